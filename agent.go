@@ -1,174 +1,651 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"log"
-	"net"
+	"reflect"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/osrg/gobgp/config"
-	"github.com/osrg/gobgp/packet/bgp"
-	"github.com/osrg/gobgp/table"
-	"github.com/packethost/packetmetadata/packetmetadata"
 	"github.com/packethost/packngo/metadata"
 
-	gobgpApi "github.com/osrg/gobgp/api"
 	gobgpServer "github.com/osrg/gobgp/server"
 )
 
+// Config holds the options a PacketBGPAgent is started with
+type Config struct {
+	MD5Password string
+	ASN         string
+	// VIPInterface is where announced addresses are placed, anything but "lo" is a dummy interface owned by the agent
+	VIPInterface string
+	// InterfacePerGroup places each VIP group on its own <VIPInterface>-<group> dummy interface
+	InterfacePerGroup bool
+	// VIPNetns is the network namespace VIP interfaces live in, empty for the agent's own
+	VIPNetns string
+	// Uplink is the interface BGP runs over, everything is withdrawn while it or all its slaves are down
+	Uplink string
+	// VIPRemovedPolicy is what happens when a VIP is removed from its interface behind the agent's back,
+	// either "restore" to put it back or "withdraw" to stop announcing it until it reappears
+	VIPRemovedPolicy string
+	// ImportTable is the kernel routing table routes received from the Packet routers are installed in,
+	// 0 disables route import
+	ImportTable int
+	// ImportPrefixes are the received prefixes that may be imported, optionally with a masklength range
+	// like "10.0.0.0/8 16..24"
+	ImportPrefixes []string
+	// StateFile is where the agent persists what it announces across restarts, empty disables it
+	StateFile string
+	// DryRun plans every change but only logs it, BGP and the VIP interfaces are left alone
+	DryRun bool
+	// Speaker is the BGP daemon announcing the prefixes: gobgp embedded in the agent, or an FRR or BIRD
+	// running on the host
+	Speaker string
+	// GRPCAddr is where the embedded gobgp serves its gRPC API
+	GRPCAddr string
+	// AddPaths is how many paths per prefix the embedded gobgp sends with ADD-PATH, so announcements
+	// can have several next hops. 0 disables ADD-PATH
+	AddPaths int
+	// Vtysh is the vtysh binary FRR is configured with
+	Vtysh string
+	// BIRDConfig is the include the BIRD speaker renders, Birdc the birdc binary that reloads BIRD and
+	// reports on its session
+	BIRDConfig string
+	Birdc      string
+	// BMPStations are the BMP collectors monitoring the embedded gobgp, unless metadata sets BGP_BMP
+	BMPStations []bmpStation
+	// BMPDefaults fills in options BGP_BMP entries leave out
+	BMPDefaults bmpStation
+	// ProcRoot is where procfs is mounted
+	ProcRoot string
+	// MRTUpdates and MRTTable are strftime style file patterns BGP updates and RIB snapshots are dumped
+	// to, empty disables that dump. Update files rotate every MRTRotation, snapshots are taken every
+	// MRTTableInterval
+	MRTUpdates       string
+	MRTTable         string
+	MRTRotation      time.Duration
+	MRTTableInterval time.Duration
+	// MRTRetention and MRTMaxFiles limit the dumps kept, 0 means no limit
+	MRTRetention time.Duration
+	MRTMaxFiles  int
+	// RPKICaches are the RTR caches (host:port) the agent's prefixes are validated against, RPKIPolicy
+	// decides what happens to prefixes that don't validate
+	RPKICaches []string
+	RPKIPolicy string
+	// PacketAPI and PacketToken are used to write BGP_STATUS back to the device, at most once every
+	// ReportInterval. No token disables reporting
+	PacketAPI      string
+	PacketToken    string
+	ReportInterval time.Duration
+	// Version is the agent's version, as reported in BGP_STATUS
+	Version string
+	// HegelAddr is the hegel gRPC endpoint metadata is watched on, plaintext if HegelInsecure is set.
+	// MetadataURL is the metadata service the device document is read from
+	HegelAddr     string
+	HegelInsecure bool
+	MetadataURL   string
+	// DrainPolicy is applied to every prefix while the device is drained and metadata doesn't name a
+	// policy: graceful-shutdown, prepend or withdraw. DrainPrepend is how often the prepend policy adds
+	// the agent's ASN
+	DrainPolicy  string
+	DrainPrepend int
+	// Profiles weight announcements against other hosts announcing the same prefixes. The device's
+	// profile is Profile unless metadata or FacilityProfiles, by facility code, pick another one
+	Profiles         map[string]announceProfile
+	FacilityProfiles map[string]string
+	Profile          string
+	// LoadCPU (percent busy), LoadBandwidth (Mbit/s on LoadInterface) and LoadConnections (as printed by
+	// LoadConnectionsScript) are the thresholds of the host load signals, 0 disables a signal. Signals
+	// are read every LoadInterval. While one is at its threshold the prefixes are de-preferred a step
+	// further, prepending LoadPrepend times, then adding LoadMED, then withdrawing, until every signal is
+	// below LoadRecover percent of its threshold. Steps are at least LoadHold apart
+	LoadCPU               int
+	LoadBandwidth         int
+	LoadInterface         string
+	LoadConnections       int
+	LoadConnectionsScript string
+	LoadInterval          time.Duration
+	LoadRecover           int
+	LoadHold              time.Duration
+	LoadPrepend           int
+	LoadMED               uint32
+	// MitigationAllowlist are the prefixes that may be blackholed or have FlowSpec rules announced, empty
+	// disables mitigation. Mitigations last MitigationDuration unless the request says otherwise, and
+	// never more than MitigationMaxDuration. Every change is appended to MitigationAuditLog
+	MitigationAllowlist   []string
+	MitigationDuration    time.Duration
+	MitigationMaxDuration time.Duration
+	MitigationAuditLog    string
+	// MeshDiscovery is how the agent finds the others it peers with over iBGP on MeshPort of the private
+	// network: static, the MeshPeers list, tag, the project's devices tagged MeshTag, or kv, the agents
+	// registered under MeshKVPrefix in the KV store at MeshKV. Empty disables the mesh. Discovery runs
+	// every MeshInterval. Prefixes without a quorum of their own need MeshMinAnnouncers agents able to
+	// announce them, and no more than MeshMaxAnnouncers announce them, 0 disables either rule
+	MeshDiscovery     string
+	MeshPeers         []string
+	MeshTag           string
+	MeshKV            string
+	MeshKVPrefix      string
+	MeshPort          int
+	MeshInterval      time.Duration
+	MeshMinAnnouncers int
+	MeshMaxAnnouncers int
+	// Schedules withhold every prefix outside, or inside, their windows unless metadata sets BGP_SCHEDULE
+	Schedules []schedule
+}
+
 // PacketBGPAgent is an agent that reads data in from Packet metadata and controls BGP announcement
 type PacketBGPAgent struct {
-	BGPServer         *gobgpServer.BgpServer
-	BGPGRPCServer     *gobgpApi.Server
-	AnnoucementIPs    []string
+	Speaker           speaker
+	Announcements     []Announcement
 	PrivateIP         *metadata.AddressInfo
-	MD5Password       string
-	ASN               string
-	announcementTable map[string][]byte
+	Metadata          *metadataClient
+	Config            Config
+	Host              hostNetwork // the agent's own network namespace
+	VIPLinks          *vipLinks
+	Importer          *routeImporter
+	BMP               *bmpManager
+	MRT               *mrtManager
+	RIB               ribReader // what gobgp received, nil unless the speaker is gobgp
+	RPKI              *rpkiValidator
+	Reporter          *statusReporter
+	State             *stateStore
+	Load              *loadController
+	Mitigations       *mitigator
+	Mesh              *mesh
+	announcementTable map[string]*announced
+	uplinkUp          bool
+	held              map[string]string // desired prefixes that aren't announced, and why
+	errors            map[string]string // desired prefixes that failed to apply, and why
+	rpkiStates        map[string]string // origin validation state of desired prefixes
+	unmet             map[string]string // desired prefixes whose advertise condition doesn't hold, and why
+	meshHeld          map[string]string // desired prefixes a mesh rule holds back, and why
+	meshView          map[string]map[string]string
+	source            string // where Announcements came from
+	sourceError       string // why the last BGP_ANNOUNCE was rejected
+	drain             string // drain policy in effect, empty when not drained
+	profile           string // announcement profile in effect
+	loadLevel         int    // how far prefixes are de-preferred because of host load
+	loadReadings      map[string]loadReading
+	hostSchedules     []schedule                  // schedules of the whole host in effect
+	schedules         map[string]scheduleStatus   // what the schedules say, by prefix and for the host
+	scheduleOverrides map[string]scheduleOverride // by prefix, empty for the host
+	lastGood          []Announcement
+	lastPlan          []planChange
+	mu                sync.Mutex
 }
 
-// NewPacketBGPAgent creates a new PacketBGPAgent
-func NewPacketBGPAgent(bgpServer *gobgpServer.BgpServer, grpcServer *gobgpApi.Server, md5Password, asn string) (*PacketBGPAgent, error) {
-	privateIP, err := getPrivateIP()
+// announced is what the agent has applied for a prefix
+type announced struct {
+	link  string
+	route *route // nil while not announced
+}
+
+// NewPacketBGPAgent creates a new PacketBGPAgent, host is its own network namespace and vipHost the one
+// VIPs are placed in
+func NewPacketBGPAgent(sp speaker, host, vipHost hostNetwork, cfg Config) (*PacketBGPAgent, error) {
+	md := newMetadataClient(cfg.HegelAddr, cfg.HegelInsecure, cfg.MetadataURL)
+	device, err := md.Device()
 	if err != nil {
 		return nil, err
 	}
+	privateIP, err := getPrivateIP(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var state *stateStore
+	if cfg.StateFile != "" {
+		state = newStateStore(cfg.StateFile)
+	}
 
-	asn64, err := strconv.ParseUint(asn, 10, 32)
+	links := newVIPLinks(vipHost, cfg.VIPInterface, cfg.InterfacePerGroup)
+	links.procRoot, links.netns, links.state = cfg.ProcRoot, cfg.VIPNetns, state
+	if !cfg.DryRun {
+		if err := links.Setup(); err != nil {
+			return nil, err
+		}
+	}
+
+	asn64, err := strconv.ParseUint(cfg.ASN, 10, 32)
 	if err != nil {
 		return nil, err
 	}
 	asn32 := uint32(asn64)
 
-	// global configuration
-	global := &config.Global{
-		Config: config.GlobalConfig{
-			As:       asn32,
-			RouterId: privateIP.Gateway.String(),
-			Port:     -1, // gobgp won't listen on tcp:179,
-		},
+	// a dry run leaves the config of a daemon shared with others alone
+	configure := !cfg.DryRun || !sp.Persistent()
+	if g, ok := sp.(*gobgpSpeaker); ok {
+		g.flowspec = len(cfg.MitigationAllowlist) > 0
+		g.addPaths = uint8(cfg.AddPaths)
+		g.multipath = cfg.ImportTable != 0
+		if cfg.MeshDiscovery != "" {
+			// mesh peers connect to the agent on the private network
+			g.listenAddr, g.listenPort = privateIP.Address.String(), int32(cfg.MeshPort)
+		}
+	}
+	if configure {
+		if err := sp.Start(asn32, privateIP.Gateway.String()); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := bgpServer.Start(global); err != nil {
+	var importer *routeImporter
+	if cfg.ImportTable != 0 {
+		g, ok := sp.(*gobgpSpeaker)
+		if !ok {
+			return nil, fmt.Errorf("route import needs the %s speaker", speakerGobgp)
+		}
+		if err := setupImportPolicy(g.server, []string{privateIP.Gateway.String()}, cfg.ImportPrefixes); err != nil {
+			return nil, err
+		}
+		importer = newRouteImporter(g.server, host, cfg.ImportTable)
+	}
+
+	if configure {
+		if err := sp.AddNeighbor(privateIP.Gateway.String(), 65530, cfg.MD5Password); err != nil {
+			return nil, err
+		}
+	}
+
+	var bmp *bmpManager
+	if g, ok := sp.(*gobgpSpeaker); ok {
+		bmp = newBMPManager(g.server, cfg.ProcRoot)
+		if err := bmp.Set(cfg.BMPStations); err != nil {
+			return nil, err
+		}
+	} else if len(cfg.BMPStations) > 0 {
+		return nil, fmt.Errorf("BMP needs the %s speaker", speakerGobgp)
+	}
+
+	var mrtDumps *mrtManager
+	if cfg.MRTUpdates != "" || cfg.MRTTable != "" {
+		g, ok := sp.(*gobgpSpeaker)
+		if !ok {
+			return nil, fmt.Errorf("MRT dumps need the %s speaker", speakerGobgp)
+		}
+		if mrtDumps, err = newMRTManager(g.server, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	var validator *rpkiValidator
+	if len(cfg.RPKICaches) > 0 {
+		g, ok := sp.(*gobgpSpeaker)
+		if !ok {
+			return nil, fmt.Errorf("RPKI validation needs the %s speaker", speakerGobgp)
+		}
+		if validator, err = newRPKIValidator(serverRIB{g.server}, asn32, cfg.RPKIPolicy); err != nil {
+			return nil, err
+		}
+		if err := addRTRCaches(g.server, cfg.RPKICaches); err != nil {
+			return nil, err
+		}
+	}
+
+	var reporter *statusReporter
+	if cfg.PacketToken != "" && !cfg.DryRun {
+		reporter = newStatusReporter(cfg.PacketAPI, cfg.PacketToken, device.ID, cfg.ReportInterval)
+	}
+
+	load, err := newLoadController(host, cfg)
+	if err != nil {
 		return nil, err
 	}
 
-	// neighbor configuration
-	n := &config.Neighbor{
-		Config: config.NeighborConfig{
-			NeighborAddress: privateIP.Gateway.String(),
-			PeerAs:          65530,
-			AuthPassword:    md5Password,
-		},
+	var embedded *gobgpServer.BgpServer // nil unless the speaker is gobgp
+	var rib ribReader
+	if g, ok := sp.(*gobgpSpeaker); ok {
+		embedded = g.server
+		rib = serverRIB{g.server}
+	}
+	mitigations, err := newMitigator(embedded, cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := bgpServer.AddNeighbor(n); err != nil {
+	agentMesh, err := newMesh(embedded, asn32, member{ID: device.ID, Address: privateIP.Address.String()}, cfg)
+	if err != nil {
 		return nil, err
 	}
 
 	return &PacketBGPAgent{
-		BGPServer:         bgpServer,
-		BGPGRPCServer:     grpcServer,
-		AnnoucementIPs:    []string{},
+		Speaker:           sp,
+		Announcements:     []Announcement{},
 		PrivateIP:         privateIP,
-		MD5Password:       md5Password,
-		ASN:               asn,
-		announcementTable: make(map[string][]byte),
+		Metadata:          md,
+		Config:            cfg,
+		Host:              host,
+		VIPLinks:          links,
+		Importer:          importer,
+		BMP:               bmp,
+		MRT:               mrtDumps,
+		RIB:               rib,
+		RPKI:              validator,
+		Reporter:          reporter,
+		State:             state,
+		Load:              load,
+		Mitigations:       mitigations,
+		Mesh:              agentMesh,
+		announcementTable: make(map[string]*announced),
+		uplinkUp:          true,
+		held:              make(map[string]string),
+		errors:            make(map[string]string),
+		rpkiStates:        make(map[string]string),
+		unmet:             make(map[string]string),
+		meshHeld:          make(map[string]string),
+		hostSchedules:     cfg.Schedules,
+		schedules:         make(map[string]scheduleStatus),
+		scheduleOverrides: make(map[string]scheduleOverride),
+		lastGood:          []Announcement{},
+		profile:           cfg.Profile,
 	}, nil
 }
 
 // EnsureIPs should be run as a go routine, watches metadata for IPs and adds them to the PacketBGPAgent
 func (agent *PacketBGPAgent) EnsureIPs(done chan bool) {
-	iterator, err := packetmetadata.Watch()
-	if err != nil {
-		log.Println(err)
-	}
+	updates := agent.Metadata.Watch(done)
 
 	for {
 		select {
 		case <-done:
-			iterator.Close()
-			break
-		default:
-			res, err := iterator.Next()
-			if err != nil {
-				log.Println(err)
-			}
-
-			annoucementIPs, ok := res.Metadata.Instance.CustomData["BGP_ANNOUNCE"]
-			if !ok {
-				log.Println("BGP_ANNOUNCE not set")
-				continue
-			}
-
-			switch a := annoucementIPs.(type) {
-			case string:
-				agent.AnnoucementIPs = []string{a}
-			case []interface{}:
-				ips := make([]string, 0)
-				for i := range a {
-					ips = append(ips, a[i].(string))
-				}
-				agent.AnnoucementIPs = ips
-			default:
+			return
+		case md := <-updates:
+			agent.ensureBMP(md.Instance.CustomData)
+			if !agent.update(md.Instance) {
 				continue
 			}
-			err = agent.EnsureBGP()
-			if err != nil {
+			if err := agent.EnsureBGP(); err != nil {
 				log.Println(err)
 			}
 		}
 	}
 }
 
-// EnsureBGP adds all IPs in agent.AnnoucementIPs to BGP server
-func (agent *PacketBGPAgent) EnsureBGP() error {
-	log.Println("ensuring announcement of the following IP blocks: ", agent.AnnoucementIPs)
+// update takes the profile, drain signal, mitigations and desired announcements from the device's metadata, and
+// reports whether they changed
+func (agent *PacketBGPAgent) update(device *metadata.CurrentDevice) bool {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	changed := false
 
-	for annIP, uuid := range agent.announcementTable {
-		exists := false
-		for _, annoucementIP := range agent.AnnoucementIPs {
-			if exists = annoucementIP == annIP; exists {
-				break
-			}
+	profile, err := selectProfile(device, agent.Config.FacilityProfiles, agent.Config.Profile)
+	if err == nil {
+		changed, err = agent.setProfile(profile)
+	}
+	if err != nil {
+		log.Println("keeping profile", agent.profile+":", err)
+	}
+
+	drain, err := parseDrain(device, agent.Config.DrainPolicy)
+	if err != nil {
+		log.Println("ignoring drain signal:", err)
+	} else if agent.setDrain(drain) {
+		changed = true
+	}
+
+	if agent.Mitigations != nil {
+		if agent.Mitigations.SetMetadata(device.CustomData["BGP_MITIGATE"], time.Now()) {
+			changed = true
 		}
-		if !exists { // if IP was previously announced but now is removed
-			_, err := agent.BGPGRPCServer.DeletePath(context.Background(), &gobgpApi.DeletePathRequest{
-				Uuid: uuid,
-			})
-			if err != nil {
-				return err
-			}
+	} else if _, ok := device.CustomData["BGP_MITIGATE"]; ok {
+		log.Println("ignoring BGP_MITIGATE, mitigation isn't enabled")
+	}
+
+	schedules := agent.Config.Schedules
+	if v, ok := device.CustomData["BGP_SCHEDULE"]; ok {
+		if schedules, err = parseSchedules(v); err != nil {
+			log.Println("ignoring BGP_SCHEDULE:", err)
+			schedules = agent.hostSchedules
+		}
+	}
+	if !reflect.DeepEqual(schedules, agent.hostSchedules) {
+		agent.hostSchedules = schedules
+		changed = true
+	}
 
-			delete(agent.announcementTable, annIP)
+	annoucementIPs, ok := device.CustomData["BGP_ANNOUNCE"]
+	if !ok {
+		log.Println("BGP_ANNOUNCE not set")
+		return changed
+	}
+
+	announcements, err := parseAnnouncements(annoucementIPs)
+	if err != nil {
+		log.Println(err)
+		agent.sourceError = err.Error()
+		agent.notifyReporter()
+		return changed
+	}
+	// writing BGP_STATUS changes metadata too, that alone shouldn't cause a reconcile
+	if agent.source != sourceMetadata || agent.sourceError != "" || !reflect.DeepEqual(agent.Announcements, announcements) {
+		changed = true
+	}
+	agent.Announcements = announcements
+	agent.source = sourceMetadata
+	agent.sourceError = ""
+	return changed
+}
+
+// ensureBMP applies the BMP stations in BGP_BMP, or the configured ones when it isn't set
+func (agent *PacketBGPAgent) ensureBMP(customData map[string]interface{}) {
+	stations := agent.Config.BMPStations
+	if v, ok := customData["BGP_BMP"]; ok {
+		if agent.BMP == nil {
+			log.Printf("ignoring BGP_BMP, BMP needs the %s speaker", speakerGobgp)
+			return
+		}
+		var err error
+		if stations, err = parseBMPStations(v, agent.Config.BMPDefaults); err != nil {
+			log.Println("invalid BGP_BMP:", err)
+			return
 		}
 	}
+	if agent.BMP == nil {
+		return
+	}
+	if err := agent.BMP.Set(stations); err != nil {
+		log.Println(err)
+	}
+}
+
+// EnsureBGP adds all IPs in agent.Announcements to BGP server
+func (agent *PacketBGPAgent) EnsureBGP() error {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	return agent.ensureBGP()
+}
 
-	for _, announceIP := range agent.AnnoucementIPs {
-		ip, ipnet, err := net.ParseCIDR(announceIP)
-		if err != nil {
-			return err
+// announcing reports whether a desired prefix should currently be announced, agent.mu must be held
+func (agent *PacketBGPAgent) announcing(prefix string) bool {
+	_, meshHeld := agent.meshHeld[prefix]
+	return agent.eligible(prefix) && !meshHeld
+}
+
+// eligible reports whether nothing but the mesh rules keeps a desired prefix from being announced,
+// agent.mu must be held
+func (agent *PacketBGPAgent) eligible(prefix string) bool {
+	_, held := agent.held[prefix]
+	_, unmet := agent.unmet[prefix]
+	return agent.uplinkUp && !held && !unmet && !agent.rpkiWithheld(prefix) && !agent.scheduleWithheld(prefix) && agent.drain != drainWithdraw && agent.loadLevel < loadWithdraw
+}
+
+func (agent *PacketBGPAgent) ensureBGP() error {
+	log.Println("ensuring announcement of the following IP blocks: ", agent.Announcements)
+
+	agent.evaluate(time.Now())
+	plan := agent.plan()
+	agent.lastPlan = plan
+
+	var err error
+	if agent.Config.DryRun {
+		for _, change := range plan {
+			log.Println("dry run, would", change)
 		}
+	} else {
+		err = agent.apply(plan)
+	}
+
+	if err == nil && len(agent.errors) == 0 {
+		agent.lastGood = agent.Announcements
+	}
+	agent.saveState()
+	return err
+}
+
+// evaluate works out which desired prefixes RPKI, their conditions, the schedules and the mesh hold back,
+// ahead of planning. agent.mu must be held
+func (agent *PacketBGPAgent) evaluate(now time.Time) {
+	agent.validateRPKI()
+	agent.evaluateConditions()
+	agent.evaluateSchedules(now)
+	agent.evaluateMesh()
+}
 
-		err = addAddr(ipnet)
-		if err != nil {
-			return err
+// prefixStatuses describes every prefix that is desired or still applied, agent.mu must be held
+func (agent *PacketBGPAgent) prefixStatuses() map[string]prefixStatus {
+	statuses := make(map[string]prefixStatus)
+	for _, announcement := range agent.Announcements {
+		status := prefixStatus{Source: agent.source, Health: healthWithdrawn}
+		if ann, ok := agent.announcementTable[announcement.Prefix]; ok {
+			status.Link = ann.link
+			status.Announced = ann.route != nil
+			status.Route = ann.route
 		}
 
-		ones, _ := ipnet.Mask.Size()
+		status.RPKI = agent.rpkiStates[announcement.Prefix]
+		status.Mesh = agent.meshView[announcement.Prefix]
+		if sched, ok := agent.schedules[announcement.Prefix]; ok {
+			status.Schedule = &sched
+		}
 
-		// add routes
-		attrs := []bgp.PathAttributeInterface{
-			bgp.NewPathAttributeOrigin(0),
-			bgp.NewPathAttributeNextHop(agent.PrivateIP.Address.String()),
+		if reason, held := agent.held[announcement.Prefix]; held {
+			status.Health, status.Reason = healthHeld, reason
+		} else if agent.rpkiWithheld(announcement.Prefix) {
+			status.Health, status.Reason = healthHeld, "RPKI "+status.RPKI
+		} else if reason, unmet := agent.unmet[announcement.Prefix]; unmet {
+			status.Health, status.Reason = healthHeld, "condition: "+reason
+		} else if reason, meshHeld := agent.meshHeld[announcement.Prefix]; meshHeld {
+			status.Health, status.Reason = healthHeld, reason
+		} else if err, failed := agent.errors[announcement.Prefix]; failed {
+			status.Health, status.Reason = healthError, err
+		} else if status.Announced {
+			status.Health = healthAnnounced
+			if mit := agent.blackholedBy(announcement.Prefix); mit != nil {
+				status.Reason = "blackholed until " + mit.Expires.Format(time.RFC3339)
+			}
+		} else if !agent.uplinkUp {
+			status.Reason = "uplink down"
+		} else if agent.scheduleWithheld(announcement.Prefix) {
+			status.Reason = agent.scheduleReason(announcement.Prefix)
+		} else if agent.drain == drainWithdraw {
+			status.Reason = "drained"
+		} else if agent.loadLevel == loadWithdraw {
+			status.Reason = "shed under load"
 		}
-		pathID, err := agent.BGPServer.AddPath("", []*table.Path{table.NewPath(nil, bgp.NewIPAddrPrefix(uint8(ones), ip.String()), false, attrs, time.Now(), false)})
-		if err != nil {
-			return err
+		statuses[announcement.Prefix] = status
+	}
+
+	for prefix, ann := range agent.announcementTable {
+		if _, ok := statuses[prefix]; ok {
+			continue
 		}
+		if mit := agent.blackholedBy(prefix); mit != nil {
+			status := prefixStatus{Source: mit.Source, Link: ann.link, Announced: ann.route != nil, Route: ann.route, Health: healthWithdrawn}
+			if status.Announced {
+				status.Health, status.Reason = healthAnnounced, "blackholed until "+mit.Expires.Format(time.RFC3339)
+			}
+			statuses[prefix] = status
+		} else { // left over, about to be cleaned up
+			statuses[prefix] = prefixStatus{Source: agent.source, Link: ann.link, Announced: ann.route != nil, Route: ann.route, Health: healthWithdrawn, Reason: "no longer desired"}
+		}
+	}
+	return statuses
+}
+
+// saveState persists the last good desired set and the status of every prefix, agent.mu must be held. A
+// dry run only reads the state file, it belongs to the agent doing the real work
+func (agent *PacketBGPAgent) saveState() {
+	agent.notifyReporter()
+	if agent.State == nil || agent.Config.DryRun {
+		return
+	}
+
+	err := agent.State.Save(&agentState{
+		Desired:  agent.lastGood,
+		Prefixes: agent.prefixStatuses(),
+		Links:    agent.VIPLinks.Owned(),
+		Updated:  time.Now(),
+	})
+	if err != nil {
+		log.Println("can't save state:", err)
+	}
+}
+
+// notifyReporter tells the status reporter, if any, that the status may have changed
+func (agent *PacketBGPAgent) notifyReporter() {
+	if agent.Reporter != nil {
+		agent.Reporter.Notify()
+	}
+}
+
+// RestoreState picks up what a previous run left behind: interfaces it created, addresses it placed,
+// and routes a persistent speaker still announces, are adopted so anything no longer desired is cleaned
+// up, and its last good set is announced until metadata has loaded
+func (agent *PacketBGPAgent) RestoreState() error {
+	if agent.State == nil {
+		return nil
+	}
+
+	state, err := agent.State.Load()
+	if err != nil {
+		return err
+	}
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	agent.VIPLinks.Adopt(state.Links)
+	for prefix, status := range state.Prefixes {
+		if _, ok := agent.announcementTable[prefix]; ok {
+			continue
+		}
+		ann := &announced{link: status.Link}
+		if agent.Speaker.Persistent() {
+			ann.route = status.Route
+		}
+		if ann.link != "" || ann.route != nil {
+			agent.announcementTable[prefix] = ann
+		}
+	}
+	if agent.source == "" {
+		log.Println("restoring last known good announcements from", agent.State.path)
+		agent.Announcements = state.Desired
+		agent.lastGood = state.Desired
+		agent.source = sourceState
+	}
+
+	return agent.ensureBGP()
+}
+
+// Stop withdraws everything from a persistent speaker, which would otherwise keep announcing prefixes
+// nobody watches over. An embedded speaker takes its announcements down with it
+func (agent *PacketBGPAgent) Stop() {
+	if !agent.Speaker.Persistent() || agent.Config.DryRun {
+		return
+	}
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
 
-		agent.announcementTable[announceIP] = pathID
+	for prefix, ann := range agent.announcementTable {
+		if ann.route == nil {
+			continue
+		}
+		if err := agent.applyChange(planChange{Action: actionWithdraw, Prefix: prefix}); err != nil {
+			log.Println(err)
+		}
 	}
-	return nil
+	agent.saveState()
 }
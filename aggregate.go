@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// maxExpandBits caps how many more-specifics a single entry expands into, at most 256
+const maxExpandBits = 8
+
+// reshape expands the entries of BGP_ANNOUNCE that ask for it into their more-specifics, then merges
+// the entries that ask to be aggregated into the fewest prefixes covering exactly them
+func reshape(anns []Announcement) ([]Announcement, error) {
+	expanded := make([]Announcement, 0, len(anns))
+	for _, ann := range anns {
+		more, err := ann.expanded()
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, more...)
+	}
+	return aggregate(expanded), nil
+}
+
+// expanded returns the more-specifics of length Expand that make up ann, ann itself if it doesn't expand
+func (ann Announcement) expanded() ([]Announcement, error) {
+	if ann.Expand == 0 {
+		return []Announcement{ann}, nil
+	}
+	if ann.Aggregate {
+		return nil, fmt.Errorf("BGP_ANNOUNCE entry %s can't both expand and aggregate", ann.Prefix)
+	}
+	_, ipnet, err := net.ParseCIDR(ann.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if ann.Expand < ones || ann.Expand > bits {
+		return nil, fmt.Errorf("BGP_ANNOUNCE entry %s can't expand into /%d", ann.Prefix, ann.Expand)
+	}
+	if ann.Expand-ones > maxExpandBits {
+		return nil, fmt.Errorf("BGP_ANNOUNCE entry %s expands into more than %d prefixes", ann.Prefix, 1<<maxExpandBits)
+	}
+
+	n := 1 << uint(ann.Expand-ones)
+	more := make([]Announcement, 0, n)
+	for i := 0; i < n; i++ {
+		m := ann
+		m.Prefix = subnet(ipnet, ann.Expand, i).String()
+		m.Expand = 0
+		more = append(more, m)
+	}
+	return more, nil
+}
+
+// subnet returns the i-th prefix of length ones within ipnet
+func subnet(ipnet *net.IPNet, ones, i int) *net.IPNet {
+	_, bits := ipnet.Mask.Size()
+	ip := make(net.IP, len(ipnet.IP))
+	copy(ip, ipnet.IP)
+	// add i to the address, shifted left by the host bits of the more-specific
+	carry := uint(i) << uint((bits-ones)%8)
+	for b := len(ip) - 1 - (bits-ones)/8; b >= 0 && carry > 0; b-- {
+		sum := uint(ip[b]) + carry&0xff
+		ip[b] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+}
+
+// aggregate merges the entries with Aggregate set that are otherwise alike: an entry covered by another
+// one goes, and two halves of a prefix become that prefix, until nothing is left to merge. A merged
+// entry takes the place of the first of them, and lists what it aggregates if it summarizes them
+func aggregate(anns []Announcement) []Announcement {
+	// entries can only be merged when their group, next hops, condition, schedule and quorum match
+	key := func(ann Announcement) string {
+		when, q := "", ""
+		if ann.When != nil {
+			when = ann.When.String()
+		}
+		if ann.Quorum != nil {
+			q = ann.Quorum.String()
+		}
+		return fmt.Sprint(ann.Group, ann.NextHops, when, ann.Schedule, q)
+	}
+
+	members := make(map[string]map[string][]string) // by key, then by merged prefix
+	for _, ann := range anns {
+		if !ann.Aggregate {
+			continue
+		}
+		k := key(ann)
+		if members[k] == nil {
+			members[k] = make(map[string][]string)
+		}
+		members[k][ann.Prefix] = []string{ann.Prefix}
+	}
+	for _, set := range members {
+		mergeCovered(set)
+		mergeSiblings(set)
+	}
+
+	result := make([]Announcement, 0, len(anns))
+	done := make(map[string]bool)
+	for _, ann := range anns {
+		if !ann.Aggregate {
+			result = append(result, ann)
+			continue
+		}
+		k := key(ann)
+		if done[k] {
+			continue
+		}
+		done[k] = true
+
+		prefixes := make([]string, 0, len(members[k]))
+		for prefix := range members[k] {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			merged := ann
+			merged.Prefix, merged.Aggregate, merged.Aggregates = prefix, false, nil
+			if covered := members[k][prefix]; summarizes(prefix, covered) {
+				sort.Strings(covered)
+				merged.Aggregates = covered
+			}
+			result = append(result, merged)
+		}
+	}
+	return result
+}
+
+// summarizes tells whether prefix stands for more specific entries that are no longer announced: it
+// merged at least two of them, and isn't one of them itself
+func summarizes(prefix string, covered []string) bool {
+	if len(covered) < 2 {
+		return false
+	}
+	for _, c := range covered {
+		if c == prefix {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeCovered folds every prefix of set that lies within another one into it
+func mergeCovered(set map[string][]string) {
+	for prefix := range set {
+		_, inner, _ := net.ParseCIDR(prefix)
+		innerOnes, _ := inner.Mask.Size()
+		for other := range set {
+			_, outer, _ := net.ParseCIDR(other)
+			outerOnes, _ := outer.Mask.Size()
+			if other != prefix && outerOnes < innerOnes && outer.Contains(inner.IP) {
+				set[other] = append(set[other], set[prefix]...)
+				delete(set, prefix)
+				break
+			}
+		}
+	}
+}
+
+// mergeSiblings replaces both halves of a prefix with the prefix, until no two halves are left
+func mergeSiblings(set map[string][]string) {
+	for merged := true; merged; {
+		merged = false
+		for prefix := range set {
+			_, ipnet, _ := net.ParseCIDR(prefix)
+			ones, bits := ipnet.Mask.Size()
+			if ones == 0 {
+				continue
+			}
+			parent := &net.IPNet{IP: ipnet.IP.Mask(net.CIDRMask(ones-1, bits)), Mask: net.CIDRMask(ones-1, bits)}
+			lower, upper := subnet(parent, ones, 0).String(), subnet(parent, ones, 1).String()
+			if _, ok := set[lower]; !ok {
+				continue
+			}
+			if _, ok := set[upper]; !ok {
+				continue
+			}
+			set[parent.String()] = append(set[lower], set[upper]...)
+			delete(set, lower)
+			delete(set, upper)
+			merged = true
+			break
+		}
+	}
+}
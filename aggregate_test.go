@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	anns, err := parseAnnouncements([]interface{}{
+		map[string]interface{}{"prefix": "192.0.2.0/30", "expand": 32, "group": "web"},
+		map[string]interface{}{"prefix": "2001:db8::/63", "expand": 64},
+		"198.51.100.0/24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(anns))
+	for _, ann := range anns {
+		got = append(got, ann.Prefix+" "+ann.Group)
+	}
+	want := "[192.0.2.0/32 web 192.0.2.1/32 web 192.0.2.2/32 web 192.0.2.3/32 web 2001:db8::/64  2001:db8:0:1::/64  198.51.100.0/24 ]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("expanded into %s, want %s", got, want)
+	}
+
+	// carrying into the next byte
+	if got, want := subnet(&net.IPNet{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.CIDRMask(22, 32)}, 24, 3).String(), "10.0.3.0/24"; got != want {
+		t.Errorf("fourth /24 of 10.0.0.0/22 is %s, want %s", got, want)
+	}
+
+	for _, invalid := range []interface{}{
+		map[string]interface{}{"prefix": "192.0.2.0/24", "expand": 16},
+		map[string]interface{}{"prefix": "192.0.2.0/24", "expand": 33},
+		map[string]interface{}{"prefix": "192.0.0.0/16", "expand": 32},
+		map[string]interface{}{"prefix": "192.0.2.0/24", "expand": 32, "aggregate": true},
+	} {
+		if anns, err := parseAnnouncements([]interface{}{invalid}); err == nil {
+			t.Errorf("accepted %v as %+v", invalid, anns)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	entry := func(prefix string) map[string]interface{} {
+		return map[string]interface{}{"prefix": prefix, "aggregate": true}
+	}
+	anns, err := parseAnnouncements([]interface{}{
+		"203.0.113.7/32",
+		entry("192.0.2.4/32"), entry("192.0.2.5/32"), entry("192.0.2.6/31"),
+		entry("192.0.2.9/32"),
+		entry("198.51.100.0/24"), entry("198.51.100.128/25"),
+		map[string]interface{}{"prefix": "192.0.2.7/32", "aggregate": true, "group": "other"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(anns))
+	for _, ann := range anns {
+		got = append(got, fmt.Sprintf("%s %v", ann.Prefix, ann.Aggregates))
+	}
+	want := "[203.0.113.7/32 [] 192.0.2.4/30 [192.0.2.4/32 192.0.2.5/32 192.0.2.6/31] 192.0.2.9/32 [] " +
+		"198.51.100.0/24 [] 192.0.2.7/32 []]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("aggregated into %s, want %s", got, want)
+	}
+
+	// an entry can't make itself an aggregate
+	if ann, err := parseAnnouncement(map[string]interface{}{"prefix": "203.0.113.8/32", "aggregates": []interface{}{"203.0.113.8/32"}}); err != nil || ann.Aggregates != nil {
+		t.Errorf("entry setting aggregates parsed as %+v, %v", ann, err)
+	}
+
+	for _, base := range []string{"lo", "vip"} {
+		n, sp := newFakeNetwork(), newFakeSpeaker(false)
+		agent := newTestAgent(Config{VIPInterface: base}, sp, n)
+		if err := desire(agent, anns...); err != nil {
+			t.Fatal(err)
+		}
+		if r := sp.routes["192.0.2.4/30"]; r == nil || r.Aggregator != testPrivateIP {
+			t.Errorf("aggregate announced as %+v, want aggregator %s", r, testPrivateIP)
+		}
+		// covering another entry summarizes nothing
+		for _, prefix := range []string{"192.0.2.9/32", "198.51.100.0/24"} {
+			if r := sp.routes[prefix]; r == nil || r.Aggregator != "" {
+				t.Errorf("%s announced as %+v, want no aggregator", prefix, r)
+			}
+		}
+		if placed := fmt.Sprint(n.placed(base)); placed != "[192.0.2.4/30 192.0.2.7/32 192.0.2.9/32 198.51.100.0/24 203.0.113.7/32]" {
+			t.Errorf("addresses on %s are %s", base, placed)
+		}
+		// an aggregate is placed as one address, every one it stands for is answered
+		for _, ip := range []string{"192.0.2.4", "192.0.2.5", "192.0.2.6", "198.51.100.200"} {
+			if !n.local(ip) {
+				t.Errorf("%s of an aggregate placed on %s isn't local", ip, base)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// Announcement is a single entry of BGP_ANNOUNCE
+type Announcement struct {
+	Prefix string `json:"prefix"`
+	Group  string `json:"group,omitempty"`
+	// When, if set, only announces the prefix while the condition holds
+	When *advertiseCondition `json:"when,omitempty"`
+	// NextHops replace the agent's private IP as next hop, several are announced as separate paths
+	NextHops nextHops `json:"next_hop,omitempty"`
+	// Expand, if set, announces the more-specifics of that length instead of the prefix
+	Expand int `json:"expand,omitempty"`
+	// Aggregate merges the entry with others that are alike into the prefixes covering them
+	Aggregate bool `json:"aggregate,omitempty"`
+	// Schedule, if set, only announces the prefix inside its windows, or withdraws it inside them. It's one
+	// schedule or a list of them, which all have to allow the prefix
+	Schedule scheduleList `json:"schedule,omitempty"`
+	// Quorum, if set, replaces the mesh-wide limits on how many agents announce the prefix
+	Quorum *quorum `json:"quorum,omitempty"`
+	// Aggregates are the entries merged into this one, it's announced as an aggregate when set
+	Aggregates []string `json:"aggregates,omitempty"`
+}
+
+// nextHops is one next hop or a list of them, in JSON either a string or an array of strings
+type nextHops []string
+
+func (n *nextHops) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*n = nextHops{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("next_hop must be an address or a list of them")
+	}
+	if len(many) > 0 {
+		*n = many
+	}
+	return nil
+}
+
+// normalize checks every next hop is an address of the same family as prefix, and listed once
+func (n nextHops) normalize(prefix net.IP) error {
+	seen := make(map[string]bool)
+	for i, hop := range n {
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			return fmt.Errorf("next hop %q isn't an IP address", hop)
+		}
+		if (ip.To4() == nil) != (prefix.To4() == nil) {
+			return fmt.Errorf("next hop %s isn't the same address family", hop)
+		}
+		n[i] = ip.String()
+		if seen[n[i]] {
+			return fmt.Errorf("next hop %s is listed twice", hop)
+		}
+		seen[n[i]] = true
+	}
+	return nil
+}
+
+// parseAnnouncements reads BGP_ANNOUNCE, which is either a single prefix string or an array whose entries
+// are prefix strings or objects like {"prefix": "X.X.X.X/XX", "group": "web", "next_hop": ["A.A.A.A",
+// "B.B.B.B"], "when": {"absent": "Y.Y.Y.Y/YY"}, "quorum": {"min": 2}}. Prefixes are normalized to their network address, and
+// entries with "expand" or "aggregate" reshaped into the prefixes they stand for
+func parseAnnouncements(v interface{}) ([]Announcement, error) {
+	switch a := v.(type) {
+	case string:
+		ann, err := parseAnnouncement(a)
+		if err != nil {
+			return nil, err
+		}
+		return reshape([]Announcement{ann})
+	case []interface{}:
+		anns := make([]Announcement, 0, len(a))
+		for i := range a {
+			ann, err := parseAnnouncement(a[i])
+			if err != nil {
+				return nil, err
+			}
+			anns = append(anns, ann)
+		}
+		return reshape(anns)
+	default:
+		return nil, fmt.Errorf("BGP_ANNOUNCE has unexpected type %T", v)
+	}
+}
+
+func parseAnnouncement(v interface{}) (Announcement, error) {
+	var ann Announcement
+	switch e := v.(type) {
+	case string:
+		ann.Prefix = e
+	case map[string]interface{}:
+		b, err := json.Marshal(e)
+		if err != nil {
+			return ann, err
+		}
+		if err := json.Unmarshal(b, &ann); err != nil {
+			return ann, err
+		}
+	default:
+		return ann, fmt.Errorf("BGP_ANNOUNCE entry has unexpected type %T", v)
+	}
+	if ann.Prefix == "" {
+		return ann, fmt.Errorf("BGP_ANNOUNCE entry %v has no prefix", v)
+	}
+	// only aggregating sets these
+	ann.Aggregates = nil
+	ip, ipnet, err := net.ParseCIDR(ann.Prefix)
+	if err != nil {
+		return ann, err
+	}
+	ann.Prefix = ipnet.String()
+	if err := ann.NextHops.normalize(ip); err != nil {
+		return ann, fmt.Errorf("BGP_ANNOUNCE entry %s: %s", ann.Prefix, err)
+	}
+	if ann.When != nil {
+		if err := ann.When.normalize(); err != nil {
+			return ann, fmt.Errorf("BGP_ANNOUNCE entry %s: %s", ann.Prefix, err)
+		}
+	}
+	if err := ann.Schedule.normalize(); err != nil {
+		return ann, fmt.Errorf("BGP_ANNOUNCE entry %s: %s", ann.Prefix, err)
+	}
+	if ann.Quorum != nil {
+		if err := ann.Quorum.normalize(); err != nil {
+			return ann, fmt.Errorf("BGP_ANNOUNCE entry %s: %s", ann.Prefix, err)
+		}
+	}
+	return ann, nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// agentStatus is what the agent reports on /status
+type agentStatus struct {
+	DryRun      bool                    `json:"dry_run"`
+	UplinkUp    bool                    `json:"uplink_up"`
+	Session     string                  `json:"session"`
+	Source      string                  `json:"source"`
+	Profile     string                  `json:"profile"`
+	Drain       string                  `json:"drain,omitempty"` // drain policy in effect
+	Load        *loadStatus             `json:"load,omitempty"`
+	Mitigations []mitigation            `json:"mitigations,omitempty"`
+	Prefixes    map[string]prefixStatus `json:"prefixes"`
+	BMP         []bmpStatus             `json:"bmp,omitempty"`
+	RPKI        []rpkiCacheStatus       `json:"rpki,omitempty"`
+	Mesh        map[string]string       `json:"mesh,omitempty"`     // session state of every mesh peer
+	Schedule    *scheduleStatus         `json:"schedule,omitempty"` // what the whole host's schedules say
+}
+
+// loadStatus is how far host load has the agent de-prefer its prefixes, and why
+type loadStatus struct {
+	Level   string                 `json:"level"`
+	Signals map[string]loadReading `json:"signals"`
+}
+
+// Status reports the current state of every prefix, BMP station and RTR cache
+func (agent *PacketBGPAgent) Status() agentStatus {
+	session, err := agent.Speaker.SessionState()
+	if err != nil {
+		session = "unknown"
+	}
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	status := agentStatus{
+		DryRun:   agent.Config.DryRun,
+		UplinkUp: agent.uplinkUp,
+		Session:  session,
+		Source:   agent.source,
+		Profile:  agent.profile,
+		Drain:    agent.drain,
+		Prefixes: agent.prefixStatuses(),
+	}
+	if agent.Load != nil {
+		status.Load = &loadStatus{Level: loadLevels[agent.loadLevel], Signals: agent.loadReadings}
+	}
+	if agent.Mitigations != nil {
+		status.Mitigations = agent.Mitigations.List()
+	}
+	if agent.BMP != nil {
+		status.BMP = agent.BMP.Status()
+	}
+	if agent.RPKI != nil {
+		status.RPKI = agent.RPKI.Caches()
+	}
+	if agent.Mesh != nil {
+		status.Mesh = agent.Mesh.Sessions()
+	}
+	if host := agent.schedules[hostSchedule]; len(agent.hostSchedules) > 0 || host.Override != nil {
+		status.Schedule = &host
+	}
+	return status
+}
+
+// ServeControl should be run as a go routine, serves the status and control API on addr
+func (agent *PacketBGPAgent) ServeControl(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", agent.handleStatus)
+	mux.HandleFunc("/plan", agent.handlePlan)
+	mux.HandleFunc("/metrics", agent.handleMetrics)
+	mux.HandleFunc("/mrt/dump", agent.handleMRTDump)
+	mux.HandleFunc("/mitigations", agent.handleMitigations)
+	mux.HandleFunc("/schedule", agent.handleSchedule)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("control API stopped:", err)
+	}
+}
+
+func (agent *PacketBGPAgent) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, agent.Status())
+}
+
+// handlePlan returns the changes from the last reconcile as a diff, or as JSON with ?format=json
+func (agent *PacketBGPAgent) handlePlan(w http.ResponseWriter, r *http.Request) {
+	plan := agent.Plan()
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, plan)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	for _, change := range plan {
+		fmt.Fprintln(w, change)
+	}
+}
+
+// handleMetrics reports status in the Prometheus text format
+func (agent *PacketBGPAgent) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	status := agent.Status()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP packet_bgp_agent_uplink_up Whether the uplink is up.")
+	fmt.Fprintln(w, "# TYPE packet_bgp_agent_uplink_up gauge")
+	fmt.Fprintln(w, "packet_bgp_agent_uplink_up", boolMetric(status.UplinkUp))
+
+	prefixes := make([]string, 0, len(status.Prefixes))
+	for prefix := range status.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	fmt.Fprintln(w, "# HELP packet_bgp_agent_profile Announcement profile in effect, 1 for the current one.")
+	fmt.Fprintln(w, "# TYPE packet_bgp_agent_profile gauge")
+	for _, name := range profileNames(agent.Config.Profiles) {
+		fmt.Fprintf(w, "packet_bgp_agent_profile{profile=%q} %d\n", name, boolMetric(status.Profile == name))
+	}
+
+	fmt.Fprintln(w, "# HELP packet_bgp_agent_drained Whether the device is drained.")
+	fmt.Fprintln(w, "# TYPE packet_bgp_agent_drained gauge")
+	fmt.Fprintln(w, "packet_bgp_agent_drained", boolMetric(status.Drain != ""))
+
+	if status.Load != nil {
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_load_level How far host load has the prefixes de-preferred, 0 (normal) to 3 (withdrawn).")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_load_level gauge")
+		fmt.Fprintln(w, "packet_bgp_agent_load_level", loadLevelIndex(status.Load.Level))
+
+		signals := make([]string, 0, len(status.Load.Signals))
+		for name := range status.Load.Signals {
+			signals = append(signals, name)
+		}
+		sort.Strings(signals)
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_load_signal Last value read from a host load signal.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_load_signal gauge")
+		for _, name := range signals {
+			fmt.Fprintf(w, "packet_bgp_agent_load_signal{signal=%q} %g\n", name, status.Load.Signals[name].Value)
+		}
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_load_threshold Threshold of a host load signal.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_load_threshold gauge")
+		for _, name := range signals {
+			fmt.Fprintf(w, "packet_bgp_agent_load_threshold{signal=%q} %g\n", name, status.Load.Signals[name].Threshold)
+		}
+	}
+
+	if agent.Mitigations != nil {
+		kinds := map[string]int{"blackhole": 0, "flowspec": 0}
+		for _, mit := range status.Mitigations {
+			if mit.Blackhole != "" {
+				kinds["blackhole"]++
+			} else {
+				kinds["flowspec"]++
+			}
+		}
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_mitigations Mitigations in effect.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_mitigations gauge")
+		for _, kind := range []string{"blackhole", "flowspec"} {
+			fmt.Fprintf(w, "packet_bgp_agent_mitigations{kind=%q} %d\n", kind, kinds[kind])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP packet_bgp_agent_session_established Whether the session to the Packet router is established.")
+	fmt.Fprintln(w, "# TYPE packet_bgp_agent_session_established gauge")
+	fmt.Fprintln(w, "packet_bgp_agent_session_established", boolMetric(status.Session == "established"))
+
+	fmt.Fprintln(w, "# HELP packet_bgp_agent_prefix_announced Whether a prefix is announced.")
+	fmt.Fprintln(w, "# TYPE packet_bgp_agent_prefix_announced gauge")
+	for _, prefix := range prefixes {
+		p := status.Prefixes[prefix]
+		fmt.Fprintf(w, "packet_bgp_agent_prefix_announced{prefix=%q,health=%q} %d\n", prefix, p.Health, boolMetric(p.Announced))
+	}
+
+	if status.RPKI != nil {
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_prefix_rpki_state Origin validation state of a prefix, 1 for the current one.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_prefix_rpki_state gauge")
+		for _, prefix := range prefixes {
+			if p := status.Prefixes[prefix]; p.RPKI != "" {
+				for _, state := range []string{rpkiValid, rpkiInvalid, rpkiNotFound, rpkiUnknown} {
+					fmt.Fprintf(w, "packet_bgp_agent_prefix_rpki_state{prefix=%q,state=%q} %d\n", prefix, state, boolMetric(p.RPKI == state))
+				}
+			}
+		}
+
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_rpki_cache_up Whether an RTR cache is connected.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_rpki_cache_up gauge")
+		for _, cache := range status.RPKI {
+			fmt.Fprintf(w, "packet_bgp_agent_rpki_cache_up{cache=%q} %d\n", cache.Address, boolMetric(cache.Up))
+		}
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_rpki_cache_roas ROAs received from an RTR cache.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_rpki_cache_roas gauge")
+		for _, cache := range status.RPKI {
+			fmt.Fprintf(w, "packet_bgp_agent_rpki_cache_roas{cache=%q} %d\n", cache.Address, cache.ROAs)
+		}
+	}
+
+	if status.Mesh != nil {
+		peers := make([]string, 0, len(status.Mesh))
+		for peer := range status.Mesh {
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_mesh_peer_established Whether the session to a mesh peer is established.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_mesh_peer_established gauge")
+		for _, peer := range peers {
+			fmt.Fprintf(w, "packet_bgp_agent_mesh_peer_established{peer=%q} %d\n", peer, boolMetric(status.Mesh[peer] == "established"))
+		}
+
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_mesh_announcers Agents announcing a prefix, this one included.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_mesh_announcers gauge")
+		for _, prefix := range prefixes {
+			p := status.Prefixes[prefix]
+			announcers := boolMetric(p.Announced)
+			for _, state := range p.Mesh {
+				announcers += boolMetric(state == meshAnnounced)
+			}
+			fmt.Fprintf(w, "packet_bgp_agent_mesh_announcers{prefix=%q} %d\n", prefix, announcers)
+		}
+	}
+
+	if status.Schedule != nil {
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_schedule_withheld Whether the whole host's schedules withhold its prefixes.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_schedule_withheld gauge")
+		fmt.Fprintln(w, "packet_bgp_agent_schedule_withheld", boolMetric(status.Schedule.Withheld))
+	}
+	fmt.Fprintln(w, "# HELP packet_bgp_agent_schedule_next_transition_seconds When the schedule of a prefix next changes, as a Unix timestamp.")
+	fmt.Fprintln(w, "# TYPE packet_bgp_agent_schedule_next_transition_seconds gauge")
+	for _, prefix := range prefixes {
+		if sched := status.Prefixes[prefix].Schedule; sched != nil && sched.NextTransition != nil {
+			fmt.Fprintf(w, "packet_bgp_agent_schedule_next_transition_seconds{prefix=%q} %d\n", prefix, sched.NextTransition.Unix())
+		}
+	}
+
+	if status.BMP != nil {
+		fmt.Fprintln(w, "# HELP packet_bgp_agent_bmp_station_up Whether a BMP station is connected.")
+		fmt.Fprintln(w, "# TYPE packet_bgp_agent_bmp_station_up gauge")
+		for _, station := range status.BMP {
+			fmt.Fprintf(w, "packet_bgp_agent_bmp_station_up{station=%q} %d\n", station.Address, boolMetric(station.Connected))
+		}
+	}
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// handleMRTDump writes a RIB snapshot right away, POST only
+func (agent *PacketBGPAgent) handleMRTDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if agent.MRT == nil {
+		http.Error(w, "MRT dumps aren't configured", http.StatusNotFound)
+		return
+	}
+
+	file, err := agent.MRT.DumpNow()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{"file": file})
+}
+
+// handleMitigations lists the mitigations in effect on GET, adds one on POST and removes the one named by
+// ?id= on DELETE
+func (agent *PacketBGPAgent) handleMitigations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, agent.Status().Mitigations)
+	case http.MethodPost:
+		var req mitigationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mit, err := agent.Mitigate(req, r.RemoteAddr)
+		if mit == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		writeJSON(w, mit)
+	case http.MethodDelete:
+		if err := agent.Unmitigate(r.URL.Query().Get("id"), r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// scheduleRequest overrides the schedules of a prefix, or of the whole host without one, until Until or for
+// Duration, or else until the next scheduled transition
+type scheduleRequest struct {
+	Prefix   string    `json:"prefix,omitempty"`
+	Announce bool      `json:"announce"`
+	Until    time.Time `json:"until,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+// handleSchedule shows what the schedules say on GET, overrides them on POST and clears the override of
+// ?prefix=, or of the whole host without it, on DELETE
+func (agent *PacketBGPAgent) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// a slow client mustn't hold up the reconciler, the statuses are written after unlocking
+		agent.mu.Lock()
+		schedules := make(map[string]scheduleStatus)
+		for key, status := range agent.schedules {
+			if key == hostSchedule {
+				key = "host"
+			}
+			schedules[key] = status
+		}
+		agent.mu.Unlock()
+		writeJSON(w, schedules)
+	case http.MethodPost:
+		var req scheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		until := req.Until
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			until = time.Now().Add(d)
+		}
+		if req.Prefix != "" {
+			_, ipnet, err := net.ParseCIDR(req.Prefix)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Prefix = ipnet.String()
+		}
+		status, err := agent.Override(req.Prefix, req.Announce, until)
+		if status == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		writeJSON(w, status)
+	case http.MethodDelete:
+		prefix := r.URL.Query().Get("prefix")
+		if prefix != "" {
+			_, ipnet, err := net.ParseCIDR(prefix)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			prefix = ipnet.String()
+		}
+		if err := agent.ClearOverride(prefix); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
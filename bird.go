@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// birdTemplate is the include the BIRD 2 config pulls in. The agent's routes live in their own tables so
+// they never reach the kernel protocol, and only they are exported to the Packet routers
+var birdTemplate = template.Must(template.New("bird").Parse(`# generated by packet-bgp-agent, changes will be overwritten
+ipv4 table packet_bgp_agent4;
+ipv6 table packet_bgp_agent6;
+
+protocol static packet_bgp_agent4 {
+	ipv4 { table packet_bgp_agent4; };
+{{- range .V4 }}
+	route {{ .Prefix }} blackhole { {{ .Attrs }} };
+{{- end }}
+}
+
+protocol static packet_bgp_agent6 {
+	ipv6 { table packet_bgp_agent6; };
+{{- range .V6 }}
+	route {{ .Prefix }} blackhole { {{ .Attrs }} };
+{{- end }}
+}
+{{ if .Neighbor }}
+protocol bgp packet_bgp_agent {
+	local as {{ .ASN }};
+	neighbor {{ .Neighbor }} as {{ .PeerAS }};
+{{- if .Password }}
+	password "{{ .Password }}";
+{{- end }}
+	ipv4 {
+		table packet_bgp_agent4;
+		import none;
+		export all;
+	};
+	ipv6 {
+		table packet_bgp_agent6;
+		import none;
+		export all;
+		extended next hop on;
+	};
+}
+{{- end }}
+`))
+
+// birdRouteLine matches the routes birdTemplate renders, birdAttr the statements setting their attributes
+var (
+	birdRouteLine = regexp.MustCompile(`(?m)^\s*route (\S+) blackhole \{ (.*) \};$`)
+	birdAttr      = regexp.MustCompile(`bgp_next_hop = ([^;\s]+);|bgp_med = (\d+);|bgp_community\.add\(\((\d+),(\d+)\)\);|bgp_path\.prepend\(\d+\);`)
+)
+
+type birdRoute struct {
+	Prefix string
+	Attrs  string
+}
+
+// birdAttrs renders the statements setting the attributes of r, asn is what gets prepended
+func birdAttrs(r *route, asn uint32) (string, error) {
+	attrs := []string{"bgp_next_hop = " + r.NextHop + ";"}
+	if r.MED > 0 {
+		attrs = append(attrs, fmt.Sprintf("bgp_med = %d;", r.MED))
+	}
+	for _, c := range r.Communities {
+		community, err := parseCommunity(c)
+		if err != nil {
+			return "", err
+		}
+		attrs = append(attrs, fmt.Sprintf("bgp_community.add((%d,%d));", community>>16, community&0xffff))
+	}
+	for i := 0; i < r.Prepend; i++ {
+		attrs = append(attrs, fmt.Sprintf("bgp_path.prepend(%d);", asn))
+	}
+	return strings.Join(attrs, " "), nil
+}
+
+// parseBIRDAttrs reads back what birdAttrs rendered
+func parseBIRDAttrs(s string) *route {
+	r := &route{}
+	for _, m := range birdAttr.FindAllStringSubmatch(s, -1) {
+		switch {
+		case m[1] != "":
+			r.NextHop = m[1]
+		case m[2] != "":
+			med, _ := strconv.ParseUint(m[2], 10, 32)
+			r.MED = uint32(med)
+		case m[3] != "":
+			r.Communities = append(r.Communities, m[3]+":"+m[4])
+		default:
+			r.Prepend++
+		}
+	}
+	return r
+}
+
+// birdSpeaker announces through a BIRD already running on the host, by rendering a config include and
+// reloading BIRD after every change
+type birdSpeaker struct {
+	path     string
+	birdc    string
+	asn      uint32
+	neighbor string
+	peerAS   uint32
+	password string
+	routes   map[string]*route
+}
+
+// newBIRDSpeaker picks up the routes a previous run left in the include, so they stay announced until
+// the agent decides otherwise
+func newBIRDSpeaker(path, birdc string) (*birdSpeaker, error) {
+	b := &birdSpeaker{
+		path:   path,
+		birdc:  birdc,
+		routes: make(map[string]*route),
+	}
+
+	existing, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range birdRouteLine.FindAllStringSubmatch(string(existing), -1) {
+		b.routes[m[1]] = parseBIRDAttrs(m[2])
+	}
+	return b, nil
+}
+
+// render writes the include and reloads BIRD
+func (b *birdSpeaker) render() error {
+	data := struct {
+		ASN      uint32
+		Neighbor string
+		PeerAS   uint32
+		Password string
+		V4, V6   []birdRoute
+	}{
+		ASN:      b.asn,
+		Neighbor: b.neighbor,
+		PeerAS:   b.peerAS,
+		Password: strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(b.password),
+	}
+
+	prefixes := make([]string, 0, len(b.routes))
+	for prefix := range b.routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		ip, _, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return err
+		}
+		attrs, err := birdAttrs(b.routes[prefix], b.asn)
+		if err != nil {
+			return err
+		}
+		if ip.To4() != nil {
+			data.V4 = append(data.V4, birdRoute{Prefix: prefix, Attrs: attrs})
+		} else {
+			data.V6 = append(data.V6, birdRoute{Prefix: prefix, Attrs: attrs})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := birdTemplate.Execute(&buf, data); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(b.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	out, err := exec.Command(b.birdc, "configure").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("birdc configure: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Start renders the include without a session, the router id belongs to whoever runs BIRD
+func (b *birdSpeaker) Start(asn uint32, routerID string) error {
+	b.asn = asn
+	return b.render()
+}
+
+func (b *birdSpeaker) AddNeighbor(address string, peerAS uint32, password string) error {
+	b.neighbor, b.peerAS, b.password = address, peerAS, password
+	return b.render()
+}
+
+func (b *birdSpeaker) Announce(prefix string, r *route) error {
+	if len(r.ECMP) > 0 {
+		return fmt.Errorf("several next hops need the %s speaker", speakerGobgp)
+	}
+	if r.Aggregator != "" {
+		return fmt.Errorf("aggregates need the %s or %s speaker", speakerGobgp, speakerFRR)
+	}
+	b.routes[prefix] = r
+	return b.render()
+}
+
+func (b *birdSpeaker) Withdraw(prefix string) error {
+	if _, ok := b.routes[prefix]; !ok {
+		return nil
+	}
+	delete(b.routes, prefix)
+	return b.render()
+}
+
+func (b *birdSpeaker) Persistent() bool {
+	return true
+}
+
+// SessionState reads the info column of the session in birdc's protocol list
+func (b *birdSpeaker) SessionState() (string, error) {
+	out, err := exec.Command(b.birdc, "show", "protocols", "packet_bgp_agent").Output()
+	if err != nil {
+		return "", fmt.Errorf("birdc: %s", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "packet_bgp_agent" {
+			return strings.ToLower(fields[len(fields)-1]), nil
+		}
+	}
+	return "", fmt.Errorf("birdc: no packet_bgp_agent protocol")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const birdProtocols = `BIRD 2.0.7 ready.
+Name       Proto      Table      State  Since         Info
+device1    Device     ---        up     12:00:00.000
+packet_bgp_agent BGP        ---        up     12:00:01.000  Established
+`
+
+func TestBIRDAttrs(t *testing.T) {
+	for _, r := range []*route{
+		{NextHop: "10.99.0.2"},
+		{NextHop: "10.99.0.2", MED: 100, Communities: []string{"65000:100", "65535:0"}, Prepend: 3},
+		{NextHop: "2001:db8:1::2", Prepend: 1},
+	} {
+		attrs, err := birdAttrs(r, 65000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parseBIRDAttrs(attrs); !reflect.DeepEqual(got, r) {
+			t.Errorf("%+v rendered as %q reads back as %+v", r, attrs, got)
+		}
+	}
+	if _, err := birdAttrs(&route{NextHop: "10.99.0.2", Communities: []string{"65536:0"}}, 65000); err == nil {
+		t.Error("rendered an invalid community")
+	}
+}
+
+func TestBIRDSpeaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-bird")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	birdc, runs := fakeCommand(t, dir, "birdc", birdProtocols)
+	path := filepath.Join(dir, "packet-bgp-agent.conf")
+
+	b, err := newBIRDSpeaker(path, birdc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(65000, "10.99.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddNeighbor("10.99.0.1", 65530, `hunter"2`); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Announce("192.0.2.1/32", &route{NextHop: "10.99.0.2", MED: 10, Prepend: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Announce("2001:db8::/64", &route{NextHop: "2001:db8:1::2", Communities: []string{"65000:100"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Announce("192.0.2.2/32", &route{NextHop: "10.99.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Withdraw("192.0.2.2/32"); err != nil {
+		t.Fatal(err)
+	}
+	// every change reloads BIRD, withdrawing what isn't announced doesn't change anything
+	if err := b.Withdraw("192.0.2.3/32"); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "birdc", runs(), "configure", "configure", "configure", "configure", "configure", "configure")
+
+	rendered, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# generated by packet-bgp-agent, changes will be overwritten
+ipv4 table packet_bgp_agent4;
+ipv6 table packet_bgp_agent6;
+
+protocol static packet_bgp_agent4 {
+	ipv4 { table packet_bgp_agent4; };
+	route 192.0.2.1/32 blackhole { bgp_next_hop = 10.99.0.2; bgp_med = 10; bgp_path.prepend(65000); };
+}
+
+protocol static packet_bgp_agent6 {
+	ipv6 { table packet_bgp_agent6; };
+	route 2001:db8::/64 blackhole { bgp_next_hop = 2001:db8:1::2; bgp_community.add((65000,100)); };
+}
+
+protocol bgp packet_bgp_agent {
+	local as 65000;
+	neighbor 10.99.0.1 as 65530;
+	password "hunter\"2";
+	ipv4 {
+		table packet_bgp_agent4;
+		import none;
+		export all;
+	};
+	ipv6 {
+		table packet_bgp_agent6;
+		import none;
+		export all;
+		extended next hop on;
+	};
+}
+`
+	if string(rendered) != want {
+		t.Errorf("rendered\n%s\nwant\n%s", rendered, want)
+	}
+
+	if state, err := b.SessionState(); err != nil || state != "established" {
+		t.Errorf("session state is %q, %v, want established", state, err)
+	}
+	if err := b.Announce("192.0.2.2/32", &route{NextHop: "10.99.0.2", ECMP: []string{"10.99.0.3"}}); err == nil {
+		t.Error("announced several next hops")
+	}
+	if err := b.Announce("192.0.2.2/32", &route{NextHop: "10.99.0.2", Aggregator: "10.99.0.2"}); err == nil {
+		t.Error("announced an aggregate")
+	}
+
+	// the next run picks up what this one announced
+	restarted, err := newBIRDSpeaker(path, birdc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restarted.routes, b.routes) {
+		t.Errorf("picked up %v from the include, want %v", restarted.routes, b.routes)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+const (
+	bmpPrePolicy  = "pre-policy"
+	bmpPostPolicy = "post-policy"
+	bmpAll        = "all"
+
+	// tcpEstablished is the TCP_ESTABLISHED state in /proc/net/tcp
+	tcpEstablished = "01"
+)
+
+// bmpStation is a BMP collector the agent's sessions are monitored by
+type bmpStation struct {
+	Address       string `json:"address"`                  // host:port
+	Policy        string `json:"policy,omitempty"`         // pre-policy, post-policy or all
+	StatsInterval int    `json:"stats_interval,omitempty"` // seconds between statistics reports, 0 disables them
+}
+
+// bmpStatus is how a station is doing, Since is when it last connected or disconnected
+type bmpStatus struct {
+	bmpStation
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+}
+
+// parseBMPStations reads a list of stations, either "host:port[ policy[ stats-interval]]" strings or
+// objects like {"address": "10.0.0.1:11019", "policy": "post-policy"}. Missing options are taken from def
+func parseBMPStations(v interface{}, def bmpStation) ([]bmpStation, error) {
+	var entries []interface{}
+	switch e := v.(type) {
+	case string:
+		entries = []interface{}{e}
+	case []interface{}:
+		entries = e
+	default:
+		return nil, fmt.Errorf("BMP stations have unexpected type %T", v)
+	}
+
+	stations := make([]bmpStation, 0, len(entries))
+	for _, entry := range entries {
+		station := def
+		switch e := entry.(type) {
+		case string:
+			fields := strings.Fields(e)
+			if len(fields) == 0 {
+				continue
+			}
+			station.Address = fields[0]
+			if len(fields) > 1 {
+				station.Policy = fields[1]
+			}
+			if len(fields) > 2 {
+				interval, err := strconv.Atoi(fields[2])
+				if err != nil {
+					return nil, fmt.Errorf("BMP station %q has an invalid stats interval", e)
+				}
+				station.StatsInterval = interval
+			}
+		case map[string]interface{}:
+			b, err := json.Marshal(e)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(b, &station); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("BMP station %v has unexpected type %T", entry, entry)
+		}
+
+		if _, _, err := net.SplitHostPort(station.Address); err != nil {
+			return nil, fmt.Errorf("BMP station %v: %s", entry, err)
+		}
+		switch station.Policy {
+		case bmpPrePolicy, bmpPostPolicy, bmpAll:
+		default:
+			return nil, fmt.Errorf("BMP station %v: policy must be %s, %s or %s", entry, bmpPrePolicy, bmpPostPolicy, bmpAll)
+		}
+		if station.StatsInterval < 0 || station.StatsInterval > 65535 {
+			return nil, fmt.Errorf("BMP station %v: stats interval out of range", entry)
+		}
+		stations = append(stations, station)
+	}
+	return stations, nil
+}
+
+type bmpStationState struct {
+	station   bmpStation
+	config    *config.BmpServerConfig
+	connected bool
+	since     time.Time
+}
+
+// bmpManager keeps gobgp's BMP stations in line with the configured ones. gobgp reconnects to a station
+// by itself, the manager follows whether it's connected by looking for the session in /proc/net/tcp
+type bmpManager struct {
+	server   *gobgpServer.BgpServer
+	procRoot string
+	stations map[bmpStation]*bmpStationState
+	mu       sync.Mutex
+}
+
+func newBMPManager(server *gobgpServer.BgpServer, procRoot string) *bmpManager {
+	return &bmpManager{
+		server:   server,
+		procRoot: procRoot,
+		stations: make(map[bmpStation]*bmpStationState),
+	}
+}
+
+// Set adds stations gobgp doesn't have yet and removes those no longer wanted
+func (m *bmpManager) Set(stations []bmpStation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := make(map[bmpStation]bool)
+	for _, station := range stations {
+		wanted[station] = true
+	}
+
+	for station, state := range m.stations {
+		if wanted[station] {
+			continue
+		}
+		if err := m.server.DeleteBmp(state.config); err != nil {
+			return err
+		}
+		log.Println("removed BMP station", station.Address)
+		delete(m.stations, station)
+	}
+
+	for _, station := range stations {
+		if _, ok := m.stations[station]; ok {
+			continue
+		}
+		c, err := bmpConfig(station)
+		if err != nil {
+			return err
+		}
+		if err := m.server.AddBmp(c); err != nil {
+			return err
+		}
+		log.Println("added BMP station", station.Address, station.Policy)
+		m.stations[station] = &bmpStationState{station: station, config: c, since: time.Now()}
+	}
+	return nil
+}
+
+// bmpConfig resolves the station's host, so its session can be found in /proc/net/tcp
+func bmpConfig(station bmpStation) (*config.BmpServerConfig, error) {
+	host, port, err := net.SplitHostPort(station.Address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := config.BMP_ROUTE_MONITORING_POLICY_TYPE_PRE_POLICY
+	switch station.Policy {
+	case bmpPostPolicy:
+		policy = config.BMP_ROUTE_MONITORING_POLICY_TYPE_POST_POLICY
+	case bmpAll:
+		policy = config.BMP_ROUTE_MONITORING_POLICY_TYPE_ALL
+	}
+
+	return &config.BmpServerConfig{
+		Address:               addrs[0],
+		Port:                  uint32(p),
+		RouteMonitoringPolicy: policy,
+		StatisticsTimeout:     uint16(station.StatsInterval),
+	}, nil
+}
+
+// Run should be run as a go routine, follows the connection state of every station until done is closed
+func (m *bmpManager) Run(done chan bool) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+func (m *bmpManager) check() {
+	established, err := establishedTCP(m.procRoot)
+	if err != nil {
+		log.Println("can't check BMP stations:", err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, state := range m.stations {
+		remote := net.JoinHostPort(state.config.Address, strconv.FormatUint(uint64(state.config.Port), 10))
+		connected := established[remote]
+		if connected == state.connected {
+			continue
+		}
+		if connected {
+			log.Println("BMP station", state.station.Address, "connected")
+		} else {
+			log.Println("BMP station", state.station.Address, "disconnected, gobgp keeps reconnecting")
+		}
+		state.connected, state.since = connected, time.Now()
+	}
+}
+
+// Status reports every station, sorted by address
+func (m *bmpManager) Status() []bmpStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]bmpStatus, 0, len(m.stations))
+	for _, state := range m.stations {
+		statuses = append(statuses, bmpStatus{bmpStation: state.station, Connected: state.connected, Since: state.since})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Address < statuses[j].Address })
+	return statuses
+}
+
+// establishedTCP returns the remote "ip:port" of every established TCP connection in procRoot/net/tcp{,6}
+func establishedTCP(procRoot string) (map[string]bool, error) {
+	established := make(map[string]bool)
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(procRoot, "net", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != tcpEstablished {
+				continue
+			}
+			if remote, err := parseProcNetAddr(fields[2]); err == nil {
+				established[remote] = true
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return established, nil
+}
+
+// parseProcNetAddr turns an address like 0100007F:2B0B into 127.0.0.1:11019. The address is made of
+// 32 bit words in host (little endian) byte order
+func parseProcNetAddr(s string) (string, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(parts[0])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", err
+	}
+
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10)), nil
+}
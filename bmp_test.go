@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/osrg/gobgp/config"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+func TestParseBMPStations(t *testing.T) {
+	def := bmpStation{Policy: bmpPrePolicy, StatsInterval: 60}
+	stations, err := parseBMPStations([]interface{}{
+		"10.0.0.1:11019",
+		"10.0.0.2:11019 post-policy",
+		"[2001:db8::1]:11019 all 0",
+		map[string]interface{}{"address": "collector:11019", "policy": "post-policy"},
+		"",
+	}, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bmpStation{
+		{Address: "10.0.0.1:11019", Policy: bmpPrePolicy, StatsInterval: 60},
+		{Address: "10.0.0.2:11019", Policy: bmpPostPolicy, StatsInterval: 60},
+		{Address: "[2001:db8::1]:11019", Policy: bmpAll, StatsInterval: 0},
+		{Address: "collector:11019", Policy: bmpPostPolicy, StatsInterval: 60},
+	}
+	if !reflect.DeepEqual(stations, want) {
+		t.Errorf("parsed %+v, want %+v", stations, want)
+	}
+
+	if stations, err := parseBMPStations("10.0.0.1:11019", def); err != nil || len(stations) != 1 {
+		t.Errorf("a single station parsed as %+v, %v", stations, err)
+	}
+	for _, bad := range []interface{}{
+		"10.0.0.1",
+		"10.0.0.1:11019 best-policy",
+		"10.0.0.1:11019 all often",
+		"10.0.0.1:11019 all 65536",
+		"10.0.0.1:11019 all -1",
+		map[string]interface{}{"address": "10.0.0.1:11019", "stats_interval": "60"},
+		[]interface{}{42},
+		42,
+	} {
+		if _, err := parseBMPStations(bad, def); err == nil {
+			t.Errorf("parsed %v", bad)
+		}
+	}
+}
+
+func TestParseProcNetAddr(t *testing.T) {
+	for s, want := range map[string]string{
+		"0100007F:2B0B":                         "127.0.0.1:11019",
+		"B80D0120000000000000000001000000:2B0B": "[2001:db8::1]:11019",
+		"0000000000000000FFFF00000100000A:0050": "10.0.0.1:80",
+	} {
+		if got, err := parseProcNetAddr(s); err != nil || got != want {
+			t.Errorf("%s parsed as %q, %v, want %s", s, got, err, want)
+		}
+	}
+	for _, bad := range []string{"0100007F", "0100007F:2B0B:1", "01007F:2B0B", "ZZ00007F:2B0B", "0100007F:12345"} {
+		if _, err := parseProcNetAddr(bad); err == nil {
+			t.Errorf("parsed %s", bad)
+		}
+	}
+}
+
+func TestBMPManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tcp := func(name string, lines ...string) {
+		content := "  sl  local_address rem_address   st tx_queue rx_queue\n"
+		for _, line := range lines {
+			content += line + "\n"
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "net", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// left running, like the test router, see testHarness.Close
+	s := gobgpServer.NewBgpServer()
+	go s.Serve()
+	if err := s.Start(&config.Global{Config: config.GlobalConfig{As: 65000, RouterId: "10.99.0.2", Port: -1}}); err != nil {
+		t.Fatal(err)
+	}
+	m := newBMPManager(s, dir)
+	v4 := bmpStation{Address: "127.0.0.1:11019", Policy: bmpPrePolicy}
+	v6 := bmpStation{Address: "[::1]:11020", Policy: bmpAll, StatsInterval: 60}
+	if err := m.Set([]bmpStation{v4, v6}); err != nil {
+		t.Fatal(err)
+	}
+	connected := func() map[string]bool {
+		m.check()
+		states := make(map[string]bool)
+		for _, status := range m.Status() {
+			states[status.Address] = status.Connected
+		}
+		return states
+	}
+
+	// no tcp6 at all is fine, a listening socket and a connection to another port don't count
+	tcp("tcp",
+		"   0: 0100007F:2B0B 00000000:0000 0A 00000000:00000000",
+		"   1: 0100007F:9C40 0100007F:2B0C 01 00000000:00000000",
+		"   2: 0100007F:9C41 0100007F:2B0B 01 00000000:00000000")
+	if got, want := connected(), map[string]bool{"127.0.0.1:11019": true, "[::1]:11020": false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stations connected %v, want %v", got, want)
+	}
+	tcp("tcp")
+	tcp("tcp6", "   0: 00000000000000000000000001000000:9C42 00000000000000000000000001000000:2B0C 01 00000000:00000000")
+	if got, want := connected(), map[string]bool{"127.0.0.1:11019": false, "[::1]:11020": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stations connected %v, want %v", got, want)
+	}
+
+	if err := m.Set([]bmpStation{v6}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Status(); len(got) != 1 || got[0].bmpStation != v6 || !got[0].Connected {
+		t.Errorf("after removing a station status is %+v, want only the connected %+v", got, v6)
+	}
+}
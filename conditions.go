@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/osrg/gobgp/packet/bgp"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+// advertiseCondition makes an announcement depend on what a neighbor sends the agent: it's only announced
+// while Absent is missing from, or Present is in, the neighbor's adj-RIB-in
+type advertiseCondition struct {
+	Absent   string `json:"absent,omitempty"`
+	Present  string `json:"present,omitempty"`
+	Neighbor string `json:"neighbor,omitempty"` // the Packet router when empty
+}
+
+// normalize checks the condition names exactly one prefix and normalizes it to its network address
+func (c *advertiseCondition) normalize() error {
+	if (c.Absent == "") == (c.Present == "") {
+		return fmt.Errorf("condition %+v needs either absent or present", *c)
+	}
+	if c.Neighbor != "" && net.ParseIP(c.Neighbor) == nil {
+		return fmt.Errorf("condition neighbor %q isn't an IP address", c.Neighbor)
+	}
+	for _, p := range []*string{&c.Absent, &c.Present} {
+		if *p == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(*p)
+		if err != nil {
+			return err
+		}
+		*p = ipnet.String()
+	}
+	return nil
+}
+
+func (c *advertiseCondition) String() string {
+	neighbor := c.Neighbor
+	if neighbor == "" {
+		neighbor = "the Packet router"
+	}
+	if c.Absent != "" {
+		return fmt.Sprintf("%s absent from %s", c.Absent, neighbor)
+	}
+	return fmt.Sprintf("%s present in %s", c.Present, neighbor)
+}
+
+// receivedFrom reports whether neighbor sent a path for prefix, whether or not the import policy
+// accepted it
+func receivedFrom(rib ribReader, neighbor, prefix string) (bool, error) {
+	ip, _, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return false, err
+	}
+	family := bgp.RF_IPv4_UC
+	if ip.To4() == nil {
+		family = bgp.RF_IPv6_UC
+	}
+
+	paths, err := rib.Received(neighbor, family, prefix)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		if !path.IsWithdraw {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unmetCondition returns why c doesn't hold, empty if it does. agent.mu must be held
+func (agent *PacketBGPAgent) unmetCondition(c *advertiseCondition) string {
+	if agent.RIB == nil {
+		return fmt.Sprintf("conditional advertisement needs the %s speaker", speakerGobgp)
+	}
+
+	neighbor := c.Neighbor
+	if neighbor == "" {
+		neighbor = agent.PrivateIP.Gateway.String()
+	}
+	prefix := c.Absent
+	if c.Present != "" {
+		prefix = c.Present
+	}
+	// a neighbor that isn't configured, or that's down, hasn't sent anything
+	received, err := receivedFrom(agent.RIB, neighbor, prefix)
+	if err != nil {
+		log.Println("can't look up", prefix, "from", neighbor+":", err)
+	}
+
+	switch {
+	case c.Absent != "" && received:
+		return fmt.Sprintf("%s received from %s", prefix, neighbor)
+	case c.Present != "" && !received:
+		return fmt.Sprintf("%s not received from %s", prefix, neighbor)
+	}
+	return ""
+}
+
+// evaluateConditions refreshes which conditional announcements are withheld and reports whether any
+// changed, agent.mu must be held
+func (agent *PacketBGPAgent) evaluateConditions() bool {
+	unmet := make(map[string]string)
+	changed := false
+	for _, announcement := range agent.Announcements {
+		if announcement.When == nil {
+			continue
+		}
+		reason := agent.unmetCondition(announcement.When)
+		prev, wasUnmet := agent.unmet[announcement.Prefix]
+		if reason != "" {
+			unmet[announcement.Prefix] = reason
+			if !wasUnmet || prev != reason {
+				log.Println("withholding", announcement.Prefix+":", reason)
+				changed = true
+			}
+		} else if wasUnmet {
+			log.Println("advertising", announcement.Prefix+", condition", announcement.When, "holds")
+			changed = true
+		}
+	}
+	agent.unmet = unmet
+	return changed
+}
+
+// WatchConditions should be run as a go routine, re-evaluates the advertise conditions whenever a
+// neighbor sends an update or changes state, and reconciles when one changed, until done is closed
+func (agent *PacketBGPAgent) WatchConditions(done chan bool) {
+	g, ok := agent.Speaker.(*gobgpSpeaker)
+	if !ok {
+		return
+	}
+	w := g.server.Watch(gobgpServer.WatchUpdate(false), gobgpServer.WatchPeerState(false))
+	defer w.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-w.Event():
+			// a burst of updates only needs one evaluation
+			for pending := true; pending; {
+				select {
+				case <-w.Event():
+				default:
+					pending = false
+				}
+			}
+			agent.mu.Lock()
+			if agent.evaluateConditions() {
+				if err := agent.ensureBGP(); err != nil {
+					log.Println(err)
+				}
+			}
+			agent.mu.Unlock()
+		}
+	}
+}
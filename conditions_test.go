@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	ann, err := parseAnnouncement(map[string]interface{}{
+		"prefix": "198.51.100.0/24",
+		"when":   map[string]interface{}{"absent": "203.0.113.9/24", "neighbor": "10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ann.When.String(), "203.0.113.0/24 absent from 10.0.0.1"; got != want {
+		t.Errorf("parsed condition %q, want %q", got, want)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{},
+		{"absent": "203.0.113.0/24", "present": "192.0.2.0/24"},
+		{"present": "not a prefix"},
+		{"present": "192.0.2.0/24", "neighbor": "router"},
+	} {
+		if _, err := parseAnnouncement(map[string]interface{}{"prefix": "198.51.100.0/24", "when": invalid}); err == nil {
+			t.Errorf("accepted condition %v", invalid)
+		}
+	}
+}
+
+func TestConditionNeedsGobgp(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(true)
+	agent := newTestAgent(Config{}, sp, n)
+
+	conditional := Announcement{Prefix: "198.51.100.0/24", When: &advertiseCondition{Absent: "203.0.113.0/24"}}
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}, conditional); err != nil {
+		t.Fatal(err)
+	}
+	// the address is placed so it's ready once the prefix can be announced
+	expectOps(t, "network", n.Ops(), "addr-replace lo 192.0.2.1/32", "addr-replace lo 198.51.100.0/24")
+	expectOps(t, "speaker", sp.Ops(), "announce 192.0.2.1/32")
+	if status := agent.Status().Prefixes["198.51.100.0/24"]; status.Health != healthHeld {
+		t.Errorf("conditional prefix has health %s, want %s", status.Health, healthHeld)
+	}
+}
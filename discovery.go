@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mesh discovery backends
+const (
+	discoveryStatic = "static"
+	discoveryTag    = "tag"
+	discoveryKV     = "kv"
+)
+
+// member is an agent of the fleet
+type member struct {
+	ID      string `json:"id"`      // device ID, what announcer decisions are based on
+	Address string `json:"address"` // private address the agent peers on
+}
+
+// discovery finds the agents of the fleet
+type discovery interface {
+	// Members returns the agents of the fleet, the agent itself may be among them
+	Members() ([]member, error)
+}
+
+// newDiscovery returns the backend cfg.MeshDiscovery names, self is the agent itself
+func newDiscovery(cfg Config, self member) (discovery, error) {
+	switch cfg.MeshDiscovery {
+	case discoveryStatic:
+		return newStaticDiscovery(cfg.MeshPeers)
+	case discoveryTag:
+		if cfg.MeshTag == "" || cfg.PacketToken == "" {
+			return nil, fmt.Errorf("finding mesh peers by tag needs a tag and a Packet API token")
+		}
+		return &tagDiscovery{
+			api:      strings.TrimSuffix(cfg.PacketAPI, "/"),
+			token:    cfg.PacketToken,
+			deviceID: self.ID,
+			tag:      cfg.MeshTag,
+			client:   &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	case discoveryKV:
+		if cfg.MeshKV == "" {
+			return nil, fmt.Errorf("finding mesh peers in a KV store needs its URL")
+		}
+		return &kvDiscovery{
+			url:    strings.TrimSuffix(cfg.MeshKV, "/"),
+			prefix: strings.Trim(cfg.MeshKVPrefix, "/"),
+			self:   self,
+			// registrations outlive a few missed refreshes
+			ttl:    3 * cfg.MeshInterval,
+			client: &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown mesh discovery %q, must be %s, %s or %s", cfg.MeshDiscovery, discoveryStatic, discoveryTag, discoveryKV)
+}
+
+// staticDiscovery is a configured list of agents
+type staticDiscovery struct {
+	members []member
+}
+
+// newStaticDiscovery reads peers, each an address or "<device ID>=<address>". Without an ID the address
+// stands in for it
+func newStaticDiscovery(peers []string) (*staticDiscovery, error) {
+	d := &staticDiscovery{}
+	for _, peer := range peers {
+		m := member{ID: peer, Address: peer}
+		if i := strings.Index(peer, "="); i >= 0 {
+			m.ID, m.Address = peer[:i], peer[i+1:]
+		}
+		ip := net.ParseIP(m.Address)
+		if ip == nil || m.ID == "" {
+			return nil, fmt.Errorf("mesh peer %q isn't an IP address, optionally preceded by a device ID and =", peer)
+		}
+		if m.ID == m.Address {
+			m.ID = ip.String()
+		}
+		m.Address = ip.String()
+		d.members = append(d.members, m)
+	}
+	return d, nil
+}
+
+func (d *staticDiscovery) Members() ([]member, error) {
+	return d.members, nil
+}
+
+// tagDiscovery finds the devices in the agent's project that have a tag through the Packet API
+type tagDiscovery struct {
+	api      string
+	token    string
+	deviceID string
+	tag      string
+	client   *http.Client
+}
+
+// Members returns the tagged devices with their private IPv4 address
+func (d *tagDiscovery) Members() ([]member, error) {
+	var device struct {
+		Project struct {
+			Href string `json:"href"`
+		} `json:"project"`
+	}
+	if err := d.get("/devices/"+d.deviceID, &device); err != nil {
+		return nil, err
+	}
+	if device.Project.Href == "" {
+		return nil, fmt.Errorf("device %s has no project", d.deviceID)
+	}
+
+	var project struct {
+		Devices []struct {
+			ID          string   `json:"id"`
+			Tags        []string `json:"tags"`
+			IPAddresses []struct {
+				Address string `json:"address"`
+				Family  int    `json:"address_family"`
+				Public  bool   `json:"public"`
+			} `json:"ip_addresses"`
+		} `json:"devices"`
+	}
+	if err := d.get(device.Project.Href+"/devices?per_page=1000", &project); err != nil {
+		return nil, err
+	}
+
+	var members []member
+	for _, dev := range project.Devices {
+		tagged := false
+		for _, tag := range dev.Tags {
+			tagged = tagged || tag == d.tag
+		}
+		if !tagged {
+			continue
+		}
+		for _, addr := range dev.IPAddresses {
+			if addr.Family == 4 && !addr.Public {
+				members = append(members, member{ID: dev.ID, Address: addr.Address})
+				break
+			}
+		}
+	}
+	return members, nil
+}
+
+// get decodes the Packet API resource at path into out
+func (d *tagDiscovery) get(path string, out interface{}) error {
+	return doJSON(d.client, http.MethodGet, d.api+path, map[string]string{"X-Auth-Token": d.token}, nil, out)
+}
+
+// kvDiscovery finds the agents in a KV store, where every agent registers itself under a shared prefix
+// with a TTL and refreshes that on every lookup. See kvStore for the API it expects
+type kvDiscovery struct {
+	url    string
+	prefix string
+	self   member
+	ttl    time.Duration
+	client *http.Client
+}
+
+// Members registers the agent, then returns every agent registered
+func (d *kvDiscovery) Members() ([]member, error) {
+	b, err := json.Marshal(d.self)
+	if err != nil {
+		return nil, err
+	}
+	key := d.url + "/v1/kv/" + d.prefix + "/" + url.PathEscape(d.self.ID) + "?ttl=" + d.ttl.String()
+	if err := doJSON(d.client, http.MethodPut, key, nil, bytes.NewReader(b), nil); err != nil {
+		return nil, err
+	}
+
+	var entries []kvEntry
+	if err := doJSON(d.client, http.MethodGet, d.url+"/v1/kv/"+d.prefix+"/?recurse", nil, nil, &entries); err != nil {
+		return nil, err
+	}
+	members := make([]member, 0, len(entries))
+	for _, entry := range entries {
+		var m member
+		if err := json.Unmarshal([]byte(entry.Value), &m); err != nil || net.ParseIP(m.Address) == nil {
+			log.Printf("skipping KV entry %s, it isn't a mesh member: %q", entry.Key, entry.Value)
+			continue
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// doJSON sends a request with the given headers and body, and decodes the response into out if it's set
+func doJSON(client *http.Client, method, url string, headers map[string]string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s %s", method, req.URL, res.Status, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/packethost/packngo/metadata"
+)
+
+const (
+	drainGracefulShutdown = "graceful-shutdown"
+	drainPrepend          = "prepend"
+	drainWithdraw         = "withdraw"
+
+	// drainTag on the device drains it with the default policy, "bgp-drain:<policy>" picks one
+	drainTag = "bgp-drain"
+
+	// communityGracefulShutdown asks the routers to prefer any other path, RFC 8326
+	communityGracefulShutdown = "65535:0"
+)
+
+func validDrainPolicy(policy string) bool {
+	return policy == drainGracefulShutdown || policy == drainPrepend || policy == drainWithdraw
+}
+
+// parseDrain returns the drain policy the device asks for, empty when it isn't drained. BGP_DRAIN is
+// true, false, or a policy name, and takes precedence over a bgp-drain tag. def is used when no policy
+// is named
+func parseDrain(device *metadata.CurrentDevice, def string) (string, error) {
+	if v, ok := device.CustomData["BGP_DRAIN"]; ok && v != nil {
+		switch d := v.(type) {
+		case bool:
+			if d {
+				return def, nil
+			}
+			return "", nil
+		case string:
+			switch strings.ToLower(d) {
+			case "", "false":
+				return "", nil
+			case "true":
+				return def, nil
+			}
+			if !validDrainPolicy(d) {
+				return "", fmt.Errorf("BGP_DRAIN %q is not a drain policy", d)
+			}
+			return d, nil
+		default:
+			return "", fmt.Errorf("BGP_DRAIN has unexpected type %T", v)
+		}
+	}
+
+	for _, tag := range device.Tags {
+		if tag == drainTag {
+			return def, nil
+		}
+		if strings.HasPrefix(tag, drainTag+":") {
+			policy := strings.TrimPrefix(tag, drainTag+":")
+			if !validDrainPolicy(policy) {
+				return "", fmt.Errorf("tag %q doesn't name a drain policy", tag)
+			}
+			return policy, nil
+		}
+	}
+	return "", nil
+}
+
+// setDrain switches to a drain policy, empty to undrain, and reports whether that's a change. agent.mu
+// must be held
+func (agent *PacketBGPAgent) setDrain(policy string) bool {
+	if policy == agent.drain {
+		return false
+	}
+	if policy == "" {
+		log.Println("drain signal cleared, undraining")
+	} else {
+		log.Println("draining with policy", policy)
+	}
+	agent.drain = policy
+	return true
+}
+
+// drained applies the drain policy, if any, to a route. agent.mu must be held
+func (agent *PacketBGPAgent) drained(r *route) *route {
+	switch agent.drain {
+	case drainGracefulShutdown:
+		r.Communities = append(r.Communities, communityGracefulShutdown)
+	case drainPrepend:
+		r.Prepend += agent.Config.DrainPrepend
+	}
+	return r
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo/metadata"
+)
+
+func TestParseDrain(t *testing.T) {
+	for _, c := range []struct {
+		tags       []string
+		customData map[string]interface{}
+		want       string
+		err        bool
+	}{
+		{want: ""},
+		{tags: []string{"web", drainTag}, want: drainGracefulShutdown},
+		{tags: []string{"bgp-drain:withdraw"}, want: drainWithdraw},
+		{tags: []string{"bgp-drain:sideways"}, err: true},
+		{customData: map[string]interface{}{"BGP_DRAIN": true}, want: drainGracefulShutdown},
+		{customData: map[string]interface{}{"BGP_DRAIN": "prepend"}, want: drainPrepend},
+		{customData: map[string]interface{}{"BGP_DRAIN": "yes please"}, err: true},
+		{customData: map[string]interface{}{"BGP_DRAIN": 1.0}, err: true},
+		// customdata overrides tags either way
+		{tags: []string{drainTag}, customData: map[string]interface{}{"BGP_DRAIN": false}, want: ""},
+		{tags: []string{drainTag}, customData: map[string]interface{}{"BGP_DRAIN": "withdraw"}, want: drainWithdraw},
+	} {
+		got, err := parseDrain(&metadata.CurrentDevice{Tags: c.tags, CustomData: c.customData}, drainGracefulShutdown)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("tags %v customdata %v drain %q, %v, want %q (error: %v)", c.tags, c.customData, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{DrainPrepend: 2}, sp, n)
+	desired := []interface{}{"192.0.2.1/32", "198.51.100.0/24"}
+	setDrain := func(drain interface{}) {
+		customData := map[string]interface{}{"BGP_ANNOUNCE": desired, "BGP_DRAIN": drain}
+		if agent.update(&metadata.CurrentDevice{CustomData: customData}) {
+			if err := agent.EnsureBGP(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	setDrain(false)
+	n.Ops()
+	sp.Ops()
+
+	setDrain(drainGracefulShutdown)
+	if got := sp.routes["192.0.2.1/32"].Communities; !reflect.DeepEqual(got, []string{communityGracefulShutdown}) {
+		t.Errorf("drained route has communities %v, want %s", got, communityGracefulShutdown)
+	}
+
+	setDrain(drainPrepend)
+	if r := sp.routes["192.0.2.1/32"]; r.Prepend != 2 || len(r.Communities) != 0 {
+		t.Errorf("drained route is %+v, want 2 prepends and no communities", r)
+	}
+
+	// withdrawing leaves the addresses and the desired set alone
+	setDrain(drainWithdraw)
+	if got := sp.announced(); len(got) != 0 {
+		t.Errorf("still announcing %v", got)
+	}
+	expectOps(t, "network", n.Ops())
+	if got := len(agent.Announcements); got != 2 {
+		t.Errorf("draining changed the desired set to %d prefixes", got)
+	}
+	if got := agent.Status().Prefixes["192.0.2.1/32"].Reason; got != "drained" {
+		t.Errorf("drained prefix has reason %q", got)
+	}
+
+	setDrain(nil)
+	if got, want := fmt.Sprint(sp.announced()), "[192.0.2.1/32 198.51.100.0/24]"; got != want {
+		t.Errorf("announced %s after undraining, want %s", got, want)
+	}
+	if r := sp.routes["192.0.2.1/32"]; r.Prepend != 0 || len(r.Communities) != 0 {
+		t.Errorf("undrained route is %+v", r)
+	}
+}
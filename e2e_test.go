@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+	"github.com/packethost/packetmetadata/hegel"
+	"google.golang.org/grpc"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+const (
+	testPassword  = "hunter2"
+	testGateway   = "127.0.0.1"
+	testPrivateIP = "10.99.0.2"
+)
+
+// testRouter is an in-process gobgp standing in for the Packet router the agent peers with
+type testRouter struct {
+	server *gobgpServer.BgpServer
+	port   uint16
+}
+
+// startTestRouter listens on testGateway for the agent to connect, it never connects itself
+func startTestRouter(t *testing.T, password string) *testRouter {
+	port := freePort(t)
+	s := gobgpServer.NewBgpServer()
+	go s.Serve()
+	err := s.Start(&config.Global{
+		Config: config.GlobalConfig{
+			As:               65530,
+			RouterId:         "10.255.0.1",
+			Port:             int32(port),
+			LocalAddressList: []string{testGateway},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddNeighbor(&config.Neighbor{
+		Config: config.NeighborConfig{
+			NeighborAddress: testGateway, // the agent dials from the same address
+			PeerAs:          65000,
+			AuthPassword:    password,
+		},
+		Transport: config.Transport{
+			Config: config.TransportConfig{PassiveMode: true},
+		},
+		AddPaths: config.AddPaths{
+			Config: config.AddPathsConfig{Receive: true},
+		},
+	})
+	if err != nil {
+		s.Stop()
+		t.Fatal(err)
+	}
+	return &testRouter{server: s, port: port}
+}
+
+// adjRibIn returns the next hop of every IPv4 path the router received from the agent, by prefix
+func (r *testRouter) adjRibIn(t *testing.T) map[string]string {
+	rib, _, err := r.server.GetAdjRib(testGateway, bgp.RF_IPv4_UC, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(map[string]string)
+	for _, dst := range rib.GetDestinations() {
+		for _, path := range dst.GetAllKnownPathList() {
+			if !path.IsWithdraw {
+				received[dst.GetNlri().String()] = path.GetNexthop().String()
+			}
+		}
+	}
+	return received
+}
+
+// announce sends prefix to the agent until the returned func withdraws it
+func (r *testRouter) announce(t *testing.T, prefix string) func() {
+	// the agent treats a path with a loopback next hop as a withdraw
+	path, err := gobgpPath(prefix, &route{NextHop: "10.255.0.1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, err := r.server.AddPath("", []*table.Path{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if err := r.server.DeletePath(uuid, 0, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// received returns the attributes of the path the router received for prefix, as a route
+func (r *testRouter) received(t *testing.T, prefix string) *route {
+	rib, _, err := r.server.GetAdjRib(testGateway, bgp.RF_IPv4_UC, true, []*table.LookupPrefix{{Prefix: prefix}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range rib.GetDestinations() {
+		for _, path := range dst.GetAllKnownPathList() {
+			received := &route{NextHop: path.GetNexthop().String(), Prepend: path.GetAsPathLen() - 1}
+			received.MED, _ = path.GetMed()
+			for _, c := range path.GetCommunities() {
+				received.Communities = append(received.Communities, formatCommunity(c))
+			}
+			return received
+		}
+	}
+	return nil
+}
+
+// nextHops returns the next hops of every path the router received for prefix, sorted
+func (r *testRouter) nextHops(t *testing.T, prefix string) []string {
+	rib, _, err := r.server.GetAdjRib(testGateway, bgp.RF_IPv4_UC, true, []*table.LookupPrefix{{Prefix: prefix}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := make([]string, 0)
+	for _, dst := range rib.GetDestinations() {
+		for _, path := range dst.GetAllKnownPathList() {
+			hops = append(hops, path.GetNexthop().String())
+		}
+	}
+	sort.Strings(hops)
+	return hops
+}
+
+func (r *testRouter) established() bool {
+	for _, n := range r.server.GetNeighbor(testGateway, false) {
+		return n.State.SessionState == config.SESSION_STATE_ESTABLISHED
+	}
+	return false
+}
+
+// testMetadata serves a metadata document through fakeMetadata, as hegel and as the metadata service
+type testMetadata struct {
+	fake      *fakeMetadata
+	hegelAddr string
+	url       string
+	close     func()
+}
+
+func startTestMetadata(t *testing.T, customData map[string]interface{}) *testMetadata {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &testMetadata{fake: &fakeMetadata{
+		path:        filepath.Join(dir, "metadata.json"),
+		subscribers: make(map[chan string]bool),
+	}}
+	m.set(t, customData)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	hegel.RegisterHegelServer(s, m.fake)
+	go s.Serve(l)
+	h := httptest.NewServer(http.HandlerFunc(m.fake.handleMetadata))
+
+	m.hegelAddr = l.Addr().String()
+	m.url = h.URL
+	m.close = func() {
+		s.Stop()
+		h.Close()
+		os.RemoveAll(dir)
+	}
+	return m
+}
+
+// set replaces the device's customdata, which is pushed to subscribers
+func (m *testMetadata) set(t *testing.T, customData map[string]interface{}) {
+	doc := map[string]interface{}{
+		"instance": map[string]interface{}{
+			"id": "device-1",
+			"network": map[string]interface{}{
+				"addresses": []map[string]interface{}{{
+					"address_family": 4,
+					"public":         false,
+					"management":     true,
+					"address":        testPrivateIP,
+					"netmask":        "255.255.255.254",
+					"gateway":        testGateway,
+					"cidr":           31,
+				}},
+			},
+			"customdata": customData,
+		},
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(m.fake.path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fake.load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHarness runs an agent with the embedded gobgp against a testRouter, testMetadata and a fakeNetwork
+type testHarness struct {
+	router   *testRouter
+	metadata *testMetadata
+	network  *fakeNetwork
+	agent    *PacketBGPAgent
+	done     chan bool
+}
+
+func newTestHarness(t *testing.T, password string, customData map[string]interface{}) *testHarness {
+	h := &testHarness{
+		router:   startTestRouter(t, password),
+		metadata: startTestMetadata(t, customData),
+		network:  newFakeNetwork(),
+		done:     make(chan bool),
+	}
+
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		MD5Password:      password,
+		ASN:              "65000",
+		VIPInterface:     "lo",
+		VIPRemovedPolicy: vipRemovedRestore,
+		StateFile:        filepath.Join(dir, "state.json"),
+		Speaker:          speakerGobgp,
+		GRPCAddr:         "127.0.0.1:0",
+		HegelAddr:        h.metadata.hegelAddr,
+		HegelInsecure:    true,
+		MetadataURL:      h.metadata.url,
+		DrainPolicy:      drainGracefulShutdown,
+		Profiles:         testProfiles(t),
+		Profile:          profilePrimary,
+		AddPaths:         4,
+	}
+
+	sp := newGobgpSpeaker(cfg.GRPCAddr)
+	sp.peerPort = h.router.port
+	if h.agent, err = NewPacketBGPAgent(sp, h.network, h.network, cfg); err != nil {
+		t.Fatal(err)
+	}
+	go h.agent.WatchConditions(h.done)
+	go h.agent.EnsureIPs(h.done)
+	return h
+}
+
+// Close stops the agent and metadata. The BGP servers are left running: a gobgp stopped with an
+// established session never drains its FSM and exits the process two minutes later
+func (h *testHarness) Close() {
+	close(h.done)
+	h.metadata.close()
+	os.RemoveAll(filepath.Dir(h.agent.Config.StateFile))
+}
+
+// expectReceived waits for the router's adj-rib-in to hold exactly the given prefixes, all with the
+// agent's private IP as next hop
+func (h *testHarness) expectReceived(t *testing.T, prefixes ...string) {
+	want := make(map[string]string)
+	for _, prefix := range prefixes {
+		want[prefix] = testPrivateIP
+	}
+	var got map[string]string
+	deadline := time.Now().Add(45 * time.Second) // gobgp waits 10-20s before its first connect
+	for time.Now().Before(deadline) {
+		if got = h.router.adjRibIn(t); fmt.Sprint(got) == fmt.Sprint(want) {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatalf("router received %v, want %v (established: %v)", got, want, h.router.established())
+}
+
+// expectRoute waits for the router to receive prefix with the attributes of want
+func (h *testHarness) expectRoute(t *testing.T, prefix string, want *route) {
+	var got *route
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if got = h.router.received(t, prefix); reflect.DeepEqual(got, want) {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatalf("router received %s with %+v, want %+v", prefix, got, want)
+}
+
+// md5Supported reports whether the kernel lets sockets use TCP MD5 signatures
+func md5Supported() bool {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return false
+	}
+	defer l.Close()
+	return gobgpServer.SetTcpMD5SigSockopt(l.(*net.TCPListener), testGateway, testPassword) == nil
+}
+
+func freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp", testGateway+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return uint16(p)
+}
+
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a BGP session")
+	}
+	password := testPassword
+	if !md5Supported() {
+		t.Log("kernel doesn't support TCP MD5 signatures, peering without a password")
+		password = ""
+	}
+
+	h := newTestHarness(t, password, map[string]interface{}{
+		"BGP_ANNOUNCE": []interface{}{"192.0.2.1/32", "198.51.100.0/24"},
+	})
+	defer h.Close()
+
+	t.Run("initial announcements", func(t *testing.T) {
+		h.expectReceived(t, "192.0.2.1/32", "198.51.100.0/24")
+		if got, want := fmt.Sprint(h.network.placed("lo")), "[192.0.2.1/32 198.51.100.0/24]"; got != want {
+			t.Errorf("addresses on lo are %s, want %s", got, want)
+		}
+	})
+
+	t.Run("prefix added and removed", func(t *testing.T) {
+		h.metadata.set(t, map[string]interface{}{
+			"BGP_ANNOUNCE": []interface{}{"192.0.2.1/32", "203.0.113.7/32"},
+		})
+		h.expectReceived(t, "192.0.2.1/32", "203.0.113.7/32")
+		if got, want := fmt.Sprint(h.network.placed("lo")), "[192.0.2.1/32 203.0.113.7/32]"; got != want {
+			t.Errorf("addresses on lo are %s, want %s", got, want)
+		}
+	})
+
+	t.Run("invalid announcement keeps the last good one", func(t *testing.T) {
+		h.metadata.set(t, map[string]interface{}{"BGP_ANNOUNCE": []interface{}{"not a prefix"}})
+		time.Sleep(time.Second)
+		h.expectReceived(t, "192.0.2.1/32", "203.0.113.7/32")
+	})
+
+	t.Run("conditional on a route from the router", func(t *testing.T) {
+		h.metadata.set(t, map[string]interface{}{
+			"BGP_ANNOUNCE": []interface{}{
+				"192.0.2.1/32",
+				map[string]interface{}{"prefix": "198.51.100.0/24", "when": map[string]interface{}{"absent": "203.0.113.0/24"}},
+			},
+		})
+		h.expectReceived(t, "192.0.2.1/32", "198.51.100.0/24")
+
+		withdraw := h.router.announce(t, "203.0.113.0/24")
+		h.expectReceived(t, "192.0.2.1/32")
+		if got := h.agent.Status().Prefixes["198.51.100.0/24"]; got.Health != healthHeld {
+			t.Errorf("conditional prefix has health %s, want %s", got.Health, healthHeld)
+		}
+
+		withdraw()
+		h.expectReceived(t, "192.0.2.1/32", "198.51.100.0/24")
+	})
+
+	t.Run("backup profile", func(t *testing.T) {
+		h.metadata.set(t, map[string]interface{}{
+			"BGP_ANNOUNCE": []interface{}{"192.0.2.1/32", "203.0.113.7/32"},
+			"BGP_PROFILE":  "backup",
+		})
+		h.expectRoute(t, "192.0.2.1/32", &route{NextHop: testPrivateIP, Prepend: 5, MED: 200})
+	})
+
+	t.Run("drained", func(t *testing.T) {
+		h.metadata.set(t, map[string]interface{}{
+			"BGP_ANNOUNCE": []interface{}{"192.0.2.1/32", "203.0.113.7/32"},
+			"BGP_DRAIN":    true,
+		})
+		h.expectRoute(t, "192.0.2.1/32", &route{NextHop: testPrivateIP, Communities: []string{communityGracefulShutdown}})
+		h.expectReceived(t, "192.0.2.1/32", "203.0.113.7/32")
+	})
+
+	t.Run("several next hops", func(t *testing.T) {
+		h.metadata.set(t, map[string]interface{}{
+			"BGP_ANNOUNCE": []interface{}{
+				map[string]interface{}{"prefix": "192.0.2.1/32", "next_hop": []interface{}{"10.99.0.5", "10.99.0.6"}},
+			},
+		})
+		eventually(t, "both paths", func() bool {
+			return fmt.Sprint(h.router.nextHops(t, "192.0.2.1/32")) == "[10.99.0.5 10.99.0.6]"
+		})
+
+		h.metadata.set(t, map[string]interface{}{
+			"BGP_ANNOUNCE": []interface{}{map[string]interface{}{"prefix": "192.0.2.1/32", "next_hop": "10.99.0.7"}},
+		})
+		eventually(t, "a single path", func() bool {
+			return fmt.Sprint(h.router.nextHops(t, "192.0.2.1/32")) == "[10.99.0.7]"
+		})
+	})
+
+	t.Run("everything withdrawn", func(t *testing.T) {
+		h.metadata.set(t, map[string]interface{}{"BGP_ANNOUNCE": []interface{}{}})
+		h.expectReceived(t)
+		if got := h.network.placed("lo"); len(got) != 0 {
+			t.Errorf("addresses left on lo: %v", got)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/packethost/packetmetadata/hegel"
+	"google.golang.org/grpc"
+)
+
+// fakeMetadata serves a JSON file as device metadata: the whole document over the hegel gRPC API, with
+// every change pushed to subscribers, and its "instance" object as the /metadata HTTP document
+type fakeMetadata struct {
+	path        string
+	json        string
+	subscribers map[chan string]bool
+	mu          sync.Mutex
+}
+
+// runFakeMetadata serves fake metadata, args are the flags after "fake-metadata"
+func runFakeMetadata(args []string) error {
+	fs := flag.NewFlagSet("fake-metadata", flag.ExitOnError)
+	path := fs.String("file", "metadata.json", "JSON file with the metadata document, as hegel returns it")
+	grpcListen := fs.String("grpc-listen", "127.0.0.1:50060", "address to serve the hegel gRPC API on, plaintext")
+	httpListen := fs.String("http-listen", "127.0.0.1:8080", "address to serve the /metadata HTTP document on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	m := &fakeMetadata{path: *path, subscribers: make(map[chan string]bool)}
+	if err := m.load(); err != nil {
+		return err
+	}
+	if err := m.watch(); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", *grpcListen)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	hegel.RegisterHegelServer(s, m)
+	go func() {
+		log.Fatal(s.Serve(l))
+	}()
+
+	http.HandleFunc("/metadata", m.handleMetadata)
+	log.Println("serving", *path, "as hegel on", *grpcListen, "and as /metadata on", *httpListen)
+	return http.ListenAndServe(*httpListen, nil)
+}
+
+// load reads the file, keeping the current document if it isn't valid JSON (e.g. half written)
+func (m *fakeMetadata) load() error {
+	b, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if string(b) == m.json {
+		return nil
+	}
+	m.json = string(b)
+	for ch := range m.subscribers {
+		select {
+		case ch <- m.json:
+		default: // a slow subscriber gets the latest document once it catches up
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- m.json
+		}
+	}
+	log.Println("loaded", m.path, "for", len(m.subscribers), "subscribers")
+	return nil
+}
+
+// watch reloads the file whenever it changes. The directory is watched, editors often replace files
+// rather than write them in place
+func (m *fakeMetadata) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(m.path)); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case ev := <-w.Events:
+				if filepath.Clean(ev.Name) != filepath.Clean(m.path) || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if err := m.load(); err != nil {
+					log.Println("can't reload metadata:", err)
+				}
+			case err := <-w.Errors:
+				log.Println(err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *fakeMetadata) Get(ctx context.Context, req *hegel.GetRequest) (*hegel.GetResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &hegel.GetResponse{JSON: m.json}, nil
+}
+
+func (m *fakeMetadata) Subscribe(req *hegel.SubscribeRequest, stream hegel.Hegel_SubscribeServer) error {
+	ch := make(chan string, 1)
+	m.mu.Lock()
+	m.subscribers[ch] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.subscribers, ch)
+		m.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case doc := <-ch:
+			if err := stream.Send(&hegel.SubscribeResponse{JSON: doc}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *fakeMetadata) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	doc := m.json
+	m.mu.Unlock()
+
+	var md struct {
+		Instance json.RawMessage `json:"instance"`
+	}
+	if err := json.Unmarshal([]byte(doc), &md); err != nil || md.Instance == nil {
+		http.Error(w, "no instance in metadata", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(md.Instance)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// fakeNetwork is an in-memory hostNetwork. It records every change made through it as an operation like
+// "addr-replace lo 192.0.2.1/32", can be told to fail any operation, and notifies subscribers of link
+// and address changes like the kernel would
+type fakeNetwork struct {
+	links     map[string]netlink.Link
+	addrs     map[string][]netlink.Addr
+	routes    []netlink.Route
+	ops       []string
+	failures  map[string]error
+	linkSubs  []chan<- netlink.LinkUpdate
+	addrSubs  []chan<- netlink.AddrUpdate
+	nextIndex int
+	mu        sync.Mutex
+}
+
+// newFakeNetwork starts out with lo and the named devices, all of them up
+func newFakeNetwork(devices ...string) *fakeNetwork {
+	n := &fakeNetwork{
+		links:     make(map[string]netlink.Link),
+		addrs:     make(map[string][]netlink.Addr),
+		failures:  make(map[string]error),
+		nextIndex: 1,
+	}
+	for _, name := range append([]string{"lo"}, devices...) {
+		n.addLink(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name, Flags: net.FlagUp, OperState: netlink.OperUp}})
+	}
+	return n
+}
+
+// fail makes op return err, op is either a whole operation like "addr-replace lo 192.0.2.1/32" or just
+// its name like "addr-replace". Reads can fail too, e.g. "link-by-name bond0". A nil err clears it
+func (n *fakeNetwork) fail(op string, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err == nil {
+		delete(n.failures, op)
+		return
+	}
+	n.failures[op] = err
+}
+
+// check returns the error injected for op, recording it when it changes something. n.mu must be held
+func (n *fakeNetwork) check(op string, change bool) error {
+	err, ok := n.failures[op]
+	if !ok {
+		err = n.failures[strings.Fields(op)[0]]
+	}
+	if change {
+		if err != nil {
+			op += " (failed)"
+		}
+		n.ops = append(n.ops, op)
+	}
+	return err
+}
+
+// Ops returns the changes made so far and forgets them
+func (n *fakeNetwork) Ops() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ops := n.ops
+	n.ops = nil
+	return ops
+}
+
+// placed returns the addresses on the named link, sorted
+func (n *fakeNetwork) placed(name string) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	placed := make([]string, 0)
+	for _, a := range n.addrs[name] {
+		placed = append(placed, a.IPNet.String())
+	}
+	sort.Strings(placed)
+	return placed
+}
+
+// setLinkUp changes the state of the named link behind the agent's back
+func (n *fakeNetwork) setLinkUp(name string, up bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	attrs := n.links[name].Attrs()
+	attrs.OperState = netlink.OperDown
+	if up {
+		attrs.OperState = netlink.OperUp
+	}
+	for _, ch := range n.linkSubs {
+		select {
+		case ch <- netlink.LinkUpdate{Link: n.links[name]}:
+		default:
+		}
+	}
+}
+
+// removeAddr deletes an address behind the agent's back
+func (n *fakeNetwork) removeAddr(name, cidr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr, _ := netlink.ParseAddr(cidr)
+	n.delAddr(n.links[name], addr)
+}
+
+// local reports whether the kernel would take ip as its own: it's an address placed on a link, inside a
+// prefix placed on lo, or inside a local route
+func (n *fakeNetwork) local(ip string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr := net.ParseIP(ip)
+	for name, addrs := range n.addrs {
+		for _, a := range addrs {
+			if a.IP.Equal(addr) || name == "lo" && a.IPNet.Contains(addr) {
+				return true
+			}
+		}
+	}
+	for _, r := range n.routes {
+		if r.Type == unix.RTN_LOCAL && r.Table == unix.RT_TABLE_LOCAL && r.Dst.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *fakeNetwork) addLink(link netlink.Link) {
+	link.Attrs().Index = n.nextIndex
+	n.nextIndex++
+	n.links[link.Attrs().Name] = link
+}
+
+func (n *fakeNetwork) notifyAddr(link netlink.Link, addr netlink.Addr, added bool) {
+	for _, ch := range n.addrSubs {
+		select {
+		case ch <- netlink.AddrUpdate{LinkAddress: *addr.IPNet, LinkIndex: link.Attrs().Index, NewAddr: added}:
+		default:
+		}
+	}
+}
+
+func (n *fakeNetwork) delAddr(link netlink.Link, addr *netlink.Addr) bool {
+	name := link.Attrs().Name
+	for i, a := range n.addrs[name] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			n.addrs[name] = append(n.addrs[name][:i], n.addrs[name][i+1:]...)
+			n.notifyAddr(link, a, false)
+			return true
+		}
+	}
+	return false
+}
+
+func (n *fakeNetwork) LinkByName(name string) (netlink.Link, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("link-by-name "+name, false); err != nil {
+		return nil, err
+	}
+	link, ok := n.links[name]
+	if !ok {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return link, nil
+}
+
+func (n *fakeNetwork) LinkByIndex(index int) (netlink.Link, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, link := range n.links {
+		if link.Attrs().Index == index {
+			return link, nil
+		}
+	}
+	return nil, netlink.LinkNotFoundError{}
+}
+
+func (n *fakeNetwork) LinkList() ([]netlink.Link, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("link-list", false); err != nil {
+		return nil, err
+	}
+	links := make([]netlink.Link, 0, len(n.links))
+	for _, link := range n.links {
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (n *fakeNetwork) LinkAdd(link netlink.Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("link-add "+link.Attrs().Name, true); err != nil {
+		return err
+	}
+	if _, ok := n.links[link.Attrs().Name]; ok {
+		return syscall.EEXIST
+	}
+	n.addLink(link)
+	return nil
+}
+
+func (n *fakeNetwork) LinkSetUp(link netlink.Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("link-set-up "+link.Attrs().Name, true); err != nil {
+		return err
+	}
+	link.Attrs().Flags |= net.FlagUp
+	return nil
+}
+
+func (n *fakeNetwork) LinkDel(link netlink.Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("link-del "+link.Attrs().Name, true); err != nil {
+		return err
+	}
+	delete(n.links, link.Attrs().Name)
+	delete(n.addrs, link.Attrs().Name)
+	routes := n.routes[:0]
+	for _, r := range n.routes {
+		if r.LinkIndex != link.Attrs().Index {
+			routes = append(routes, r)
+		}
+	}
+	n.routes = routes
+	return nil
+}
+
+func (n *fakeNetwork) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("addr-list "+link.Attrs().Name, false); err != nil {
+		return nil, err
+	}
+	return append([]netlink.Addr{}, n.addrs[link.Attrs().Name]...), nil
+}
+
+func (n *fakeNetwork) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	name := link.Attrs().Name
+	if err := n.check(fmt.Sprintf("addr-replace %s %s", name, addr.IPNet), true); err != nil {
+		return err
+	}
+	for _, a := range n.addrs[name] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			return nil
+		}
+	}
+	n.addrs[name] = append(n.addrs[name], *addr)
+	n.notifyAddr(link, *addr, true)
+	return nil
+}
+
+func (n *fakeNetwork) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check(fmt.Sprintf("addr-del %s %s", link.Attrs().Name, addr.IPNet), true); err != nil {
+		return err
+	}
+	if !n.delAddr(link, addr) {
+		return syscall.EADDRNOTAVAIL
+	}
+	return nil
+}
+
+func (n *fakeNetwork) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("route-list", false); err != nil {
+		return nil, err
+	}
+	routes := make([]netlink.Route, 0)
+	for _, r := range n.routes {
+		if filterMask&netlink.RT_FILTER_TABLE != 0 && r.Table != filter.Table {
+			continue
+		}
+		if filterMask&netlink.RT_FILTER_PROTOCOL != 0 && r.Protocol != filter.Protocol {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func (n *fakeNetwork) RouteReplace(route *netlink.Route) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check(fmt.Sprintf("route-replace %s table %d", route.Dst, route.Table), true); err != nil {
+		return err
+	}
+	n.removeRoute(route)
+	n.routes = append(n.routes, *route)
+	return nil
+}
+
+func (n *fakeNetwork) RouteDel(route *netlink.Route) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check(fmt.Sprintf("route-del %s table %d", route.Dst, route.Table), true); err != nil {
+		return err
+	}
+	if !n.removeRoute(route) {
+		return syscall.ESRCH
+	}
+	return nil
+}
+
+func (n *fakeNetwork) removeRoute(route *netlink.Route) bool {
+	for i, r := range n.routes {
+		if r.Dst.String() == route.Dst.String() && r.Table == route.Table {
+			n.routes = append(n.routes[:i], n.routes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (n *fakeNetwork) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("link-subscribe", false); err != nil {
+		return err
+	}
+	n.linkSubs = append(n.linkSubs, ch)
+	return nil
+}
+
+func (n *fakeNetwork) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.check("addr-subscribe", false); err != nil {
+		return err
+	}
+	n.addrSubs = append(n.addrSubs, ch)
+	return nil
+}
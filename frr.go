@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// frrSpeaker announces through an FRR bgpd already running on the host, configured with vtysh. Each
+// prefix becomes a network statement with its own route-map carrying the route's attributes
+type frrSpeaker struct {
+	vtysh    string
+	asn      uint32
+	neighbor string
+	routes   map[string]*route // what this run announced, by prefix
+}
+
+func newFRRSpeaker(vtysh string) *frrSpeaker {
+	return &frrSpeaker{vtysh: vtysh, routes: make(map[string]*route)}
+}
+
+// run runs commands in configuration mode
+func (f *frrSpeaker) run(commands ...string) error {
+	args := []string{"-c", "configure terminal"}
+	for _, c := range commands {
+		args = append(args, "-c", c)
+	}
+	out, err := exec.Command(f.vtysh, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("vtysh: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	// vtysh exits 0 on some configuration errors, they are reported with a % prefix
+	if strings.Contains(string(out), "%") {
+		return fmt.Errorf("vtysh: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// configure runs commands in the router bgp section
+func (f *frrSpeaker) configure(commands ...string) error {
+	return f.run(append([]string{"router bgp " + strconv.FormatUint(uint64(f.asn), 10)}, commands...)...)
+}
+
+// Start only makes sure the BGP instance exists, the router id belongs to whoever runs FRR
+func (f *frrSpeaker) Start(asn uint32, routerID string) error {
+	f.asn = asn
+	return f.configure()
+}
+
+func (f *frrSpeaker) AddNeighbor(address string, peerAS uint32, password string) error {
+	f.neighbor = address
+	commands := []string{"neighbor " + address + " remote-as " + strconv.FormatUint(uint64(peerAS), 10)}
+	if password != "" {
+		commands = append(commands, "neighbor "+address+" password "+password)
+	}
+	commands = append(commands,
+		"address-family ipv4 unicast", "neighbor "+address+" activate", "exit-address-family",
+		"address-family ipv6 unicast", "neighbor "+address+" activate", "exit-address-family",
+	)
+	return f.configure(commands...)
+}
+
+func (f *frrSpeaker) Announce(prefix string, r *route) error {
+	if len(r.ECMP) > 0 {
+		return fmt.Errorf("several next hops need the %s speaker", speakerGobgp)
+	}
+	family, nextHop, err := frrFamily(prefix)
+	if err != nil {
+		return err
+	}
+	routeMap := frrRouteMap(prefix)
+
+	// changing the route-map in place is a soft update, bgpd re-evaluates the network statement. A
+	// route-map left by a previous run is rebuilt, nothing of its route may linger
+	prev, ok := f.routes[prefix]
+	if !ok {
+		f.run("no route-map " + routeMap) // it may not exist
+		prev = &route{}
+	}
+	commands := []string{"route-map " + routeMap + " permit 10", "set " + nextHop + " " + r.NextHop}
+	if len(r.Communities) > 0 {
+		commands = append(commands, "set community "+strings.Join(r.Communities, " "))
+	} else if len(prev.Communities) > 0 {
+		commands = append(commands, "no set community")
+	}
+	if r.Prepend > 0 {
+		asn := strconv.FormatUint(uint64(f.asn), 10)
+		commands = append(commands, "set as-path prepend "+strings.TrimSpace(strings.Repeat(asn+" ", r.Prepend)))
+	} else if prev.Prepend > 0 {
+		commands = append(commands, "no set as-path prepend")
+	}
+	if r.MED > 0 {
+		commands = append(commands, "set metric "+strconv.FormatUint(uint64(r.MED), 10))
+	} else if prev.MED > 0 {
+		commands = append(commands, "no set metric")
+	}
+	if r.Aggregator != "" {
+		commands = append(commands, "set atomic-aggregate", "set aggregator as "+strconv.FormatUint(uint64(f.asn), 10)+" "+r.Aggregator)
+	} else if prev.Aggregator != "" {
+		commands = append(commands, "no set atomic-aggregate", "no set aggregator as")
+	}
+	if err := f.run(commands...); err != nil {
+		return err
+	}
+	if err := f.configure("address-family "+family, "network "+prefix+" route-map "+routeMap, "exit-address-family"); err != nil {
+		return err
+	}
+	f.routes[prefix] = r
+	return nil
+}
+
+func (f *frrSpeaker) Withdraw(prefix string) error {
+	family, _, err := frrFamily(prefix)
+	if err != nil {
+		return err
+	}
+	if err := f.configure("address-family "+family, "no network "+prefix, "exit-address-family"); err != nil {
+		return err
+	}
+	if err := f.run("no route-map " + frrRouteMap(prefix)); err != nil {
+		return err
+	}
+	delete(f.routes, prefix)
+	return nil
+}
+
+func (f *frrSpeaker) Persistent() bool {
+	return true
+}
+
+func (f *frrSpeaker) SessionState() (string, error) {
+	out, err := exec.Command(f.vtysh, "-c", "show bgp neighbors "+f.neighbor+" json").Output()
+	if err != nil {
+		return "", fmt.Errorf("vtysh: %s", err)
+	}
+	neighbors := make(map[string]struct {
+		State string `json:"bgpState"`
+	})
+	if err := json.Unmarshal(out, &neighbors); err != nil {
+		return "", err
+	}
+	n, ok := neighbors[f.neighbor]
+	if !ok {
+		return "", fmt.Errorf("no neighbor %s", f.neighbor)
+	}
+	return strings.ToLower(n.State), nil
+}
+
+// frrFamily returns the address family section and the route-map next hop command for prefix
+func frrFamily(prefix string) (string, string, error) {
+	ip, _, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", "", err
+	}
+	if ip.To4() != nil {
+		return "ipv4 unicast", "ip next-hop", nil
+	}
+	return "ipv6 unicast", "ipv6 next-hop global", nil
+}
+
+// frrRouteMap names the route-map of a prefix, e.g. packet-bgp-agent-147.75.65.1_32
+func frrRouteMap(prefix string) string {
+	return "packet-bgp-agent-" + strings.NewReplacer("/", "_", ":", ".").Replace(prefix)
+}
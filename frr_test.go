@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCommand writes a script to dir standing in for a control binary like vtysh or birdc. Every run
+// appends its arguments, joined by |, to the returned log and prints output
+func fakeCommand(t *testing.T, dir, name, output string) (string, func() []string) {
+	path, log, out := filepath.Join(dir, name), filepath.Join(dir, name+".log"), filepath.Join(dir, name+".out")
+	if err := ioutil.WriteFile(out, []byte(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\nIFS='|'\necho \"$*\" >> " + log + "\ncat " + out + "\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runs := func() []string {
+		b, err := ioutil.ReadFile(log)
+		if err != nil {
+			return nil
+		}
+		os.Remove(log)
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+	return path, runs
+}
+
+func TestFRRSpeaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-frr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vtysh, runs := fakeCommand(t, dir, "vtysh", `{"10.99.0.1": {"bgpState": "Established"}}`)
+
+	f := newFRRSpeaker(vtysh)
+	if err := f.Start(65000, "10.99.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddNeighbor("10.99.0.1", 65530, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "vtysh", runs(),
+		"-c|configure terminal|-c|router bgp 65000",
+		"-c|configure terminal|-c|router bgp 65000|-c|neighbor 10.99.0.1 remote-as 65530|-c|neighbor 10.99.0.1 password hunter2"+
+			"|-c|address-family ipv4 unicast|-c|neighbor 10.99.0.1 activate|-c|exit-address-family"+
+			"|-c|address-family ipv6 unicast|-c|neighbor 10.99.0.1 activate|-c|exit-address-family")
+
+	// a route-map a previous run left is rebuilt from scratch
+	r := &route{NextHop: "10.99.0.2", Communities: []string{"65000:100", "65535:0"}, Prepend: 2, MED: 10}
+	if err := f.Announce("192.0.2.1/32", r); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "vtysh", runs(),
+		"-c|configure terminal|-c|no route-map packet-bgp-agent-192.0.2.1_32",
+		"-c|configure terminal|-c|route-map packet-bgp-agent-192.0.2.1_32 permit 10|-c|set ip next-hop 10.99.0.2"+
+			"|-c|set community 65000:100 65535:0|-c|set as-path prepend 65000 65000|-c|set metric 10",
+		"-c|configure terminal|-c|router bgp 65000|-c|address-family ipv4 unicast|-c|network 192.0.2.1/32 route-map packet-bgp-agent-192.0.2.1_32|-c|exit-address-family")
+
+	// what the new route doesn't set anymore is unset in place
+	if err := f.Announce("192.0.2.1/32", &route{NextHop: "10.99.0.2", Aggregator: "10.99.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "vtysh", runs(),
+		"-c|configure terminal|-c|route-map packet-bgp-agent-192.0.2.1_32 permit 10|-c|set ip next-hop 10.99.0.2"+
+			"|-c|no set community|-c|no set as-path prepend|-c|no set metric|-c|set atomic-aggregate|-c|set aggregator as 65000 10.99.0.2",
+		"-c|configure terminal|-c|router bgp 65000|-c|address-family ipv4 unicast|-c|network 192.0.2.1/32 route-map packet-bgp-agent-192.0.2.1_32|-c|exit-address-family")
+
+	if err := f.Announce("2001:db8::/64", &route{NextHop: "2001:db8:1::2"}); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "vtysh", runs(),
+		"-c|configure terminal|-c|no route-map packet-bgp-agent-2001.db8.._64",
+		"-c|configure terminal|-c|route-map packet-bgp-agent-2001.db8.._64 permit 10|-c|set ipv6 next-hop global 2001:db8:1::2",
+		"-c|configure terminal|-c|router bgp 65000|-c|address-family ipv6 unicast|-c|network 2001:db8::/64 route-map packet-bgp-agent-2001.db8.._64|-c|exit-address-family")
+
+	if err := f.Withdraw("192.0.2.1/32"); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "vtysh", runs(),
+		"-c|configure terminal|-c|router bgp 65000|-c|address-family ipv4 unicast|-c|no network 192.0.2.1/32|-c|exit-address-family",
+		"-c|configure terminal|-c|no route-map packet-bgp-agent-192.0.2.1_32")
+
+	if state, err := f.SessionState(); err != nil || state != "established" {
+		t.Errorf("session state is %q, %v, want established", state, err)
+	}
+	if err := f.Announce("192.0.2.2/32", &route{NextHop: "10.99.0.2", ECMP: []string{"10.99.0.3"}}); err == nil {
+		t.Error("announced several next hops")
+	}
+
+	// vtysh exits 0 on some configuration errors
+	failing, _ := fakeCommand(t, dir, "vtysh-failing", "% Unknown command: route-map\n")
+	if err := newFRRSpeaker(failing).Withdraw("192.0.2.1/32"); err == nil {
+		t.Error("a configuration error wasn't reported")
+	}
+}
@@ -2,17 +2,20 @@ package main
 
 import (
 	"errors"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/packethost/packngo/metadata"
 	"github.com/vishvananda/netlink"
 )
 
-func getPrivateIP() (*metadata.AddressInfo, error) {
-	device, err := metadata.GetMetadata()
-	if err != nil {
-		return nil, err
-	}
+func getPrivateIP(device *metadata.CurrentDevice) (*metadata.AddressInfo, error) {
 	for _, addr := range device.Network.Addresses {
 		if addr.Family == 4 && addr.Management && !addr.Public {
 			return &addr, nil
@@ -21,9 +24,9 @@ func getPrivateIP() (*metadata.AddressInfo, error) {
 	return nil, errors.New("No IP found")
 }
 
-// addAddr adds an IP to the loopback device
-func addAddr(ipnet *net.IPNet) error {
-	lo, err := netlink.LinkByName("lo")
+// addAddr adds an IP to the named device
+func addAddr(nl hostNetwork, linkName string, ipnet *net.IPNet) error {
+	link, err := nl.LinkByName(linkName)
 	if err != nil {
 		return err
 	}
@@ -32,7 +35,117 @@ func addAddr(ipnet *net.IPNet) error {
 	if err != nil {
 		return err
 	}
-	err = netlink.AddrReplace(lo, addr)
+	err = nl.AddrReplace(link, addr)
 
 	return err
 }
+
+// delAddr removes an IP from the named device, it's not an error if it or the device isn't there
+func delAddr(nl hostNetwork, linkName string, ipnet *net.IPNet) error {
+	link, err := nl.LinkByName(linkName)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	addr, err := netlink.ParseAddr(ipnet.String())
+	if err != nil {
+		return err
+	}
+	err = nl.AddrDel(link, addr)
+	if err == syscall.EADDRNOTAVAIL {
+		return nil
+	}
+
+	return err
+}
+
+// envOrDefault returns the value of the env var key, or def if it isn't set
+func envOrDefault(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envBool returns the env var key parsed as a bool, false if unset or invalid
+func envBool(key string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(key))
+	return b
+}
+
+// envInt returns the env var key parsed as an int, or def if it's unset or invalid
+func envInt(key string, def int) int {
+	i, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+// envDuration returns the env var key parsed as a duration, or def if it's unset or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// dialAddr turns a listen address like ":50051" into one that can be dialed
+func dialAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// writeFileAtomic writes b to a temporary file next to path and renames it into place
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+// hostNetwork is the part of a network namespace the agent touches: links, addresses, routes, and
+// notifications of link and address changes
+type hostNetwork interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrReplace(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+
+	// LinkSubscribe and AddrSubscribe send changes down ch until done is closed
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+	AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error
+}
+
+// netlinkNetwork is a hostNetwork talking netlink to the kernel
+type netlinkNetwork struct {
+	*netlink.Handle
+	netns string
+}
+
+// newNetlinkNetwork operates in the named network namespace, the current one if it's empty
+func newNetlinkNetwork(netnsName string) (*netlinkNetwork, error) {
+	h, err := netlinkHandle(netnsName)
+	if err != nil {
+		return nil, err
+	}
+	return &netlinkNetwork{Handle: h, netns: netnsName}, nil
+}
+
+// newHostNetworks returns the agent's own namespace and the one VIPs are placed in, the same unless
+// vipNetns is set
+func newHostNetworks(vipNetns string) (host, vip hostNetwork, err error) {
+	h, err := newNetlinkNetwork("")
+	if err != nil {
+		return nil, nil, err
+	}
+	if vipNetns == "" {
+		return h, h, nil
+	}
+	v, err := newNetlinkNetwork(vipNetns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, v, nil
+}
+
+func (n *netlinkNetwork) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	if n.netns == "" {
+		return netlink.LinkSubscribe(ch, done)
+	}
+
+	ns, err := getNetns(n.netns)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	return netlink.LinkSubscribeAt(ns, ch, done)
+}
+
+func (n *netlinkNetwork) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	if n.netns == "" {
+		return netlink.AddrSubscribe(ch, done)
+	}
+
+	ns, err := getNetns(n.netns)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	return netlink.AddrSubscribeAt(ns, ch, done)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+	"github.com/vishvananda/netlink"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+const (
+	importPolicyName  = "packet-bgp-agent-import"
+	routerNeighborSet = "packet-routers"
+
+	// rtprotBGP marks kernel routes installed by the agent, as listed in /etc/iproute2/rt_protos
+	rtprotBGP = 186
+)
+
+// setupImportPolicy makes sure only routes from the Packet routers matching prefixes reach the RIB, the
+// agent's own paths aren't affected
+func setupImportPolicy(s *gobgpServer.BgpServer, routers []string, prefixes []string) error {
+	if err := addNeighborSet(s, routerNeighborSet, routers...); err != nil {
+		return err
+	}
+	prefixSets, err := addPrefixSets(s, importPolicyName, prefixes)
+	if err != nil {
+		return err
+	}
+
+	statements := make([]config.Statement, 0, len(prefixSets)+1)
+	for _, set := range prefixSets {
+		statements = append(statements, config.Statement{
+			Name: set,
+			Conditions: config.Conditions{
+				MatchPrefixSet:   config.MatchPrefixSet{PrefixSet: set},
+				MatchNeighborSet: config.MatchNeighborSet{NeighborSet: routerNeighborSet},
+			},
+			Actions: config.Actions{RouteDisposition: config.ROUTE_DISPOSITION_ACCEPT_ROUTE},
+		})
+	}
+	statements = append(statements, config.Statement{
+		Name: importPolicyName + "-reject",
+		Conditions: config.Conditions{
+			MatchNeighborSet: config.MatchNeighborSet{NeighborSet: routerNeighborSet},
+		},
+		Actions: config.Actions{RouteDisposition: config.ROUTE_DISPOSITION_REJECT_ROUTE},
+	})
+
+	return addGlobalImportPolicy(s, importPolicyName, statements)
+}
+
+// routeImporter installs the best paths received from peers into a kernel routing table, using every
+// equally good path as an ECMP next hop
+type routeImporter struct {
+	server    *gobgpServer.BgpServer
+	host      hostNetwork
+	table     int
+	installed map[string]*netlink.Route
+}
+
+func newRouteImporter(server *gobgpServer.BgpServer, host hostNetwork, routingTable int) *routeImporter {
+	return &routeImporter{
+		server:    server,
+		host:      host,
+		table:     routingTable,
+		installed: make(map[string]*netlink.Route),
+	}
+}
+
+// Run should be run as a go routine, keeps the kernel table in sync with the RIB until done is closed and
+// then removes everything it installed
+func (i *routeImporter) Run(done chan bool) {
+	i.flush()
+
+	w := i.server.Watch(gobgpServer.WatchBestPath(true))
+	defer w.Stop()
+
+	for {
+		select {
+		case <-done:
+			i.removeAll()
+			return
+		case ev := <-w.Event():
+			best, ok := ev.(*gobgpServer.WatchEventBestPath)
+			if !ok {
+				continue
+			}
+			// with multipath on, changes to the equally good paths that leave the best one alone only
+			// show up in MultiPathList
+			for _, paths := range append(best.MultiPathList, best.PathList) {
+				for _, path := range paths {
+					if err := i.sync(path.GetRouteFamily(), path.GetNlri().String()); err != nil {
+						log.Println(err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// sync installs or removes the kernel route for prefix according to the RIB
+func (i *routeImporter) sync(family bgp.RouteFamily, prefix string) error {
+	if family != bgp.RF_IPv4_UC && family != bgp.RF_IPv6_UC {
+		return nil
+	}
+
+	rib, _, err := i.server.GetRib("", family, []*table.LookupPrefix{{Prefix: prefix}})
+	if err != nil {
+		return err
+	}
+
+	nexthops := make([]net.IP, 0)
+	seen := make(map[string]bool)
+	for _, dst := range rib.GetDestinations() {
+		for _, path := range dst.GetMultiBestPath(table.GLOBAL_RIB_NAME) {
+			if path.IsLocal() || path.IsWithdraw || seen[path.GetNexthop().String()] {
+				continue
+			}
+			seen[path.GetNexthop().String()] = true
+			nexthops = append(nexthops, path.GetNexthop())
+		}
+	}
+
+	if len(nexthops) == 0 {
+		return i.remove(prefix)
+	}
+
+	_, dst, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+	route := &netlink.Route{
+		Dst:      dst,
+		Table:    i.table,
+		Protocol: rtprotBGP,
+	}
+	if len(nexthops) == 1 {
+		route.Gw = nexthops[0]
+	} else {
+		for _, nh := range nexthops {
+			route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{Gw: nh})
+		}
+	}
+
+	if err := i.host.RouteReplace(route); err != nil {
+		return fmt.Errorf("can't install imported route %s via %v: %s", prefix, nexthops, err)
+	}
+	log.Println("installed imported route", prefix, "via", nexthops, "in table", i.table)
+	i.installed[prefix] = route
+	return nil
+}
+
+func (i *routeImporter) remove(prefix string) error {
+	route, ok := i.installed[prefix]
+	if !ok {
+		return nil
+	}
+	if err := i.host.RouteDel(route); err != nil {
+		return err
+	}
+	log.Println("removed imported route", prefix, "from table", i.table)
+	delete(i.installed, prefix)
+	return nil
+}
+
+func (i *routeImporter) removeAll() {
+	for prefix := range i.installed {
+		if err := i.remove(prefix); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// flush removes routes a previous run left in the table
+func (i *routeImporter) flush() {
+	routes, err := i.host.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Table:    i.table,
+		Protocol: rtprotBGP,
+	}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, route := range routes {
+		route := route
+		if err := i.host.RouteDel(&route); err != nil {
+			log.Println(err)
+		}
+	}
+}
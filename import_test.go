@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+	"github.com/vishvananda/netlink"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+func TestImporterFlush(t *testing.T) {
+	n := newFakeNetwork()
+	for _, r := range []struct {
+		dst      string
+		table    int
+		protocol int
+	}{
+		{"10.0.0.0/8", 100, rtprotBGP},
+		{"10.1.0.0/16", 100, 4}, // static, someone else's
+		{"10.2.0.0/16", 200, rtprotBGP},
+	} {
+		_, dst, _ := net.ParseCIDR(r.dst)
+		n.routes = append(n.routes, netlink.Route{Dst: dst, Table: r.table, Protocol: r.protocol})
+	}
+
+	newRouteImporter(nil, n, 100).flush()
+	expectOps(t, "network", n.Ops(), "route-del 10.0.0.0/8 table 100")
+}
+
+// receivePath makes s take a path for prefix as if the Packet router at peer had sent it, withdrawn
+// unless asPath is set
+func receivePath(t *testing.T, s *gobgpServer.BgpServer, peer, prefix string, asPath ...uint32) {
+	_, ipnet, _ := net.ParseCIDR(prefix)
+	ones, _ := ipnet.Mask.Size()
+	source := &table.PeerInfo{AS: 65530, LocalAS: 65000, Address: net.ParseIP(peer), ID: net.ParseIP(peer)}
+	var pattrs []bgp.PathAttributeInterface
+	if len(asPath) > 0 {
+		pattrs = []bgp.PathAttributeInterface{
+			bgp.NewPathAttributeOrigin(0),
+			bgp.NewPathAttributeAsPath([]bgp.AsPathParamInterface{bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, asPath)}),
+			bgp.NewPathAttributeNextHop(peer),
+		}
+	}
+	path := table.NewPath(source, bgp.NewIPAddrPrefix(uint8(ones), ipnet.IP.String()), len(asPath) == 0, pattrs, time.Now(), false)
+	if _, err := s.AddPath("", []*table.Path{path}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// importedVia returns the next hops of the route to prefix in table 100
+func importedVia(n *fakeNetwork, prefix string) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	hops := make([]string, 0)
+	for _, r := range n.routes {
+		if r.Table != 100 || r.Dst.String() != prefix {
+			continue
+		}
+		if r.Gw != nil {
+			hops = append(hops, r.Gw.String())
+		}
+		for _, nh := range r.MultiPath {
+			hops = append(hops, nh.Gw.String())
+		}
+	}
+	return hops
+}
+
+func TestImporterSync(t *testing.T) {
+	// left running, like the test router, see testHarness.Close
+	s := gobgpServer.NewBgpServer()
+	go s.Serve()
+	global := &config.Global{Config: config.GlobalConfig{As: 65000, RouterId: "10.99.0.2", Port: -1}}
+	global.UseMultiplePaths.Config.Enabled = true // as the agent starts it when importing
+	if err := s.Start(global); err != nil {
+		t.Fatal(err)
+	}
+	n := newFakeNetwork()
+	done := make(chan bool)
+	go newRouteImporter(s, n, 100).Run(done)
+
+	expectVia := func(what, want string) {
+		t.Helper()
+		eventually(t, what, func() bool { return fmt.Sprint(importedVia(n, "203.0.113.0/24")) == want })
+	}
+	receivePath(t, s, "10.0.0.1", "203.0.113.0/24", 65530)
+	expectVia("the route to be installed", "[10.0.0.1]")
+
+	// an equally good path leaves the best one alone, it's added as an ECMP next hop all the same, and a
+	// worse one isn't
+	receivePath(t, s, "10.0.0.2", "203.0.113.0/24", 65530)
+	receivePath(t, s, "10.0.0.3", "203.0.113.0/24", 65530, 64999)
+	expectVia("an ECMP next hop to be added", "[10.0.0.1 10.0.0.2]")
+	receivePath(t, s, "10.0.0.2", "203.0.113.0/24")
+	expectVia("an ECMP next hop to be removed", "[10.0.0.1]")
+
+	receivePath(t, s, "10.0.0.1", "203.0.113.0/24")
+	expectVia("the worse path to take over", "[10.0.0.3]")
+	receivePath(t, s, "10.0.0.3", "203.0.113.0/24")
+	expectVia("the route to be removed", "[]")
+
+	// what's left is removed on exit
+	receivePath(t, s, "10.0.0.1", "198.51.100.0/24", 65530)
+	eventually(t, "the route to be installed", func() bool { return len(importedVia(n, "198.51.100.0/24")) == 1 })
+	close(done)
+	eventually(t, "the table to be emptied", func() bool {
+		routes, _ := n.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: 100}, netlink.RT_FILTER_TABLE)
+		return len(routes) == 0
+	})
+}
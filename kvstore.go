@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kvEntry is a key and its value, as a recursive GET lists them
+type kvEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// kvStore is a minimal in-memory KV store standing in for a real one, enough for mesh discovery. Under
+// /v1/kv/<key> it takes PUT, with an optional ?ttl= after which the key expires, GET, which returns the
+// value or with ?recurse every entry whose key starts with <key> as JSON, and DELETE
+type kvStore struct {
+	entries map[string]kvValue
+	mu      sync.Mutex
+}
+
+type kvValue struct {
+	value   string
+	expires time.Time // zero if it never does
+}
+
+func newKVStore() *kvStore {
+	return &kvStore{entries: make(map[string]kvValue)}
+}
+
+// runKVStore serves a KV store, args are the flags after "kv-store"
+func runKVStore(args []string) error {
+	fs := flag.NewFlagSet("kv-store", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8500", "address to serve the KV API on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	log.Println("serving a KV store on", *listen)
+	return http.ListenAndServe(*listen, newKVStore())
+}
+
+func (s *kvStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, v := range s.entries {
+		if !v.expires.IsZero() && now.After(v.expires) {
+			delete(s.entries, k)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v := kvValue{value: string(b)}
+		if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			v.expires = now.Add(d)
+		}
+		s.entries[key] = v
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if _, ok := r.URL.Query()["recurse"]; ok {
+			entries := []kvEntry{}
+			for k, v := range s.entries {
+				if strings.HasPrefix(k, key) {
+					entries = append(entries, kvEntry{Key: k, Value: v.value})
+				}
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+			writeJSON(w, entries)
+			return
+		}
+		v, ok := s.entries[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(v.value))
+	case http.MethodDelete:
+		delete(s.entries, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "use GET, PUT or DELETE", http.StatusMethodNotAllowed)
+	}
+}
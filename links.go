@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// maxLinkNameLen is IFNAMSIZ without the trailing NUL
+const maxLinkNameLen = 15
+
+var groupNameRe = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// vipLinks manages the interfaces announced addresses are placed on. Unless the base is "lo" these are
+// dummy interfaces, optionally one per VIP group named <base>-<group>, owned by the agent if it created them
+type vipLinks struct {
+	nl       hostNetwork
+	base     string
+	perGroup bool
+	ready    map[string]bool // set up by Ensure
+	owned    map[string]bool // created by the agent, deleted on Teardown
+	procRoot string          // where the sysctls of group interfaces are set, they aren't when empty
+	netns    string
+	state    *stateStore // where interfaces are recorded as owned before they're created, if set
+}
+
+// newVIPLinks manages VIP interfaces in the namespace of nl
+func newVIPLinks(nl hostNetwork, base string, perGroup bool) *vipLinks {
+	return &vipLinks{
+		nl:       nl,
+		base:     base,
+		perGroup: perGroup,
+		ready:    make(map[string]bool),
+		owned:    make(map[string]bool),
+	}
+}
+
+// Setup creates the base interface
+func (l *vipLinks) Setup() error {
+	return l.Ensure(l.base)
+}
+
+// NameFor returns the name of the interface addresses in group belong on
+func (l *vipLinks) NameFor(group string) (string, error) {
+	if !l.perGroup || group == "" || l.base == "lo" {
+		return l.base, nil
+	}
+	if !groupNameRe.MatchString(group) {
+		return "", fmt.Errorf("invalid VIP group name %q", group)
+	}
+	name := l.base + "-" + group
+	if len(name) > maxLinkNameLen {
+		return "", fmt.Errorf("interface name %s for VIP group %s is longer than %d characters", name, group, maxLinkNameLen)
+	}
+	return name, nil
+}
+
+// Ensure creates the named interface as an agent-owned dummy, unless it's lo or already exists, and sets
+// it up
+func (l *vipLinks) Ensure(name string) error {
+	if name == "lo" || l.ready[name] {
+		return nil
+	}
+
+	link, err := l.nl.LinkByName(name)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		if l.state != nil {
+			if err := l.state.AddLink(name); err != nil {
+				return fmt.Errorf("can't record VIP interface %s before creating it: %s", name, err)
+			}
+		}
+		link = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+		if err := l.nl.LinkAdd(link); err != nil {
+			return err
+		}
+		log.Println("created VIP interface", name)
+		l.owned[name] = true
+	} else if err != nil {
+		return err
+	} else if link.Type() != "dummy" {
+		return fmt.Errorf("VIP interface %s already exists and is a %s, not a dummy interface", name, link.Type())
+	}
+
+	// the base interface is checked along with the host's sysctls, a group interface the agent created is
+	// its own, so its settings are made right away
+	if l.owned[name] && name != l.base && l.procRoot != "" {
+		if err := newSysctlManager(l.procRoot, l.netns, vipLinkSysctls(name)).Ensure(true); err != nil {
+			return err
+		}
+	}
+	if err := l.nl.LinkSetUp(link); err != nil {
+		return err
+	}
+	l.ready[name] = true
+	return nil
+}
+
+// Owned returns the interfaces the agent created, sorted
+func (l *vipLinks) Owned() []string {
+	names := make([]string, 0, len(l.owned))
+	for name := range l.owned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Adopt takes ownership of the named interfaces a previous run created, those that are gone are skipped
+func (l *vipLinks) Adopt(names []string) {
+	for _, name := range names {
+		if _, err := l.nl.LinkByName(name); err == nil && name != "lo" {
+			l.owned[name] = true
+		}
+	}
+}
+
+// AddAddr places ipnet on the named interface. The kernel only takes a whole prefix as local on a
+// loopback interface, on a dummy one just the address itself is, so the rest gets a local route
+func (l *vipLinks) AddAddr(name string, ipnet *net.IPNet) error {
+	if err := addAddr(l.nl, name, ipnet); err != nil {
+		return err
+	}
+	route, err := l.localRoute(name, ipnet)
+	if err != nil || route == nil {
+		return err
+	}
+	return l.nl.RouteReplace(route)
+}
+
+// DelAddr removes ipnet, and its local route, from the named interface
+func (l *vipLinks) DelAddr(name string, ipnet *net.IPNet) error {
+	route, err := l.localRoute(name, ipnet)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if route != nil {
+		if err := l.nl.RouteDel(route); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return delAddr(l.nl, name, ipnet)
+}
+
+// localRoute returns the route that makes all of ipnet local on the named interface, nil when placing
+// the address is enough
+func (l *vipLinks) localRoute(name string, ipnet *net.IPNet) (*netlink.Route, error) {
+	if ones, bits := ipnet.Mask.Size(); name == "lo" || ones == bits {
+		return nil, nil
+	}
+	link, err := l.nl.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask},
+		Type:      unix.RTN_LOCAL,
+		Table:     unix.RT_TABLE_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+	}, nil
+}
+
+// LinkName returns the name of the interface with the given index
+func (l *vipLinks) LinkName(index int) (string, error) {
+	link, err := l.nl.LinkByIndex(index)
+	if err != nil {
+		return "", err
+	}
+	return link.Attrs().Name, nil
+}
+
+// HasAddr reports whether ipnet is placed on the named interface
+func (l *vipLinks) HasAddr(name string, ipnet *net.IPNet) (bool, error) {
+	link, err := l.nl.LinkByName(name)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	addrs, err := l.nl.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IPNet.String() == ipnet.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddrSubscribe sends address changes in the VIP namespace down ch until done is closed
+func (l *vipLinks) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	return l.nl.AddrSubscribe(ch, done)
+}
+
+// Teardown deletes every interface the agent owns, along with the addresses on them
+func (l *vipLinks) Teardown() error {
+	var lastErr error
+	for name := range l.owned {
+		link, err := l.nl.LinkByName(name)
+		if err == nil {
+			err = l.nl.LinkDel(link)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		log.Println("deleted VIP interface", name)
+		delete(l.owned, name)
+		delete(l.ready, name)
+	}
+	return lastErr
+}
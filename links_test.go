@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func mustParseAddr(t *testing.T, cidr string) *netlink.Addr {
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestPerGroupLinks(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{VIPInterface: "vip", InterfacePerGroup: true}, sp, n)
+
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32", Group: "web"}, Announcement{Prefix: "192.0.2.2/32"}); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops(),
+		"link-add vip-web", "link-set-up vip-web", "addr-replace vip-web 192.0.2.1/32",
+		"link-add vip", "link-set-up vip", "addr-replace vip 192.0.2.2/32")
+
+	// moving a prefix to another group moves its address
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32", Group: "db"}, Announcement{Prefix: "192.0.2.2/32"}); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops(), "addr-del vip-web 192.0.2.1/32", "link-add vip-db", "link-set-up vip-db", "addr-replace vip-db 192.0.2.1/32")
+	expectOps(t, "speaker", sp.Ops(), "announce 192.0.2.1/32", "announce 192.0.2.2/32")
+
+	// invalid groups are rejected without touching anything
+	n.Ops()
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32", Group: "db"}, Announcement{Prefix: "192.0.2.3/32", Group: "no spaces"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := agent.Status().Prefixes["192.0.2.3/32"].Health; got != healthError {
+		t.Errorf("prefix in an invalid group has health %s, want %s", got, healthError)
+	}
+	expectOps(t, "network", n.Ops(), "addr-del vip 192.0.2.2/32")
+}
+
+func TestTeardown(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{VIPInterface: "vip", InterfacePerGroup: true}, sp, n)
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32", Group: "web"}, Announcement{Prefix: "192.0.2.2/32"}); err != nil {
+		t.Fatal(err)
+	}
+	n.Ops()
+
+	n.fail("link-del vip-web", errors.New("injected"))
+	if err := agent.VIPLinks.Teardown(); err == nil {
+		t.Error("teardown succeeded despite a failing delete")
+	}
+	if _, err := n.LinkByName("vip"); err == nil {
+		t.Error("vip wasn't deleted")
+	}
+
+	// what failed is retried
+	n.fail("link-del vip-web", nil)
+	n.Ops()
+	if err := agent.VIPLinks.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops(), "link-del vip-web")
+	if got := fmt.Sprint(n.placed("vip-web")); got != "[]" {
+		t.Errorf("addresses left behind: %s", got)
+	}
+}
+
+func TestTeardownLeavesExistingLinks(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	if err := n.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "vip"}}); err != nil {
+		t.Fatal(err)
+	}
+	agent := newTestAgent(Config{VIPInterface: "vip", InterfacePerGroup: true}, sp, n)
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32", Group: "web"}, Announcement{Prefix: "192.0.2.2/32"}); err != nil {
+		t.Fatal(err)
+	}
+	n.Ops()
+	if err := agent.VIPLinks.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops(), "link-del vip-web")
+
+	// what a previous run created is taken over from its state
+	links := newVIPLinks(n, "vip", true)
+	links.Adopt([]string{"vip", "vip-gone"})
+	if got := fmt.Sprint(links.Owned()); got != "[vip]" {
+		t.Errorf("adopted %s, want [vip]", got)
+	}
+}
+
+func TestGroupLinkSysctls(t *testing.T) {
+	root, err := ioutil.TempDir("", "packet-bgp-agent-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// what the kernel starts a new interface with
+	for _, name := range []string{"vip", "vip-web"} {
+		for _, s := range vipLinkSysctls(name) {
+			path := filepath.Join(root, "sys", filepath.FromSlash(s.Key))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte("0\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{VIPInterface: "vip", InterfacePerGroup: true}, sp, n)
+	agent.VIPLinks.procRoot = root
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32", Group: "web"}, Announcement{Prefix: "192.0.2.2/32"}); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(key string) string {
+		b, err := ioutil.ReadFile(filepath.Join(root, "sys", filepath.FromSlash(key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(b))
+	}
+	for _, s := range vipLinkSysctls("vip-web") {
+		if got := read(s.Key); got != s.Value {
+			t.Errorf("%s is %s, want %s", s.Key, got, s.Value)
+		}
+	}
+	// the base interface is left to the host's checks
+	if got := read("net/ipv4/conf/vip/arp_ignore"); got != "0" {
+		t.Errorf("base interface arp_ignore is %s, want it untouched", got)
+	}
+}
+
+func TestPrefixVIPsAreLocal(t *testing.T) {
+	for _, base := range []string{"lo", "vip"} {
+		n, sp := newFakeNetwork(), newFakeSpeaker(false)
+		agent := newTestAgent(Config{VIPInterface: base}, sp, n)
+		if err := desire(agent, Announcement{Prefix: "192.0.2.8/29"}, Announcement{Prefix: "2001:db8::/126"}); err != nil {
+			t.Fatal(err)
+		}
+		// the whole prefix is answered, not just the address placed for it
+		for _, ip := range []string{"192.0.2.8", "192.0.2.9", "192.0.2.15", "2001:db8::", "2001:db8::3"} {
+			if !n.local(ip) {
+				t.Errorf("%s of a prefix placed on %s isn't local", ip, base)
+			}
+		}
+		if n.local("192.0.2.16") {
+			t.Errorf("192.0.2.16 is local with 192.0.2.8/29 placed on %s", base)
+		}
+
+		if err := desire(agent); err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range []string{"192.0.2.9", "2001:db8::3"} {
+			if n.local(ip) {
+				t.Errorf("%s is still local after its prefix was removed from %s", ip, base)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	vipRemovedRestore  = "restore"
+	vipRemovedWithdraw = "withdraw"
+)
+
+// WatchLinks should be run as a go routine, follows the uplink and VIP addresses and withdraws or
+// re-announces prefixes as soon as they change instead of waiting for the BGP hold timer
+func (agent *PacketBGPAgent) WatchLinks(done chan bool) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	linkUpdates := make(chan netlink.LinkUpdate, 16)
+	if agent.Config.Uplink != "" {
+		if err := agent.Host.LinkSubscribe(linkUpdates, stop); err != nil {
+			log.Println(err)
+		}
+		agent.setUplinkState(uplinkState(agent.Host, agent.Config.Uplink))
+	}
+
+	addrUpdates := make(chan netlink.AddrUpdate, 16)
+	if err := agent.VIPLinks.AddrSubscribe(addrUpdates, stop); err != nil {
+		log.Println(err)
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case _, ok := <-linkUpdates:
+			if !ok {
+				log.Println("link subscription closed")
+				linkUpdates = nil
+				continue
+			}
+			agent.setUplinkState(uplinkState(agent.Host, agent.Config.Uplink))
+		case update, ok := <-addrUpdates:
+			if !ok {
+				log.Println("address subscription closed")
+				addrUpdates = nil
+				continue
+			}
+			agent.handleAddrUpdate(update)
+		}
+	}
+}
+
+// uplinkState reports whether name can carry traffic, a bond counts as down once all of its slaves are
+func uplinkState(host hostNetwork, name string) (bool, string) {
+	link, err := host.LinkByName(name)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return true, fmt.Sprintf("uplink %s not found, not tracking it", name)
+	} else if err != nil {
+		return true, fmt.Sprintf("can't check uplink %s: %s", name, err)
+	}
+
+	if !linkUp(link) {
+		return false, fmt.Sprintf("uplink %s is %s", name, link.Attrs().OperState)
+	}
+
+	links, err := host.LinkList()
+	if err != nil {
+		return true, fmt.Sprintf("can't list slaves of uplink %s: %s", name, err)
+	}
+	slaves, up := 0, 0
+	for _, l := range links {
+		if l.Attrs().MasterIndex != link.Attrs().Index {
+			continue
+		}
+		slaves++
+		if linkUp(l) {
+			up++
+		}
+	}
+	if slaves > 0 && up == 0 {
+		return false, fmt.Sprintf("all %d slaves of uplink %s are down", slaves, name)
+	}
+	return true, fmt.Sprintf("uplink %s is up, %d/%d slaves up", name, up, slaves)
+}
+
+// linkUp is false when a link is administratively down or has lost carrier. Devices that don't report
+// carrier (OperUnknown) count as up
+func linkUp(link netlink.Link) bool {
+	attrs := link.Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return false
+	}
+	switch attrs.OperState {
+	case netlink.OperDown, netlink.OperLowerLayerDown, netlink.OperNotPresent:
+		return false
+	}
+	return true
+}
+
+func (agent *PacketBGPAgent) setUplinkState(up bool, reason string) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	if up == agent.uplinkUp {
+		return
+	}
+	agent.uplinkUp = up
+	if up {
+		log.Println("re-announcing:", reason)
+	} else {
+		log.Println("withdrawing all prefixes:", reason)
+	}
+
+	if err := agent.ensureBGP(); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleAddrUpdate restores or withdraws a VIP someone else removed from its interface, and re-announces
+// a withdrawn one once it's put back
+func (agent *PacketBGPAgent) handleAddrUpdate(update netlink.AddrUpdate) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	prefix := update.LinkAddress.String()
+
+	if update.NewAddr {
+		if _, held := agent.held[prefix]; !held {
+			return
+		}
+		log.Println("VIP", prefix, "is back, re-announcing")
+		delete(agent.held, prefix)
+		if err := agent.ensureBGP(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	ann, ok := agent.announcementTable[prefix]
+	if !ok {
+		return
+	}
+	if link, err := agent.VIPLinks.LinkName(update.LinkIndex); err != nil || link != ann.link {
+		return
+	}
+
+	if agent.Config.DryRun {
+		log.Println("dry run, VIP", prefix, "was removed from", ann.link, "would", agent.Config.VIPRemovedPolicy)
+		return
+	}
+
+	switch agent.Config.VIPRemovedPolicy {
+	case vipRemovedWithdraw:
+		log.Println("VIP", prefix, "was removed from", ann.link, "withdrawing it")
+		agent.held[prefix] = "address removed from " + ann.link
+		if err := agent.applyChange(planChange{Action: actionWithdraw, Prefix: prefix}); err != nil {
+			log.Println(err)
+		}
+		agent.saveState()
+	default:
+		log.Println("VIP", prefix, "was removed from", ann.link, "restoring it")
+		if err := agent.VIPLinks.AddAddr(ann.link, &update.LinkAddress); err != nil {
+			log.Println(err)
+		}
+	}
+}
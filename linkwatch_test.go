@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUplinkDownWithdrawsEverything(t *testing.T) {
+	n, sp := newFakeNetwork("bond0"), newFakeSpeaker(false)
+	agent := newTestAgent(Config{Uplink: "bond0"}, sp, n)
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}, Announcement{Prefix: "198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	n.Ops()
+	sp.Ops()
+
+	done := make(chan bool)
+	defer close(done)
+	go agent.WatchLinks(done)
+
+	n.setLinkUp("bond0", false)
+	eventually(t, "withdrawal", func() bool { return len(sp.announced()) == 0 })
+	// addresses stay, traffic already on its way is still answered
+	expectOps(t, "network", n.Ops())
+	if got, want := agent.Status().Prefixes["192.0.2.1/32"].Reason, "uplink down"; got != want {
+		t.Errorf("withdrawn prefix has reason %q, want %q", got, want)
+	}
+
+	n.setLinkUp("bond0", true)
+	eventually(t, "re-announcement", func() bool { return len(sp.announced()) == 2 })
+}
+
+func TestVIPRemovedPolicy(t *testing.T) {
+	for _, policy := range []string{vipRemovedRestore, vipRemovedWithdraw} {
+		t.Run(policy, func(t *testing.T) {
+			n, sp := newFakeNetwork(), newFakeSpeaker(false)
+			agent := newTestAgent(Config{VIPRemovedPolicy: policy}, sp, n)
+			if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan bool)
+			defer close(done)
+			go agent.WatchLinks(done)
+			eventually(t, "subscription", func() bool {
+				n.mu.Lock()
+				defer n.mu.Unlock()
+				return len(n.addrSubs) > 0
+			})
+			n.Ops()
+
+			n.removeAddr("lo", "192.0.2.1/32")
+			switch policy {
+			case vipRemovedRestore:
+				eventually(t, "address restored", func() bool { return fmt.Sprint(n.placed("lo")) == "[192.0.2.1/32]" })
+				if got := sp.announced(); len(got) != 1 {
+					t.Errorf("announced %v while restoring", got)
+				}
+			case vipRemovedWithdraw:
+				eventually(t, "withdrawal", func() bool { return len(sp.announced()) == 0 })
+				expectOps(t, "network", n.Ops())
+
+				// putting it back re-announces it
+				n.AddrReplace(n.links["lo"], mustParseAddr(t, "192.0.2.1/32"))
+				eventually(t, "re-announcement", func() bool { return len(sp.announced()) == 1 })
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// load levels, each one de-prefers the agent's prefixes further than the one before
+const (
+	loadNormal = iota
+	loadPrepend
+	loadMED
+	loadWithdraw
+)
+
+var loadLevels = []string{"normal", "prepend", "med", "withdraw"}
+
+func loadLevelIndex(name string) int {
+	for i, level := range loadLevels {
+		if level == name {
+			return i
+		}
+	}
+	return loadNormal
+}
+
+// loadReading is the last value read from a load signal
+type loadReading struct {
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// loadSignal is one measure of how busy the host is, overloaded once it reaches threshold
+type loadSignal struct {
+	name      string
+	threshold float64
+	read      func() (float64, error)
+}
+
+// loadController reads host load signals and decides how far the agent's prefixes are de-preferred. It
+// moves one level at a time and no more often than every hold, up while any signal is at its threshold
+// and down once all of them are below recover times theirs
+type loadController struct {
+	signals []loadSignal
+	recover float64
+	hold    time.Duration
+	changed time.Time
+}
+
+// newLoadController returns nil when no signal is configured
+func newLoadController(host hostNetwork, cfg Config) (*loadController, error) {
+	c := &loadController{
+		recover: float64(cfg.LoadRecover) / 100,
+		hold:    cfg.LoadHold,
+	}
+	if cfg.LoadCPU > 0 {
+		cpu := &cpuSampler{procRoot: cfg.ProcRoot}
+		c.signals = append(c.signals, loadSignal{name: "cpu", threshold: float64(cfg.LoadCPU), read: cpu.Read})
+	}
+	if cfg.LoadBandwidth > 0 {
+		if cfg.LoadInterface == "" {
+			return nil, fmt.Errorf("a bandwidth threshold needs an interface to measure")
+		}
+		rate := &linkRate{host: host, name: cfg.LoadInterface}
+		c.signals = append(c.signals, loadSignal{name: "bandwidth", threshold: float64(cfg.LoadBandwidth), read: rate.Read})
+	}
+	if cfg.LoadConnections > 0 {
+		if cfg.LoadConnectionsScript == "" {
+			return nil, fmt.Errorf("a connection threshold needs a script to count them")
+		}
+		script := cfg.LoadConnectionsScript
+		c.signals = append(c.signals, loadSignal{name: "connections", threshold: float64(cfg.LoadConnections), read: func() (float64, error) {
+			return runLoadScript(script)
+		}})
+	}
+	if len(c.signals) == 0 {
+		return nil, nil
+	}
+	if c.recover <= 0 || c.recover >= 1 {
+		return nil, fmt.Errorf("load recovery must be between 0 and 100%% of the thresholds, not %d%%", cfg.LoadRecover)
+	}
+	return c, nil
+}
+
+// Sample reads every signal and returns the readings along with the highest fraction of its threshold any
+// signal reached. A signal that can't be read is left out
+func (c *loadController) Sample() (map[string]loadReading, float64) {
+	readings := make(map[string]loadReading)
+	load := 0.0
+	for _, s := range c.signals {
+		reading := loadReading{Threshold: s.threshold}
+		v, err := s.read()
+		if err != nil {
+			log.Println("can't read load signal", s.name+":", err)
+			reading.Error = err.Error()
+		} else {
+			reading.Value = v
+			if v/s.threshold > load {
+				load = v / s.threshold
+			}
+		}
+		readings[s.name] = reading
+	}
+	return readings, load
+}
+
+// Next returns the level following level at the given load
+func (c *loadController) Next(level int, load float64, now time.Time) int {
+	if now.Sub(c.changed) < c.hold {
+		return level
+	}
+	next := level
+	if load >= 1 && level < loadWithdraw {
+		next++
+	} else if load < c.recover && level > loadNormal {
+		next--
+	}
+	if next != level {
+		c.changed = now
+	}
+	return next
+}
+
+// cpuSampler measures the share of CPU time spent busy since the last read, in percent
+type cpuSampler struct {
+	procRoot    string
+	busy, total uint64
+}
+
+func (s *cpuSampler) Read() (float64, error) {
+	f, err := os.Open(filepath.Join(s.procRoot, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, fmt.Errorf("%s is empty", f.Name())
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("unexpected first line in %s: %q", f.Name(), scanner.Text())
+	}
+
+	// user nice system idle iowait irq softirq steal, guest time is counted in user already
+	var busy, total uint64
+	for i, field := range fields[1:] {
+		if i >= 8 {
+			break
+		}
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += v
+		if i != 3 && i != 4 {
+			busy += v
+		}
+	}
+
+	var usage float64
+	if s.total > 0 && total > s.total { // the first read has nothing to compare with
+		usage = 100 * float64(busy-s.busy) / float64(total-s.total)
+	}
+	s.busy, s.total = busy, total
+	return usage, nil
+}
+
+// linkRate measures the traffic on a link since the last read, in Mbit/s in whichever direction is busier
+type linkRate struct {
+	host   hostNetwork
+	name   string
+	rx, tx uint64
+	last   time.Time
+}
+
+func (r *linkRate) Read() (float64, error) {
+	link, err := r.host.LinkByName(r.name)
+	if err != nil {
+		return 0, err
+	}
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return 0, fmt.Errorf("no statistics for %s", r.name)
+	}
+
+	now := time.Now()
+	var rate float64
+	if !r.last.IsZero() && stats.RxBytes >= r.rx && stats.TxBytes >= r.tx {
+		bytes := stats.RxBytes - r.rx
+		if stats.TxBytes-r.tx > bytes {
+			bytes = stats.TxBytes - r.tx
+		}
+		rate = float64(bytes) * 8 / 1e6 / now.Sub(r.last).Seconds()
+	}
+	r.rx, r.tx, r.last = stats.RxBytes, stats.TxBytes, now
+	return rate, nil
+}
+
+// runLoadScript runs script, a command and its arguments, which prints a number like the count of open
+// connections
+func runLoadScript(script string) (float64, error) {
+	args := strings.Fields(script)
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", script, err)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s printed %q, not a number", script, strings.TrimSpace(string(out)))
+	}
+	return v, nil
+}
+
+// setLoadLevel switches to a load level and reports whether that's a change. agent.mu must be held
+func (agent *PacketBGPAgent) setLoadLevel(level int) bool {
+	if level == agent.loadLevel {
+		return false
+	}
+	log.Println("load level changed from", loadLevels[agent.loadLevel], "to", loadLevels[level])
+	agent.loadLevel = level
+	return true
+}
+
+// shedding de-prefers a route as far as the load level asks. agent.mu must be held
+func (agent *PacketBGPAgent) shedding(r *route) *route {
+	if agent.loadLevel >= loadPrepend {
+		r.Prepend += agent.Config.LoadPrepend
+	}
+	if agent.loadLevel >= loadMED {
+		r.MED += agent.Config.LoadMED
+	}
+	return r
+}
+
+// WatchLoad should be run as a go routine, samples the load signals every LoadInterval and reconciles
+// when the load level changes, until done is closed
+func (agent *PacketBGPAgent) WatchLoad(done chan bool) {
+	ticker := time.NewTicker(agent.Config.LoadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			readings, load := agent.Load.Sample()
+
+			agent.mu.Lock()
+			agent.loadReadings = readings
+			if agent.setLoadLevel(agent.Load.Next(agent.loadLevel, load, time.Now())) {
+				if err := agent.ensureBGP(); err != nil {
+					log.Println(err)
+				}
+			}
+			agent.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestLoadController(t *testing.T) {
+	c := &loadController{recover: 0.8, hold: time.Minute}
+	now := time.Now()
+	level := loadNormal
+	for _, step := range []struct {
+		after time.Duration
+		load  float64
+		want  int
+	}{
+		{0, 0.5, loadNormal},
+		{0, 1.2, loadPrepend},
+		{30 * time.Second, 1.5, loadPrepend}, // held
+		{time.Minute, 1.5, loadMED},
+		{time.Minute, 1, loadWithdraw},
+		{time.Minute, 2, loadWithdraw},
+		{time.Minute, 0.9, loadWithdraw}, // not low enough to recover
+		{time.Minute, 0.7, loadMED},
+		{10 * time.Second, 0.1, loadMED},
+		{time.Minute, 0.1, loadPrepend},
+		{time.Minute, 0.1, loadNormal},
+	} {
+		now = now.Add(step.after)
+		if level = c.Next(level, step.load, now); level != step.want {
+			t.Fatalf("at load %g after %s went to %s, want %s", step.load, step.after, loadLevels[level], loadLevels[step.want])
+		}
+	}
+}
+
+func TestLoadSignals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stat := func(line string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(line+"\ncpu0 0 0 0 0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cpu := &cpuSampler{procRoot: dir}
+	stat("cpu  100 0 100 700 100 0 0 0 0 0")
+	if v, err := cpu.Read(); err != nil || v != 0 {
+		t.Errorf("first CPU read got %g, %v, want 0", v, err)
+	}
+	// 150 of 200 ticks busy
+	stat("cpu  200 0 150 740 110 0 0 0 0 0")
+	if v, err := cpu.Read(); err != nil || v != 75 {
+		t.Errorf("CPU read got %g, %v, want 75", v, err)
+	}
+
+	n := newFakeNetwork("bond0")
+	stats := &netlink.LinkStatistics{RxBytes: 1e9, TxBytes: 1e9}
+	n.links["bond0"].Attrs().Statistics = stats
+	rate := &linkRate{host: n, name: "bond0"}
+	if _, err := rate.Read(); err != nil {
+		t.Fatal(err)
+	}
+	stats.RxBytes += 125e6 // 1000 Mbit
+	stats.TxBytes += 25e6
+	rate.last = time.Now().Add(-2 * time.Second)
+	if v, err := rate.Read(); err != nil || v < 499 || v > 501 {
+		t.Errorf("link rate got %g, %v, want about 500 Mbit/s", v, err)
+	}
+
+	if v, err := runLoadScript("echo 42"); err != nil || v != 42 {
+		t.Errorf("script got %g, %v, want 42", v, err)
+	}
+	if _, err := runLoadScript("echo many"); err == nil {
+		t.Error("script printing a word was accepted")
+	}
+}
+
+func TestShedding(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{LoadPrepend: 3, LoadMED: 1000}, sp, n)
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}); err != nil {
+		t.Fatal(err)
+	}
+	sp.Ops()
+
+	shed := func(level int) {
+		agent.mu.Lock()
+		agent.setLoadLevel(level)
+		agent.mu.Unlock()
+		if err := agent.EnsureBGP(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shed(loadPrepend)
+	if r := sp.routes["192.0.2.1/32"]; r.Prepend != 3 || r.MED != 0 {
+		t.Errorf("route under load is %+v, want 3 prepends", r)
+	}
+	shed(loadMED)
+	if r := sp.routes["192.0.2.1/32"]; r.Prepend != 3 || r.MED != 1000 {
+		t.Errorf("route under more load is %+v, want 3 prepends and MED 1000", r)
+	}
+	sp.Ops()
+
+	shed(loadWithdraw)
+	expectOps(t, "speaker", sp.Ops(), "withdraw 192.0.2.1/32")
+	if status := agent.Status().Prefixes["192.0.2.1/32"]; status.Reason != "shed under load" {
+		t.Errorf("shed prefix has reason %q", status.Reason)
+	}
+	if got := n.placed("lo"); len(got) != 1 {
+		t.Errorf("shedding removed the address: %v", got)
+	}
+
+	shed(loadNormal)
+	if r := sp.routes["192.0.2.1/32"]; r == nil || r.Prepend != 0 || r.MED != 0 {
+		t.Errorf("route after recovering is %+v", r)
+	}
+}
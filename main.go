@@ -1,31 +1,164 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
-
-	gobgpApi "github.com/osrg/gobgp/api"
-	gobgpServer "github.com/osrg/gobgp/server"
 )
 
 var (
-	md5Password = os.Getenv("MD5_PASSWORD")
-	asn         = os.Getenv("ASN")
+	md5Password    string
+	asn            string
+	procRoot       string
+	uplink         string
+	enforceSysctls bool
+	vipInterface   string
+	perGroupLinks  bool
+	vipNetns       string
+	bgpNetns       string
+	vipRemoved     string
+	importTable    int
+	importPrefixes string
+	stateFile      string
+	dryRun         bool
+	controlAddr    string
+	grpcAddr       string
+	speakerName    string
+	vtysh          string
+	birdConfig     string
+	birdc          string
+	bmpList        string
+	bmpStations    []bmpStation
+	bmpDefaults    bmpStation
+	mrtUpdates     string
+	mrtTable       string
+	mrtRotation    time.Duration
+	mrtTableEvery  time.Duration
+	mrtRetention   time.Duration
+	mrtMaxFiles    int
+	rpkiCaches     string
+	rpkiPolicy     string
+	packetAPI      string
+	packetToken    string
+	reportInterval time.Duration
+	hegelAddr      string
+	hegelInsecure  bool
+	metadataURL    string
+	drainPolicy    string
+	drainPrepends  int
+	profileList    string
+	profiles       map[string]announceProfile
+	facilityList   string
+	facilities     map[string]string
+	profile        string
+	loadCPU        int
+	loadBandwidth  int
+	loadInterface  string
+	loadConns      int
+	loadScript     string
+	loadInterval   time.Duration
+	loadRecover    int
+	loadHold       time.Duration
+	loadPrepends   int
+	loadAddedMED   int
+	mitigateAllow  string
+	mitigateFor    time.Duration
+	mitigateMax    time.Duration
+	mitigateAudit  string
+	addPaths       int
+	meshDiscovery  string
+	meshPeers      string
+	meshTag        string
+	meshKV         string
+	meshKVPrefix   string
+	meshPort       int
+	meshInterval   time.Duration
+	meshMin        int
+	meshMax        int
+	scheduleJSON   string
+	schedules      []schedule
 )
 
 var (
 	tag = "unknown" // set with -ldflags
 )
 
-func init() {
+// parseFlags reads the command line, kept out of init so tests can run without it
+func parseFlags() {
 	var printVersion bool
-	flag.StringVar(&md5Password, "md5", "", "Specify MD5 password to announce with")
-	flag.StringVar(&asn, "asn", "65000", "ASN to announce with")
+	flag.StringVar(&md5Password, "md5", os.Getenv("MD5_PASSWORD"), "Specify MD5 password to announce with")
+	flag.StringVar(&asn, "asn", envOrDefault("ASN", "65000"), "ASN to announce with")
+	flag.StringVar(&procRoot, "proc-root", envOrDefault("PROC_ROOT", "/proc"), "where procfs is mounted, for checking sysctls")
+	flag.StringVar(&uplink, "uplink", envOrDefault("UPLINK", "bond0"), "uplink interface that carries BGP traffic")
+	flag.BoolVar(&enforceSysctls, "enforce-sysctls", envBool("ENFORCE_SYSCTLS"), "correct sysctl drift instead of only reporting it, restored on exit")
+	flag.StringVar(&vipInterface, "vip-interface", envOrDefault("VIP_INTERFACE", "lo"), "interface to place announced addresses on, anything but lo is created as a dummy interface and removed on exit")
+	flag.BoolVar(&perGroupLinks, "vip-interface-per-group", envBool("VIP_INTERFACE_PER_GROUP"), "place each VIP group on its own <vip-interface>-<group> dummy interface")
+	flag.StringVar(&vipNetns, "vip-netns", os.Getenv("VIP_NETNS"), "network namespace (name or path) to place announced addresses in")
+	flag.StringVar(&bgpNetns, "bgp-netns", os.Getenv("BGP_NETNS"), "network namespace (name or path) to run the BGP speaker in")
+	flag.StringVar(&vipRemoved, "vip-removed-policy", envOrDefault("VIP_REMOVED_POLICY", vipRemovedRestore), "what to do when a VIP is removed from its interface by someone else, restore or withdraw")
+	flag.IntVar(&importTable, "import-table", envInt("IMPORT_TABLE", 0), "kernel routing table to install routes received from the Packet routers in, 0 disables route import")
+	flag.StringVar(&importPrefixes, "import-prefixes", envOrDefault("IMPORT_PREFIXES", "0.0.0.0/0,::/0"), "comma separated received prefixes to import, each optionally followed by a masklength range like \"10.0.0.0/8 16..24\"")
+	flag.StringVar(&stateFile, "state-file", envOrDefault("STATE_FILE", "/var/lib/packet-bgp-agent/state.json"), "file to persist announcement state in across restarts, empty disables it")
+	flag.BoolVar(&dryRun, "dry-run", envBool("DRY_RUN"), "plan and log every change without touching BGP or the VIP interfaces")
+	flag.StringVar(&controlAddr, "control-addr", envOrDefault("CONTROL_ADDR", "127.0.0.1:50052"), "address to serve the status and control API on, empty disables it")
+	flag.StringVar(&grpcAddr, "grpc-addr", envOrDefault("GRPC_ADDR", ":50051"), "address to serve the gobgp gRPC API on")
+	flag.IntVar(&addPaths, "add-paths", envInt("ADD_PATHS", 0), "most paths per prefix the embedded gobgp sends with ADD-PATH, so a prefix can have several next hops, 0 disables ADD-PATH")
+	flag.StringVar(&speakerName, "speaker", envOrDefault("SPEAKER", speakerGobgp), "BGP speaker to announce through: gobgp (embedded), frr or bird")
+	flag.StringVar(&vtysh, "vtysh", envOrDefault("VTYSH", "vtysh"), "vtysh binary used to configure FRR")
+	flag.StringVar(&birdConfig, "bird-config", envOrDefault("BIRD_CONFIG", "/etc/bird/packet-bgp-agent.conf"), "BIRD config include to render, must be included from bird.conf")
+	flag.StringVar(&birdc, "birdc", envOrDefault("BIRDC", "birdc"), "birdc binary used to reload BIRD and read its session state")
+	flag.StringVar(&bmpList, "bmp-stations", os.Getenv("BMP_STATIONS"), "comma separated BMP collectors to export to, each \"host:port[ policy[ stats-interval]]\"")
+	flag.StringVar(&bmpDefaults.Policy, "bmp-policy", envOrDefault("BMP_POLICY", bmpPrePolicy), "default BMP route monitoring policy: pre-policy, post-policy or all")
+	flag.IntVar(&bmpDefaults.StatsInterval, "bmp-stats-interval", envInt("BMP_STATS_INTERVAL", 60), "default seconds between BMP statistics reports, 0 disables them")
+	flag.StringVar(&mrtUpdates, "mrt-updates", os.Getenv("MRT_UPDATES"), "strftime style file pattern to dump BGP updates to in MRT format, e.g. /var/lib/mrt/updates.%Y%m%d.%H%M, empty disables it")
+	flag.StringVar(&mrtTable, "mrt-table", os.Getenv("MRT_TABLE"), "strftime style file pattern to dump RIB snapshots to in MRT format, empty disables it")
+	flag.DurationVar(&mrtRotation, "mrt-rotation", envDuration("MRT_ROTATION", time.Hour), "how often to start a new MRT update file, at least 1m")
+	flag.DurationVar(&mrtTableEvery, "mrt-table-interval", envDuration("MRT_TABLE_INTERVAL", time.Hour), "how often to take a RIB snapshot, at least 1m")
+	flag.DurationVar(&mrtRetention, "mrt-retention", envDuration("MRT_RETENTION", 7*24*time.Hour), "how long to keep MRT dumps, 0 keeps them forever")
+	flag.IntVar(&mrtMaxFiles, "mrt-max-files", envInt("MRT_MAX_FILES", 0), "how many files of each MRT dump to keep at most, 0 means no limit")
+	flag.StringVar(&rpkiCaches, "rpki-caches", os.Getenv("RPKI_CACHES"), "comma separated RTR caches (host:port) to validate announced prefixes against, empty disables validation")
+	flag.StringVar(&rpkiPolicy, "rpki-policy", envOrDefault("RPKI_POLICY", rpkiPolicyFlag), "what to do with prefixes that don't validate: flag, withhold-invalid or withhold")
+	flag.StringVar(&packetAPI, "packet-api", envOrDefault("PACKET_API_URL", "https://api.packet.net"), "Packet API endpoint BGP_STATUS is written to")
+	flag.StringVar(&packetToken, "packet-token", os.Getenv("PACKET_AUTH_TOKEN"), "Packet API token, writes BGP_STATUS back to the device's customdata when set")
+	flag.DurationVar(&reportInterval, "report-interval", envDuration("REPORT_INTERVAL", 30*time.Second), "minimum time between BGP_STATUS updates")
+	flag.StringVar(&hegelAddr, "hegel-addr", envOrDefault("HEGEL_ADDR", "metadata.packet.net:50060"), "hegel gRPC endpoint metadata is watched on")
+	flag.BoolVar(&hegelInsecure, "hegel-insecure", envBool("HEGEL_INSECURE"), "talk plaintext gRPC to hegel, e.g. to a fake-metadata server")
+	flag.StringVar(&metadataURL, "metadata-url", envOrDefault("METADATA_URL", "https://metadata.packet.net"), "metadata service the device document is read from")
+	flag.StringVar(&drainPolicy, "drain-policy", envOrDefault("DRAIN_POLICY", drainGracefulShutdown), "what draining does to every prefix unless metadata names a policy: graceful-shutdown, prepend or withdraw")
+	flag.IntVar(&drainPrepends, "drain-prepend", envInt("DRAIN_PREPEND", 3), "how often the prepend drain policy prepends the agent's ASN")
+	flag.StringVar(&profileList, "profiles", envOrDefault("PROFILES", defaultProfiles), "comma separated announcement profiles, each \"name prepend med [community ...]\"")
+	flag.StringVar(&facilityList, "facility-profiles", os.Getenv("FACILITY_PROFILES"), "comma separated profiles by facility, e.g. \"ewr1=primary,sjc1=secondary\"")
+	flag.StringVar(&profile, "profile", envOrDefault("PROFILE", profilePrimary), "announcement profile unless metadata or the facility picks another one")
+	flag.IntVar(&loadCPU, "load-cpu", envInt("LOAD_CPU", 0), "percent of CPU time busy at which prefixes are de-preferred, 0 disables the signal")
+	flag.IntVar(&loadBandwidth, "load-bandwidth", envInt("LOAD_BANDWIDTH", 0), "Mbit/s on --load-interface, in either direction, at which prefixes are de-preferred, 0 disables the signal")
+	flag.StringVar(&loadInterface, "load-interface", envOrDefault("LOAD_INTERFACE", "bond0"), "interface whose traffic --load-bandwidth applies to")
+	flag.IntVar(&loadConns, "load-connections", envInt("LOAD_CONNECTIONS", 0), "connection count, as printed by --load-connections-script, at which prefixes are de-preferred, 0 disables the signal")
+	flag.StringVar(&loadScript, "load-connections-script", os.Getenv("LOAD_CONNECTIONS_SCRIPT"), "command printing the number of connections the host is serving")
+	flag.DurationVar(&loadInterval, "load-interval", envDuration("LOAD_INTERVAL", 10*time.Second), "how often the load signals are read")
+	flag.IntVar(&loadRecover, "load-recover", envInt("LOAD_RECOVER", 80), "percent of its threshold every load signal must be below before prefixes are preferred again")
+	flag.DurationVar(&loadHold, "load-hold", envDuration("LOAD_HOLD", time.Minute), "least time between two steps of de-preferring or preferring prefixes again")
+	flag.IntVar(&loadPrepends, "load-prepend", envInt("LOAD_PREPEND", 3), "how often the agent's ASN is prepended under load")
+	flag.IntVar(&loadAddedMED, "load-med", envInt("LOAD_MED", 1000), "MED added once prepending isn't enough")
+	flag.StringVar(&mitigateAllow, "mitigation-allowlist", os.Getenv("MITIGATION_ALLOWLIST"), "comma separated prefixes that may be blackholed or have FlowSpec rules announced, empty disables mitigation")
+	flag.DurationVar(&mitigateFor, "mitigation-duration", envDuration("MITIGATION_DURATION", time.Hour), "how long a mitigation lasts unless the request says otherwise")
+	flag.DurationVar(&mitigateMax, "mitigation-max-duration", envDuration("MITIGATION_MAX_DURATION", 24*time.Hour), "longest a mitigation may last")
+	flag.StringVar(&mitigateAudit, "mitigation-audit-log", envOrDefault("MITIGATION_AUDIT_LOG", "/var/lib/packet-bgp-agent/mitigations.log"), "file every change to the mitigations is appended to, empty only logs them")
+	flag.StringVar(&meshDiscovery, "mesh-discovery", os.Getenv("MESH_DISCOVERY"), "how to find the other agents to peer with over iBGP: static, tag or kv, empty disables the mesh unless --mesh-peers or --mesh-tag is set")
+	flag.StringVar(&meshPeers, "mesh-peers", os.Getenv("MESH_PEERS"), "comma separated private addresses of the other agents, each optionally preceded by a device ID and =, for static discovery")
+	flag.StringVar(&meshTag, "mesh-tag", os.Getenv("MESH_TAG"), "peer with the agents on the project's devices that have this tag, for tag discovery, needs --packet-token")
+	flag.StringVar(&meshKV, "mesh-kv", os.Getenv("MESH_KV"), "URL of the KV store agents register in, for kv discovery")
+	flag.StringVar(&meshKVPrefix, "mesh-kv-prefix", envOrDefault("MESH_KV_PREFIX", "packet-bgp-agent/mesh"), "key prefix agents register under in the KV store")
+	flag.IntVar(&meshPort, "mesh-port", envInt("MESH_PORT", 179), "port mesh peers connect to on the private network")
+	flag.DurationVar(&meshInterval, "mesh-interval", envDuration("MESH_INTERVAL", time.Minute), "how often to look up the tagged mesh peers")
+	flag.IntVar(&meshMin, "mesh-min-announcers", envInt("MESH_MIN_ANNOUNCERS", 0), "hold back a prefix unless at least this many agents of the mesh can announce it, 0 disables the rule")
+	flag.IntVar(&meshMax, "mesh-max-announcers", envInt("MESH_MAX_ANNOUNCERS", 0), "most agents of the mesh announcing a prefix at once, picked by rendezvous hashing on device ID, 0 disables the rule")
+	flag.StringVar(&scheduleJSON, "schedule", os.Getenv("SCHEDULE"), "JSON schedule object, or list of them, withholding every prefix outside or inside its windows, unless metadata sets BGP_SCHEDULE")
 	flag.BoolVar(&printVersion, "version", false, "print the current version")
 	flag.Parse()
 
@@ -33,32 +166,229 @@ func init() {
 		fmt.Println(tag)
 		os.Exit(0)
 	}
+
+	stations := make([]interface{}, 0)
+	for _, station := range splitList(bmpList) {
+		stations = append(stations, station)
+	}
+	var err error
+	if bmpStations, err = parseBMPStations(stations, bmpDefaults); err != nil {
+		log.Fatal(err)
+	}
+
+	if vipRemoved != vipRemovedRestore && vipRemoved != vipRemovedWithdraw {
+		log.Fatalf("invalid --vip-removed-policy %q, must be %s or %s", vipRemoved, vipRemovedRestore, vipRemovedWithdraw)
+	}
+	if profiles, err = parseProfiles(splitList(profileList)); err != nil {
+		log.Fatal(err)
+	}
+	if facilities, err = parseFacilityProfiles(splitList(facilityList)); err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := profiles[profile]; !ok {
+		log.Fatalf("invalid --profile %q, must be one of %s", profile, strings.Join(profileNames(profiles), ", "))
+	}
+	if loadInterval <= 0 {
+		log.Fatalf("invalid --load-interval %s, must be positive", loadInterval)
+	}
+	if loadAddedMED < 0 {
+		log.Fatalf("invalid --load-med %d, must not be negative", loadAddedMED)
+	}
+	if addPaths < 0 || addPaths > 255 {
+		log.Fatalf("invalid --add-paths %d, must be between 0 and 255", addPaths)
+	}
+	if scheduleJSON != "" {
+		var v interface{}
+		if err := json.Unmarshal([]byte(scheduleJSON), &v); err != nil {
+			log.Fatalf("invalid --schedule: %s", err)
+		}
+		if schedules, err = parseSchedules(v); err != nil {
+			log.Fatalf("invalid --schedule: %s", err)
+		}
+	}
+	if meshDiscovery == "" && meshTag != "" {
+		meshDiscovery = discoveryTag
+	} else if meshDiscovery == "" && meshPeers != "" {
+		meshDiscovery = discoveryStatic
+	}
+	if meshPort <= 0 || meshPort > 65535 {
+		log.Fatalf("invalid --mesh-port %d", meshPort)
+	}
+	if meshInterval <= 0 {
+		log.Fatalf("invalid --mesh-interval %s, must be positive", meshInterval)
+	}
+	if meshMin < 0 || meshMax < 0 {
+		log.Fatalf("invalid --mesh-min-announcers %d or --mesh-max-announcers %d, must not be negative", meshMin, meshMax)
+	}
+	if mitigateFor <= 0 || mitigateFor > mitigateMax {
+		log.Fatalf("invalid --mitigation-duration %s, must be positive and at most --mitigation-max-duration", mitigateFor)
+	}
+	if !validDrainPolicy(drainPolicy) {
+		log.Fatalf("invalid --drain-policy %q, must be %s, %s or %s", drainPolicy, drainGracefulShutdown, drainPrepend, drainWithdraw)
+	}
 }
 
 func main() {
-	s := gobgpServer.NewBgpServer()
-	go s.Serve()
+	parseFlags()
+
+	if err := enterNetns(bgpNetns); err != nil {
+		log.Fatal(err)
+	}
 
-	g := gobgpApi.NewGrpcServer(s, ":50051")
-	go g.Serve()
+	cfg := Config{
+		MD5Password:           md5Password,
+		ASN:                   asn,
+		VIPInterface:          vipInterface,
+		InterfacePerGroup:     perGroupLinks,
+		VIPNetns:              vipNetns,
+		Uplink:                uplink,
+		VIPRemovedPolicy:      vipRemoved,
+		ImportTable:           importTable,
+		ImportPrefixes:        splitList(importPrefixes),
+		StateFile:             stateFile,
+		DryRun:                dryRun,
+		Speaker:               speakerName,
+		GRPCAddr:              grpcAddr,
+		AddPaths:              addPaths,
+		Vtysh:                 vtysh,
+		BIRDConfig:            birdConfig,
+		Birdc:                 birdc,
+		BMPStations:           bmpStations,
+		BMPDefaults:           bmpDefaults,
+		ProcRoot:              procRoot,
+		MRTUpdates:            mrtUpdates,
+		MRTTable:              mrtTable,
+		MRTRotation:           mrtRotation,
+		MRTTableInterval:      mrtTableEvery,
+		MRTRetention:          mrtRetention,
+		MRTMaxFiles:           mrtMaxFiles,
+		RPKICaches:            splitList(rpkiCaches),
+		RPKIPolicy:            rpkiPolicy,
+		PacketAPI:             packetAPI,
+		PacketToken:           packetToken,
+		ReportInterval:        reportInterval,
+		Version:               tag,
+		HegelAddr:             hegelAddr,
+		HegelInsecure:         hegelInsecure,
+		MetadataURL:           metadataURL,
+		DrainPolicy:           drainPolicy,
+		DrainPrepend:          drainPrepends,
+		Profiles:              profiles,
+		FacilityProfiles:      facilities,
+		Profile:               profile,
+		LoadCPU:               loadCPU,
+		LoadBandwidth:         loadBandwidth,
+		LoadInterface:         loadInterface,
+		LoadConnections:       loadConns,
+		LoadConnectionsScript: loadScript,
+		LoadInterval:          loadInterval,
+		LoadRecover:           loadRecover,
+		LoadHold:              loadHold,
+		LoadPrepend:           loadPrepends,
+		LoadMED:               uint32(loadAddedMED),
+		MitigationAllowlist:   splitList(mitigateAllow),
+		MitigationDuration:    mitigateFor,
+		MitigationMaxDuration: mitigateMax,
+		MitigationAuditLog:    mitigateAudit,
+		MeshDiscovery:         meshDiscovery,
+		MeshPeers:             splitList(meshPeers),
+		MeshTag:               meshTag,
+		MeshKV:                meshKV,
+		MeshKVPrefix:          meshKVPrefix,
+		MeshPort:              meshPort,
+		MeshInterval:          meshInterval,
+		MeshMinAnnouncers:     meshMin,
+		MeshMaxAnnouncers:     meshMax,
+		Schedules:             schedules,
+	}
 
-	agent, err := NewPacketBGPAgent(s, g, md5Password, asn)
+	switch flag.Arg(0) {
+	case "plan":
+		if err := runPlan(cfg); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	case "rtr-cache":
+		log.Fatal(runRTRCache(flag.Args()[1:]))
+	case "fake-metadata":
+		log.Fatal(runFakeMetadata(flag.Args()[1:]))
+	case "kv-store":
+		log.Fatal(runKVStore(flag.Args()[1:]))
+	}
+
+	sp, err := newSpeaker(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	host, vipHost, err := newHostNetworks(vipNetns)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	agent, err := NewPacketBGPAgent(sp, host, vipHost, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sysctls := newSysctlManager(procRoot, vipNetns, requiredSysctls(vipInterface, []string{uplink}))
+	if err := sysctls.Ensure(enforceSysctls && !dryRun); err != nil {
+		log.Fatal(err)
+	}
+
 	log.Printf("started new bgp agent MD5=%s, ASN=%s \n", md5Password, asn)
 
-	quit := make(chan bool, 1)
+	if err := agent.RestoreState(); err != nil {
+		log.Println(err)
+	}
+
+	quit := make(chan bool)
+	go agent.WatchLinks(quit)
+	go agent.WatchConditions(quit)
+	if agent.Importer != nil && !dryRun {
+		go agent.Importer.Run(quit)
+	}
+	if agent.BMP != nil {
+		go agent.BMP.Run(quit)
+	}
+	if agent.MRT != nil {
+		go agent.MRT.Run(quit)
+	}
+	if agent.RPKI != nil {
+		go agent.WatchRPKI(quit)
+	}
+	if agent.Load != nil {
+		go agent.WatchLoad(quit)
+	}
+	if agent.Mitigations != nil {
+		go agent.WatchMitigations(quit)
+	}
+	if agent.Mesh != nil {
+		go agent.WatchMesh(quit)
+	}
+	go agent.WatchSchedules(quit)
+	if agent.Reporter != nil {
+		go agent.Reporter.Run(quit, agent.reportedStatus)
+	}
+	if controlAddr != "" {
+		go agent.ServeControl(controlAddr)
+	}
 	go agent.EnsureIPs(quit)
 
-	var gracefulStop = make(chan os.Signal)
+	var gracefulStop = make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
 
 	<-gracefulStop
 	log.Println("received stop signal, shutting down")
-	quit <- true
+	close(quit)
+	agent.Stop()
+	if err := sysctls.Restore(); err != nil {
+		log.Println(err)
+	}
+	if err := agent.VIPLinks.Teardown(); err != nil {
+		log.Println(err)
+	}
 	time.Sleep(1 * time.Second)
 	os.Exit(0)
 }
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+// what an agent publishes to the mesh about a prefix it's eligible to announce
+const (
+	meshAnnounced = "announced"
+	meshStandby   = "standby" // held back by its quorum, ready to take over
+)
+
+// the communities carrying the mesh state of a prefix
+var meshCommunities = map[string]string{
+	meshAnnounced: "64512:1",
+	meshStandby:   "64512:2",
+}
+
+// meshFamilies are the only families mesh sessions carry, so nothing is exchanged with the Packet router's
+// unicast routes and mesh paths never reach it
+var meshFamilies = []config.AfiSafiType{config.AFI_SAFI_TYPE_L3VPN_IPV4_UNICAST, config.AFI_SAFI_TYPE_L3VPN_IPV6_UNICAST}
+
+// mesh peers the agent over iBGP with the other agents of the fleet, on the private network. Every agent
+// publishes the prefixes it's eligible to announce as VPN paths, distinguished by its own address, with a
+// community telling whether it announces them, so each one sees who announces what
+type mesh struct {
+	server    *gobgpServer.BgpServer // nil when the mesh is only looked at
+	rib       ribReader
+	asn       uint32
+	self      member
+	byAddress bool // static peers may come without device IDs, so quorums rank every agent by its address
+	port      uint16
+	discovery discovery
+	peers     map[string]string // device IDs of the peers by address
+	paths     map[string][]byte // UUIDs of the published prefixes
+	states    map[string]string // published state of a prefix
+}
+
+// newMesh returns nil when no discovery backend is configured
+func newMesh(server *gobgpServer.BgpServer, asn uint32, self member, cfg Config) (*mesh, error) {
+	if cfg.MeshDiscovery == "" {
+		return nil, nil
+	}
+	if server == nil {
+		return nil, fmt.Errorf("the mesh needs the %s speaker", speakerGobgp)
+	}
+	d, err := newDiscovery(cfg, self)
+	if err != nil {
+		return nil, err
+	}
+	return &mesh{
+		server:    server,
+		rib:       serverRIB{server},
+		asn:       asn,
+		self:      self,
+		byAddress: cfg.MeshDiscovery == discoveryStatic,
+		port:      uint16(cfg.MeshPort),
+		discovery: d,
+		peers:     make(map[string]string),
+		paths:     make(map[string][]byte),
+		states:    make(map[string]string),
+	}, nil
+}
+
+// lookAtMesh returns a mesh that only reads from rib what the agents discovery finds publish, it neither
+// peers nor publishes, so it's only for a dry run. It's nil when no discovery backend is configured
+func lookAtMesh(rib ribReader, self member, cfg Config) (*mesh, error) {
+	if cfg.MeshDiscovery == "" {
+		return nil, nil
+	}
+	d, err := newDiscovery(cfg, self)
+	if err != nil {
+		return nil, err
+	}
+	m := &mesh{
+		rib:       rib,
+		self:      self,
+		byAddress: cfg.MeshDiscovery == discoveryStatic,
+		discovery: d,
+		peers:     make(map[string]string),
+		paths:     make(map[string][]byte),
+		states:    make(map[string]string),
+	}
+	peers, err := m.Discover()
+	if err != nil {
+		log.Println("can't discover mesh peers:", err)
+	}
+	for _, peer := range peers {
+		m.peers[peer.Address] = peer.ID
+	}
+	return m, nil
+}
+
+// Discover returns the other agents discovery finds, sorted by address
+func (m *mesh) Discover() ([]member, error) {
+	members, err := m.discovery.Members()
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]member, 0, len(members))
+	seen := make(map[string]bool)
+	for _, peer := range members {
+		if peer.ID == m.self.ID || peer.Address == m.self.Address || seen[peer.Address] {
+			continue
+		}
+		seen[peer.Address] = true
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers, nil
+}
+
+// SetPeers peers with exactly the given agents
+func (m *mesh) SetPeers(peers []member) error {
+	want := make(map[string]bool)
+	for _, peer := range peers {
+		want[peer.Address] = true
+		if _, ok := m.peers[peer.Address]; !ok {
+			log.Println("adding mesh peer", peer.Address, "device", peer.ID)
+			if err := m.server.AddNeighbor(m.neighbor(peer.Address)); err != nil {
+				return err
+			}
+		}
+		m.peers[peer.Address] = peer.ID
+	}
+	for peer := range m.peers {
+		if want[peer] {
+			continue
+		}
+		log.Println("removing mesh peer", peer)
+		if err := m.server.DeleteNeighbor(m.neighbor(peer)); err != nil {
+			return err
+		}
+		delete(m.peers, peer)
+	}
+	return nil
+}
+
+func (m *mesh) neighbor(peer string) *config.Neighbor {
+	n := &config.Neighbor{
+		Config: config.NeighborConfig{
+			NeighborAddress: peer,
+			PeerAs:          m.asn,
+		},
+		Transport: config.Transport{
+			Config: config.TransportConfig{LocalAddress: m.self.Address, RemotePort: m.port},
+		},
+	}
+	for _, family := range meshFamilies {
+		n.AfiSafis = append(n.AfiSafis, config.AfiSafi{Config: config.AfiSafiConfig{AfiSafiName: family, Enabled: true}})
+	}
+	return n
+}
+
+// Sessions returns the session state of every mesh peer
+func (m *mesh) Sessions() map[string]string {
+	sessions := make(map[string]string)
+	for peer := range m.peers {
+		sessions[peer] = "unknown"
+		for _, n := range m.server.GetNeighbor(peer, false) {
+			sessions[peer] = string(n.State.SessionState)
+		}
+	}
+	return sessions
+}
+
+// View returns, for every prefix a peer publishes, each peer publishing it and its state
+func (m *mesh) View() map[string]map[string]string {
+	view := make(map[string]map[string]string)
+	for peer := range m.peers {
+		for _, family := range []bgp.RouteFamily{bgp.RF_IPv4_VPN, bgp.RF_IPv6_VPN} {
+			paths, err := m.rib.Received(peer, family, "")
+			if err != nil {
+				log.Println("can't read what mesh peer", peer, "publishes:", err)
+				continue
+			}
+			for _, path := range paths {
+				prefix, state := meshPublished(path)
+				if path.IsWithdraw || state == "" {
+					continue
+				}
+				if view[prefix] == nil {
+					view[prefix] = make(map[string]string)
+				}
+				view[prefix][peer] = state
+			}
+		}
+	}
+	return view
+}
+
+// meshPublished returns the prefix and state a mesh path carries, an empty state if it isn't one
+func meshPublished(path *table.Path) (string, string) {
+	var published string
+	switch nlri := path.GetNlri().(type) {
+	case *bgp.LabeledVPNIPAddrPrefix:
+		published = nlri.IPPrefix()
+	case *bgp.LabeledVPNIPv6AddrPrefix:
+		published = nlri.IPPrefix()
+	default:
+		return "", ""
+	}
+	_, ipnet, err := net.ParseCIDR(published)
+	if err != nil {
+		return "", ""
+	}
+	prefix := ipnet.String()
+
+	for _, c := range path.GetCommunities() {
+		for state, community := range meshCommunities {
+			if v, _ := parseCommunity(community); v == c {
+				return prefix, state
+			}
+		}
+	}
+	return prefix, ""
+}
+
+// Publish tells the peers the agent's state for prefix, empty when it isn't eligible to announce it
+func (m *mesh) Publish(prefix, state string) error {
+	if m.states[prefix] == state {
+		return nil
+	}
+	if state == "" {
+		if err := m.server.DeletePath(m.paths[prefix], 0, "", nil); err != nil {
+			return err
+		}
+		delete(m.paths, prefix)
+		delete(m.states, prefix)
+		return nil
+	}
+
+	path, err := m.path(prefix, state)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.paths[prefix]; ok {
+		if err := m.server.UpdatePath("", []*table.Path{path}); err != nil {
+			return err
+		}
+	} else {
+		uuid, err := m.server.AddPath("", []*table.Path{path})
+		if err != nil {
+			return err
+		}
+		m.paths[prefix] = uuid
+	}
+	m.states[prefix] = state
+	return nil
+}
+
+// Published returns the prefixes the agent publishes
+func (m *mesh) Published() []string {
+	prefixes := make([]string, 0, len(m.states))
+	for prefix := range m.states {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// path builds the VPN path publishing state for prefix, distinguished by the agent's address
+func (m *mesh) path(prefix, state string) (*table.Path, error) {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := ipnet.Mask.Size()
+	community, err := parseCommunity(meshCommunities[state])
+	if err != nil {
+		return nil, err
+	}
+
+	rd := bgp.NewRouteDistinguisherIPAddressAS(m.self.Address, 1)
+	var nlri bgp.AddrPrefixInterface
+	if ip.To4() != nil {
+		nlri = bgp.NewLabeledVPNIPAddrPrefix(uint8(ones), ip.String(), *bgp.NewMPLSLabelStack(), rd)
+	} else {
+		nlri = bgp.NewLabeledVPNIPv6AddrPrefix(uint8(ones), ip.String(), *bgp.NewMPLSLabelStack(), rd)
+	}
+	attrs := []bgp.PathAttributeInterface{
+		bgp.NewPathAttributeOrigin(0),
+		bgp.NewPathAttributeMpReachNLRI(m.self.Address, []bgp.AddrPrefixInterface{nlri}),
+		bgp.NewPathAttributeLocalPref(100),
+		bgp.NewPathAttributeCommunities([]uint32{community}),
+	}
+	return table.NewPath(nil, nlri, false, attrs, time.Now(), false), nil
+}
+
+// selfID returns what the agent is ranked by in a quorum, its device ID, or its address with static discovery
+func (m *mesh) selfID() string {
+	if m.byAddress {
+		return m.self.Address
+	}
+	return m.self.ID
+}
+
+// Candidates returns the IDs, as selfID has them, of the agents able to announce prefix according to view:
+// the agent itself and every peer publishing it
+func (m *mesh) Candidates(prefix string, view map[string]map[string]string) []string {
+	candidates := []string{m.selfID()}
+	for peer := range view[prefix] {
+		id := m.peers[peer]
+		if id == "" || m.byAddress {
+			id = peer
+		}
+		candidates = append(candidates, id)
+	}
+	return candidates
+}
+
+// quorumFor returns the quorum announcement is subject to, its own or the mesh-wide one, nil if there's none
+func (agent *PacketBGPAgent) quorumFor(announcement Announcement) *quorum {
+	if announcement.Quorum != nil {
+		return announcement.Quorum
+	}
+	if q := (quorum{Min: agent.Config.MeshMinAnnouncers, Max: agent.Config.MeshMaxAnnouncers}); q != (quorum{}) {
+		return &q
+	}
+	return nil
+}
+
+// evaluateMesh publishes the agent's state for every desired prefix, refreshes which are held back by their
+// quorum and reports whether any changed, agent.mu must be held. A dry run only looks. Without the mesh
+// the agent can't tell whether a quorum is met, so prefixes that have one are held
+func (agent *PacketBGPAgent) evaluateMesh() bool {
+	var view map[string]map[string]string
+	if agent.Mesh != nil {
+		view = agent.Mesh.View()
+	}
+	held := make(map[string]string)
+	desired := make(map[string]bool)
+	changed := false
+	for _, announcement := range agent.Announcements {
+		prefix := announcement.Prefix
+		desired[prefix] = true
+
+		q := agent.quorumFor(announcement)
+		state := ""
+		if agent.Mesh == nil {
+			if q != nil {
+				held[prefix] = "quorum: needs the mesh"
+			}
+		} else if agent.eligible(prefix) {
+			state = meshAnnounced
+			if q != nil {
+				if reason := q.hold(prefix, agent.Mesh.selfID(), agent.Mesh.Candidates(prefix, view)); reason != "" {
+					held[prefix] = reason
+					state = meshStandby
+				}
+			}
+		}
+		prev, wasHeld := agent.meshHeld[prefix]
+		if reason, isHeld := held[prefix]; isHeld && (!wasHeld || prev != reason) {
+			log.Println("withholding", prefix+":", reason)
+			changed = true
+		} else if !isHeld && wasHeld {
+			log.Println("advertising", prefix+", its quorum is met")
+			changed = true
+		}
+
+		if agent.Mesh != nil && !agent.Config.DryRun {
+			if err := agent.Mesh.Publish(prefix, state); err != nil {
+				log.Println("can't publish", prefix, "to the mesh:", err)
+			}
+		}
+	}
+	if agent.Mesh != nil {
+		for _, prefix := range agent.Mesh.Published() {
+			if !desired[prefix] {
+				if err := agent.Mesh.Publish(prefix, ""); err != nil {
+					log.Println("can't unpublish", prefix, "from the mesh:", err)
+				}
+			}
+		}
+	}
+	agent.meshHeld = held
+	agent.meshView = view
+	return changed
+}
+
+// discoverMesh peers with the agents discovery finds, keeping the current peers when it fails
+func (agent *PacketBGPAgent) discoverMesh() {
+	peers, err := agent.Mesh.Discover()
+	if err != nil {
+		log.Println("can't discover mesh peers:", err)
+		return
+	}
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if err := agent.Mesh.SetPeers(peers); err != nil {
+		log.Println(err)
+	}
+}
+
+// WatchMesh should be run as a go routine, discovers the mesh peers every MeshInterval and re-evaluates the
+// mesh rules whenever a peer publishes something or changes state, reconciling when one changed, until
+// done is closed
+func (agent *PacketBGPAgent) WatchMesh(done chan bool) {
+	w := agent.Mesh.server.Watch(gobgpServer.WatchUpdate(false), gobgpServer.WatchPeerState(false))
+	defer w.Stop()
+	ticker := time.NewTicker(agent.Config.MeshInterval)
+	defer ticker.Stop()
+
+	agent.discoverMesh()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			agent.discoverMesh()
+		case <-w.Event():
+			// a burst of updates only needs one evaluation
+			for pending := true; pending; {
+				select {
+				case <-w.Event():
+				default:
+					pending = false
+				}
+			}
+			agent.mu.Lock()
+			if agent.evaluateMesh() {
+				if err := agent.ensureBGP(); err != nil {
+					log.Println(err)
+				}
+			}
+			agent.mu.Unlock()
+		}
+	}
+}
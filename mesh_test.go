@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+func TestQuorum(t *testing.T) {
+	ids := []string{"device-a", "device-b", "device-c", "device-d"}
+	if reason := (quorum{Min: 5}).hold("192.0.2.1/32", "device-a", ids); reason == "" {
+		t.Error("announcing with 4 of at least 5 announcers")
+	}
+	if reason := (quorum{Min: 4}).hold("192.0.2.1/32", "device-a", ids); reason != "" {
+		t.Errorf("holding with 4 of at least 4 announcers: %s", reason)
+	}
+
+	// every agent reaches the same decision on its own, and not every prefix picks the same agents
+	winners := make(map[string]bool)
+	for i := 0; i < 16; i++ {
+		prefix := fmt.Sprintf("192.0.2.%d/32", i)
+		var announcing []string
+		for _, self := range ids {
+			if (quorum{Max: 2}).hold(prefix, self, ids) == "" {
+				announcing = append(announcing, self)
+			}
+		}
+		if len(announcing) != 2 {
+			t.Errorf("%s announced by %v, want 2 agents", prefix, announcing)
+		}
+		winners[fmt.Sprint(announcing)] = true
+	}
+	if len(winners) < 2 {
+		t.Errorf("every prefix announced by the same agents %v", winners)
+	}
+}
+
+func TestQuorumNeedsMesh(t *testing.T) {
+	anns, err := parseAnnouncements([]interface{}{
+		map[string]interface{}{"prefix": "192.0.2.1/32", "quorum": map[string]interface{}{"min": 2}},
+		"198.51.100.0/24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseAnnouncement(map[string]interface{}{"prefix": "192.0.2.1/32", "quorum": map[string]interface{}{}}); err == nil {
+		t.Error("accepted an empty quorum")
+	}
+
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{}, sp, n)
+	if err := desire(agent, anns...); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(sp.announced()), "[198.51.100.0/24]"; got != want {
+		t.Errorf("announced %s, want %s", got, want)
+	}
+	if status := agent.Status().Prefixes["192.0.2.1/32"]; status.Health != healthHeld {
+		t.Errorf("prefix with a quorum has health %s, want %s", status.Health, healthHeld)
+	}
+}
+
+func TestStaticDiscovery(t *testing.T) {
+	d, err := newStaticDiscovery([]string{"10.0.0.3", "device-b=10.0.0.9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, _ := d.Members()
+	if want := []member{{"10.0.0.3", "10.0.0.3"}, {"device-b", "10.0.0.9"}}; !reflect.DeepEqual(members, want) {
+		t.Errorf("static members are %v, want %v", members, want)
+	}
+	for _, invalid := range []string{"device-b", "=10.0.0.9", "device-b=router"} {
+		if _, err := newStaticDiscovery([]string{invalid}); err == nil {
+			t.Errorf("accepted mesh peer %q", invalid)
+		}
+	}
+}
+
+func TestStaticMeshQuorum(t *testing.T) {
+	// two agents that list each other by address, or only one of them by device ID too
+	for _, peers := range [][2]string{{"10.0.0.2", "10.0.0.1"}, {"device-b=10.0.0.2", "10.0.0.1"}} {
+		a, err := lookAtMesh(nil, member{"device-a", "10.0.0.1"}, Config{MeshDiscovery: discoveryStatic, MeshPeers: []string{peers[0]}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := lookAtMesh(nil, member{"device-b", "10.0.0.2"}, Config{MeshDiscovery: discoveryStatic, MeshPeers: []string{peers[1]}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// each sees the other publish every prefix, and exactly one of them announces it
+		for i := 0; i < 16; i++ {
+			prefix := fmt.Sprintf("192.0.2.%d/32", i)
+			var announcing []string
+			for _, m := range []*mesh{a, b} {
+				other := a
+				if m == a {
+					other = b
+				}
+				view := map[string]map[string]string{prefix: {other.self.Address: meshAnnounced}}
+				if (quorum{Max: 1}).hold(prefix, m.selfID(), m.Candidates(prefix, view)) == "" {
+					announcing = append(announcing, m.self.ID)
+				}
+			}
+			if len(announcing) != 1 {
+				t.Errorf("with peers %v %s is announced by %v, want one agent", peers, prefix, announcing)
+			}
+		}
+	}
+}
+
+func TestKVDiscovery(t *testing.T) {
+	h := httptest.NewServer(newKVStore())
+	defer h.Close()
+
+	discover := func(id, address string, interval time.Duration) discovery {
+		d, err := newDiscovery(Config{MeshDiscovery: discoveryKV, MeshKV: h.URL, MeshKVPrefix: "fleet", MeshInterval: interval}, member{id, address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	a, b := discover("device-a", "10.0.0.3", time.Hour), discover("device-b", "10.0.0.9", 10*time.Millisecond)
+	// something else written under the prefix is skipped
+	if err := doJSON(http.DefaultClient, http.MethodPut, h.URL+"/v1/kv/fleet/lock", nil, strings.NewReader("held"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Members(); err != nil {
+		t.Fatal(err)
+	}
+	members, err := b.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []member{{"device-a", "10.0.0.3"}, {"device-b", "10.0.0.9"}}; !reflect.DeepEqual(members, want) {
+		t.Errorf("registered members are %v, want %v", members, want)
+	}
+
+	// b stopped refreshing its registration
+	time.Sleep(50 * time.Millisecond)
+	members, err = a.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []member{{"device-a", "10.0.0.3"}}; !reflect.DeepEqual(members, want) {
+		t.Errorf("registered members are %v after one expired, want %v", members, want)
+	}
+}
+
+func TestMeshTagged(t *testing.T) {
+	h := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Token") != "token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/devices/self":
+			fmt.Fprint(w, `{"project": {"href": "/projects/p"}}`)
+		case "/projects/p/devices":
+			fmt.Fprint(w, `{"devices": [
+				{"id": "self", "tags": ["lb"], "ip_addresses": [{"address": "10.0.0.5", "address_family": 4, "public": false}]},
+				{"id": "device-b", "tags": ["lb", "web"], "ip_addresses": [
+					{"address": "147.75.0.9", "address_family": 4, "public": true},
+					{"address": "10.0.0.9", "address_family": 4, "public": false}
+				]},
+				{"id": "device-c", "tags": ["web"], "ip_addresses": [{"address": "10.0.0.7", "address_family": 4, "public": false}]}
+			]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer h.Close()
+
+	m, err := newMesh(gobgpServer.NewBgpServer(), 65000, member{"self", "10.0.0.5"}, Config{
+		MeshDiscovery: discoveryTag,
+		MeshTag:       "lb",
+		PacketAPI:     h.URL,
+		PacketToken:   "token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := m.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []member{{"device-b", "10.0.0.9"}}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("discovered %v, want %v", peers, want)
+	}
+}
+
+// startMeshServer starts a gobgp listening on address like the agent's embedded one does with the mesh on
+func startMeshServer(t *testing.T, address string, port uint16) *gobgpServer.BgpServer {
+	s := gobgpServer.NewBgpServer()
+	go s.Serve()
+	err := s.Start(&config.Global{
+		Config: config.GlobalConfig{
+			As:               65000,
+			RouterId:         address,
+			Port:             int32(port),
+			LocalAddressList: []string{address},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMeshView(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a BGP session")
+	}
+	port := freePort(t)
+	// left running, like the test router, see testHarness.Close
+	a, b := startMeshServer(t, "127.0.0.2", port), startMeshServer(t, "127.0.0.3", port)
+
+	meshA, _ := newMesh(a, 65000, member{"device-a", "127.0.0.2"}, Config{MeshDiscovery: discoveryStatic, MeshPort: int(port), MeshPeers: []string{"device-b=127.0.0.3"}})
+	meshB, _ := newMesh(b, 65000, member{"device-b", "127.0.0.3"}, Config{MeshDiscovery: discoveryStatic, MeshPort: int(port), MeshPeers: []string{"device-a=127.0.0.2"}})
+	for _, m := range []*mesh{meshA, meshB} {
+		peers, err := m.Discover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SetPeers(peers); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := meshA.Publish("192.0.2.1/32", meshAnnounced); err != nil {
+		t.Fatal(err)
+	}
+	if err := meshA.Publish("2001:db8::/64", meshStandby); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{
+		"192.0.2.1/32":  {"127.0.0.2": meshAnnounced},
+		"2001:db8::/64": {"127.0.0.2": meshStandby},
+	}
+	var got map[string]map[string]string
+	deadline := time.Now().Add(45 * time.Second) // gobgp waits 10-20s before its first connect
+	for time.Now().Before(deadline) {
+		if got = meshB.View(); reflect.DeepEqual(got, want) {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mesh peer sees %v, want %v", got, want)
+	}
+
+	// a changed state replaces the published one, and unpublishing takes it away
+	if err := meshA.Publish("192.0.2.1/32", meshStandby); err != nil {
+		t.Fatal(err)
+	}
+	if err := meshA.Publish("2001:db8::/64", ""); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]map[string]string{"192.0.2.1/32": {"127.0.0.2": meshStandby}}
+	eventually(t, "the mesh peer to see the changes", func() bool {
+		return reflect.DeepEqual(meshB.View(), want)
+	})
+	if sessions := meshB.Sessions(); sessions["127.0.0.2"] != "established" {
+		t.Errorf("mesh sessions are %v, want established", sessions)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/packethost/packetmetadata/hegel"
+	"github.com/packethost/packetmetadata/packetmetadata"
+	"github.com/packethost/packngo/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// metadataClient reads the device's metadata from hegel over gRPC and from the metadata service over
+// HTTP. Unlike packetmetadata and packngo/metadata both endpoints are configurable, so the agent can run
+// against a fake off Packet
+type metadataClient struct {
+	hegelAddr string
+	insecure  bool // plaintext gRPC, for a fake hegel
+	url       string
+	http      *http.Client
+}
+
+func newMetadataClient(hegelAddr string, insecure bool, url string) *metadataClient {
+	return &metadataClient{
+		hegelAddr: hegelAddr,
+		insecure:  insecure,
+		url:       strings.TrimSuffix(url, "/"),
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *metadataClient) dial() (hegel.HegelClient, *grpc.ClientConn, error) {
+	opt := grpc.WithInsecure()
+	if !c.insecure {
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, nil, err
+		}
+		opt = grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(certPool, ""))
+	}
+	conn, err := grpc.Dial(c.hegelAddr, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hegel.NewHegelClient(conn), conn, nil
+}
+
+// Get returns the current metadata from hegel
+func (c *metadataClient) Get() (*packetmetadata.Metadata, error) {
+	client, conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := client.Get(ctx, &hegel.GetRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadata(res.JSON)
+}
+
+// Device returns the device document of the metadata service
+func (c *metadataClient) Device() (*metadata.CurrentDevice, error) {
+	res, err := c.http.Get(c.url + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s/metadata: %s", c.url, res.Status)
+	}
+	device := &metadata.CurrentDevice{}
+	if err := json.Unmarshal(b, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// Watch sends the metadata once connected to hegel and again whenever it changes, reconnecting with
+// backoff when the subscription breaks, until done is closed
+func (c *metadataClient) Watch(done chan bool) <-chan *packetmetadata.Metadata {
+	updates := make(chan *packetmetadata.Metadata)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	go func() {
+		backoff := time.Second
+		for {
+			err := c.subscribe(ctx, updates, func() { backoff = time.Second })
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("metadata subscription broke, retrying in", backoff, ":", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}()
+	return updates
+}
+
+// subscribe sends the current metadata and every change until the subscription breaks, connected is
+// called once it is established
+func (c *metadataClient) subscribe(ctx context.Context, updates chan *packetmetadata.Metadata, connected func()) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sub, err := client.Subscribe(ctx, &hegel.SubscribeRequest{})
+	if err != nil {
+		return err
+	}
+	res, err := client.Get(ctx, &hegel.GetRequest{})
+	if err != nil {
+		return err
+	}
+	connected()
+
+	last := ""
+	state := res.JSON
+	for {
+		if state != last {
+			md, err := parseMetadata(state)
+			if err != nil {
+				log.Println("ignoring invalid metadata:", err)
+			} else {
+				select {
+				case updates <- md:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			last = state
+		}
+
+		next, err := sub.Recv()
+		if err != nil {
+			return err
+		}
+		state = next.JSON
+	}
+}
+
+func parseMetadata(s string) (*packetmetadata.Metadata, error) {
+	md := &packetmetadata.Metadata{}
+	if err := json.Unmarshal([]byte(s), md); err != nil {
+		return nil, err
+	}
+	if md.Instance == nil {
+		md.Instance = &metadata.CurrentDevice{}
+	}
+	return md, nil
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+const (
+	// communityBlackhole asks the upstream to drop traffic to a prefix, RFC 7999. It's sent along with
+	// NO_EXPORT so the blackhole doesn't spread any further
+	communityBlackhole = "65535:666"
+	communityNoExport  = "65535:65281"
+
+	sourceAPI = "api"
+)
+
+// flowspecRule matches traffic to Destination, and optionally by source, protocol and ports, and drops it
+// or limits its rate
+type flowspecRule struct {
+	Destination      string   `json:"destination"`
+	Source           string   `json:"source,omitempty"`
+	Protocol         string   `json:"protocol,omitempty"` // tcp, udp, icmp, icmpv6 or a protocol number
+	DestinationPorts []uint16 `json:"destination_ports,omitempty"`
+	SourcePorts      []uint16 `json:"source_ports,omitempty"`
+	RateLimit        float32  `json:"rate_limit,omitempty"` // bytes per second, 0 drops the traffic
+}
+
+var ipProtocols = map[string]uint64{"icmp": 1, "tcp": 6, "udp": 17, "icmpv6": 58}
+
+// nlri builds the FlowSpec NLRI matching the rule
+func (f *flowspecRule) nlri() (bgp.AddrPrefixInterface, error) {
+	ip, dst, err := net.ParseCIDR(f.Destination)
+	if err != nil {
+		return nil, err
+	}
+	v4 := ip.To4() != nil
+	components := []bgp.FlowSpecComponentInterface{flowspecPrefix(dst, true)}
+
+	if f.Source != "" {
+		srcIP, src, err := net.ParseCIDR(f.Source)
+		if err != nil {
+			return nil, err
+		}
+		if (srcIP.To4() != nil) != v4 {
+			return nil, fmt.Errorf("source %s and destination %s aren't the same address family", f.Source, f.Destination)
+		}
+		components = append(components, flowspecPrefix(src, false))
+	}
+
+	if f.Protocol != "" {
+		proto, ok := ipProtocols[strings.ToLower(f.Protocol)]
+		if !ok {
+			n, err := strconv.ParseUint(f.Protocol, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("unknown protocol %q", f.Protocol)
+			}
+			proto = n
+		}
+		components = append(components, bgp.NewFlowSpecComponent(bgp.FLOW_SPEC_TYPE_IP_PROTO, []*bgp.FlowSpecComponentItem{
+			bgp.NewFlowSpecComponentItem(bgp.DEC_NUM_OP_EQ, proto),
+		}))
+	}
+
+	for _, ports := range []struct {
+		typ   bgp.BGPFlowSpecType
+		ports []uint16
+	}{{bgp.FLOW_SPEC_TYPE_DST_PORT, f.DestinationPorts}, {bgp.FLOW_SPEC_TYPE_SRC_PORT, f.SourcePorts}} {
+		if len(ports.ports) == 0 {
+			continue
+		}
+		items := make([]*bgp.FlowSpecComponentItem, 0, len(ports.ports))
+		for _, port := range ports.ports {
+			items = append(items, bgp.NewFlowSpecComponentItem(bgp.DEC_NUM_OP_EQ, uint64(port)))
+		}
+		components = append(components, bgp.NewFlowSpecComponent(ports.typ, items))
+	}
+
+	if f.RateLimit < 0 {
+		return nil, fmt.Errorf("rate limit %g is negative", f.RateLimit)
+	}
+	if v4 {
+		return bgp.NewFlowSpecIPv4Unicast(components), nil
+	}
+	return bgp.NewFlowSpecIPv6Unicast(components), nil
+}
+
+func flowspecPrefix(ipnet *net.IPNet, destination bool) bgp.FlowSpecComponentInterface {
+	ones, _ := ipnet.Mask.Size()
+	if ipnet.IP.To4() != nil {
+		prefix := bgp.NewIPAddrPrefix(uint8(ones), ipnet.IP.String())
+		if destination {
+			return bgp.NewFlowSpecDestinationPrefix(prefix)
+		}
+		return bgp.NewFlowSpecSourcePrefix(prefix)
+	}
+	prefix := bgp.NewIPv6AddrPrefix(uint8(ones), ipnet.IP.String())
+	if destination {
+		return bgp.NewFlowSpecDestinationPrefix6(prefix, 0)
+	}
+	return bgp.NewFlowSpecSourcePrefix6(prefix, 0)
+}
+
+// path builds the path announcing the rule, its action carried in a traffic-rate extended community
+func (f *flowspecRule) path() (*table.Path, error) {
+	nlri, err := f.nlri()
+	if err != nil {
+		return nil, err
+	}
+	nexthop := "0.0.0.0"
+	if nlri.AFI() == bgp.AFI_IP6 {
+		nexthop = "::"
+	}
+	attrs := []bgp.PathAttributeInterface{
+		bgp.NewPathAttributeOrigin(0),
+		bgp.NewPathAttributeMpReachNLRI(nexthop, []bgp.AddrPrefixInterface{nlri}),
+		bgp.NewPathAttributeExtendedCommunities([]bgp.ExtendedCommunityInterface{bgp.NewTrafficRateExtended(0, f.RateLimit)}),
+	}
+	return table.NewPath(nil, nlri, false, attrs, time.Now(), false), nil
+}
+
+// mitigation is a time limited blackhole or FlowSpec announcement
+type mitigation struct {
+	ID        string        `json:"id"`
+	Blackhole string        `json:"blackhole,omitempty"`
+	FlowSpec  *flowspecRule `json:"flowspec,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	Source    string        `json:"source"`
+	Expires   time.Time     `json:"expires"`
+}
+
+// mitigationRequest asks for a blackhole or a FlowSpec rule, until a time or for a duration like "30m".
+// BGP_MITIGATE entries need until, a duration would start over with every metadata update
+type mitigationRequest struct {
+	Blackhole string        `json:"blackhole,omitempty"`
+	FlowSpec  *flowspecRule `json:"flowspec,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	Until     *time.Time    `json:"until,omitempty"`
+	Duration  string        `json:"duration,omitempty"`
+}
+
+// mitigator keeps track of the mitigations in effect. Blackholes are announced through the speaker along
+// with the rest of the plan, FlowSpec rules straight into the embedded gobgp. Every change is audited
+type mitigator struct {
+	allowlist       []*net.IPNet
+	defaultDuration time.Duration
+	maxDuration     time.Duration
+	auditLog        string
+	server          *gobgpServer.BgpServer // nil unless the speaker is gobgp, FlowSpec needs it
+	dryRun          bool
+	active          map[string]*mitigation
+	flows           map[string][]byte // path UUIDs of announced FlowSpec rules by mitigation ID
+	lastMetadata    interface{}
+}
+
+// newMitigator returns nil when nothing may be mitigated
+func newMitigator(server *gobgpServer.BgpServer, cfg Config) (*mitigator, error) {
+	if len(cfg.MitigationAllowlist) == 0 {
+		return nil, nil
+	}
+	m := &mitigator{
+		defaultDuration: cfg.MitigationDuration,
+		maxDuration:     cfg.MitigationMaxDuration,
+		auditLog:        cfg.MitigationAuditLog,
+		server:          server,
+		dryRun:          cfg.DryRun,
+		active:          make(map[string]*mitigation),
+		flows:           make(map[string][]byte),
+	}
+	for _, prefix := range cfg.MitigationAllowlist {
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mitigation allowlist entry: %s", err)
+		}
+		m.allowlist = append(m.allowlist, ipnet)
+	}
+	return m, nil
+}
+
+// allowed reports whether prefix lies within an allowlisted one
+func (m *mitigator) allowed(prefix *net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	for _, allowed := range m.allowlist {
+		allowedOnes, allowedBits := allowed.Mask.Size()
+		if bits == allowedBits && ones >= allowedOnes && allowed.Contains(prefix.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// mitigation checks req and turns it into the mitigation it asks for
+func (m *mitigator) mitigation(req mitigationRequest, source string, now time.Time) (*mitigation, error) {
+	mit := &mitigation{Reason: req.Reason, Source: source}
+
+	var target string
+	switch {
+	case req.Blackhole != "" && req.FlowSpec != nil:
+		return nil, fmt.Errorf("a mitigation is either a blackhole or a FlowSpec rule")
+	case req.Blackhole != "":
+		_, ipnet, err := net.ParseCIDR(req.Blackhole)
+		if err != nil {
+			return nil, err
+		}
+		mit.Blackhole = ipnet.String()
+		mit.ID = "blackhole " + mit.Blackhole
+		target = mit.Blackhole
+	case req.FlowSpec != nil:
+		if m.server == nil {
+			return nil, fmt.Errorf("FlowSpec needs the %s speaker", speakerGobgp)
+		}
+		rule := *req.FlowSpec
+		nlri, err := rule.nlri()
+		if err != nil {
+			return nil, err
+		}
+		_, dst, _ := net.ParseCIDR(rule.Destination)
+		rule.Destination = dst.String()
+		mit.FlowSpec = &rule
+		mit.ID = "flowspec " + nlri.String()
+		target = rule.Destination
+	default:
+		return nil, fmt.Errorf("a mitigation needs a blackhole or a FlowSpec rule")
+	}
+
+	if _, ipnet, _ := net.ParseCIDR(target); !m.allowed(ipnet) {
+		return nil, fmt.Errorf("%s isn't on the mitigation allowlist", target)
+	}
+
+	switch {
+	case req.Duration != "" && source != sourceAPI:
+		return nil, fmt.Errorf("%s needs until, a duration would start over with every update", mit.ID)
+	case req.Until != nil:
+		mit.Expires = *req.Until
+	case req.Duration != "":
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return nil, err
+		}
+		mit.Expires = now.Add(d)
+	case source == sourceAPI:
+		mit.Expires = now.Add(m.defaultDuration)
+	default:
+		return nil, fmt.Errorf("%s needs until", mit.ID)
+	}
+	if !mit.Expires.After(now) {
+		return nil, fmt.Errorf("%s expired at %s", mit.ID, mit.Expires.Format(time.RFC3339))
+	}
+	if mit.Expires.Sub(now) > m.maxDuration {
+		return nil, fmt.Errorf("%s lasts longer than %s", mit.ID, m.maxDuration)
+	}
+	return mit, nil
+}
+
+// Add puts mit in effect, or changes the one with the same ID
+func (m *mitigator) Add(mit *mitigation, by string) error {
+	if mit.FlowSpec != nil && !m.dryRun {
+		path, err := mit.FlowSpec.path()
+		if err != nil {
+			return err
+		}
+		if _, ok := m.flows[mit.ID]; ok {
+			if err := m.server.UpdatePath("", []*table.Path{path}); err != nil {
+				return err
+			}
+		} else {
+			uuid, err := m.server.AddPath("", []*table.Path{path})
+			if err != nil {
+				return err
+			}
+			m.flows[mit.ID] = uuid
+		}
+	}
+
+	action := "add"
+	if _, ok := m.active[mit.ID]; ok {
+		action = "change"
+	}
+	m.active[mit.ID] = mit
+	m.audit(action, mit, by)
+	return nil
+}
+
+// Remove takes the mitigation with id out of effect, action says why for the audit log
+func (m *mitigator) Remove(id, action, by string) error {
+	mit, ok := m.active[id]
+	if !ok {
+		return fmt.Errorf("no mitigation %q", id)
+	}
+	if uuid, ok := m.flows[id]; ok {
+		if err := m.server.DeletePath(uuid, 0, "", nil); err != nil {
+			return err
+		}
+		delete(m.flows, id)
+	}
+	delete(m.active, id)
+	m.audit(action, mit, by)
+	return nil
+}
+
+// Expire removes every mitigation that's expired by now and reports whether there was any
+func (m *mitigator) Expire(now time.Time) bool {
+	expired := false
+	for _, mit := range m.List() {
+		if now.Before(mit.Expires) {
+			continue
+		}
+		if err := m.Remove(mit.ID, "expire", "agent"); err != nil {
+			log.Println("can't expire mitigation", mit.ID+":", err)
+			continue
+		}
+		expired = true
+	}
+	return expired
+}
+
+// SetMetadata makes the mitigations from BGP_MITIGATE those in v, invalid entries are audited as
+// rejected and left out. It reports whether anything changed
+func (m *mitigator) SetMetadata(v interface{}, now time.Time) bool {
+	// writing BGP_STATUS changes metadata too, an unchanged BGP_MITIGATE isn't looked at again
+	if reflect.DeepEqual(v, m.lastMetadata) {
+		return false
+	}
+	m.lastMetadata = v
+
+	var reqs []mitigationRequest
+	if v != nil {
+		b, err := json.Marshal(v)
+		if err == nil {
+			err = json.Unmarshal(b, &reqs)
+		}
+		if err != nil {
+			log.Println("invalid BGP_MITIGATE:", err)
+			return false
+		}
+	}
+
+	changed := false
+	wanted := make(map[string]bool)
+	for _, req := range reqs {
+		mit, err := m.mitigation(req, sourceMetadata, now)
+		if err != nil {
+			m.audit("reject", &mitigation{Blackhole: req.Blackhole, FlowSpec: req.FlowSpec, Reason: err.Error(), Source: sourceMetadata}, sourceMetadata)
+			continue
+		}
+		wanted[mit.ID] = true
+		if prev, ok := m.active[mit.ID]; ok && reflect.DeepEqual(prev, mit) {
+			continue
+		}
+		if err := m.Add(mit, sourceMetadata); err != nil {
+			log.Println("can't add mitigation", mit.ID+":", err)
+			continue
+		}
+		changed = true
+	}
+	for id, mit := range m.active {
+		if mit.Source != sourceMetadata || wanted[id] {
+			continue
+		}
+		if err := m.Remove(id, "remove", sourceMetadata); err != nil {
+			log.Println("can't remove mitigation", id+":", err)
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+// List returns the mitigations in effect, sorted by ID
+func (m *mitigator) List() []mitigation {
+	list := make([]mitigation, 0, len(m.active))
+	for _, mit := range m.active {
+		list = append(list, *mit)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// blackholed returns the blackhole mitigation of prefix, nil if there's none
+func (m *mitigator) blackholed(prefix string) *mitigation {
+	return m.active["blackhole "+prefix]
+}
+
+// blackholes returns the blackholed prefixes, sorted
+func (m *mitigator) blackholes() []string {
+	prefixes := make([]string, 0)
+	for _, mit := range m.active {
+		if mit.Blackhole != "" {
+			prefixes = append(prefixes, mit.Blackhole)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// auditEntry is a line of the audit log
+type auditEntry struct {
+	Time   time.Time   `json:"time"`
+	Action string      `json:"action"` // add, change, remove, expire or reject
+	By     string      `json:"by"`     // who asked: the API client's address, metadata or the agent
+	Mit    *mitigation `json:"mitigation"`
+}
+
+// audit records a change to the mitigations in the agent's log and, if configured, the audit log
+func (m *mitigator) audit(action string, mit *mitigation, by string) {
+	b, err := json.Marshal(auditEntry{Time: time.Now().UTC(), Action: action, By: by, Mit: mit})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println("mitigation audit:", string(b))
+	if m.auditLog == "" {
+		return
+	}
+
+	f, err := os.OpenFile(m.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Println("can't write mitigation audit log:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Println("can't write mitigation audit log:", err)
+	}
+}
+
+// blackholedBy returns the mitigation blackholing prefix, nil if there's none. agent.mu must be held
+func (agent *PacketBGPAgent) blackholedBy(prefix string) *mitigation {
+	if agent.Mitigations == nil {
+		return nil
+	}
+	return agent.Mitigations.blackholed(prefix)
+}
+
+// blackholed adds the blackhole communities to r if prefix is blackholed, agent.mu must be held
+func (agent *PacketBGPAgent) blackholed(prefix string, r *route) *route {
+	if agent.blackholedBy(prefix) != nil {
+		r.Communities = append(r.Communities, communityBlackhole, communityNoExport)
+	}
+	return r
+}
+
+// blackholing reports whether prefix is announced as a blackhole, whatever else holds it back. agent.mu
+// must be held
+func (agent *PacketBGPAgent) blackholing(prefix string) bool {
+	return agent.uplinkUp && agent.blackholedBy(prefix) != nil
+}
+
+// Mitigate puts a mitigation requested on the API into effect, by is who asked
+func (agent *PacketBGPAgent) Mitigate(req mitigationRequest, by string) (*mitigation, error) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	if agent.Mitigations == nil {
+		return nil, fmt.Errorf("mitigation isn't enabled, there's no allowlist")
+	}
+	mit, err := agent.Mitigations.mitigation(req, sourceAPI, time.Now())
+	if err != nil {
+		agent.Mitigations.audit("reject", &mitigation{Blackhole: req.Blackhole, FlowSpec: req.FlowSpec, Reason: err.Error(), Source: sourceAPI}, by)
+		return nil, err
+	}
+	if err := agent.Mitigations.Add(mit, by); err != nil {
+		return nil, err
+	}
+	return mit, agent.ensureBGP()
+}
+
+// Unmitigate takes the mitigation with id out of effect, by is who asked
+func (agent *PacketBGPAgent) Unmitigate(id, by string) error {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	if agent.Mitigations == nil {
+		return fmt.Errorf("no mitigation %q", id)
+	}
+	if err := agent.Mitigations.Remove(id, "remove", by); err != nil {
+		return err
+	}
+	return agent.ensureBGP()
+}
+
+// WatchMitigations should be run as a go routine, withdraws mitigations as they expire until done is
+// closed
+func (agent *PacketBGPAgent) WatchMitigations(done chan bool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			agent.mu.Lock()
+			if agent.Mitigations.Expire(now) {
+				if err := agent.ensureBGP(); err != nil {
+					log.Println(err)
+				}
+			}
+			agent.mu.Unlock()
+		}
+	}
+}
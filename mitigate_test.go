@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestMitigator allows 192.0.2.0/24 and audits to a file in a temporary directory
+func newTestMitigator(t *testing.T) *mitigator {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMitigator(nil, Config{
+		MitigationAllowlist:   []string{"192.0.2.0/24"},
+		MitigationDuration:    time.Hour,
+		MitigationMaxDuration: 24 * time.Hour,
+		MitigationAuditLog:    filepath.Join(dir, "audit.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// audited returns the actions in the audit log and what they were taken on
+func audited(t *testing.T, m *mitigator) []string {
+	f, err := os.Open(m.auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	actions := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		target := entry.Mit.ID
+		if target == "" { // a rejected request never got an ID
+			target = entry.Mit.Blackhole
+		}
+		actions = append(actions, entry.Action+" "+target)
+	}
+	return actions
+}
+
+func TestMitigationRequests(t *testing.T) {
+	m := newTestMitigator(t)
+	defer os.RemoveAll(filepath.Dir(m.auditLog))
+	now := time.Now()
+	later := now.Add(time.Hour)
+
+	mit, err := m.mitigation(mitigationRequest{Blackhole: "192.0.2.7/32"}, sourceAPI, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mit.ID != "blackhole 192.0.2.7/32" || !mit.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("got mitigation %+v", mit)
+	}
+
+	for _, invalid := range []mitigationRequest{
+		{},
+		{Blackhole: "198.51.100.1/32", Duration: "1m"},         // not allowlisted
+		{Blackhole: "192.0.0.0/16", Duration: "1m"},            // covers more than allowed
+		{Blackhole: "192.0.2.7/32", Duration: "48h"},           // too long
+		{Blackhole: "192.0.2.7/32", Until: &now},               // already expired
+		{FlowSpec: &flowspecRule{Destination: "192.0.2.7/32"}}, // no gobgp
+		{Blackhole: "192.0.2.7/32", FlowSpec: &flowspecRule{}}, // both
+	} {
+		if mit, err := m.mitigation(invalid, sourceAPI, now); err == nil {
+			t.Errorf("accepted %+v as %+v", invalid, mit)
+		}
+	}
+
+	// metadata has to say until when
+	if _, err := m.mitigation(mitigationRequest{Blackhole: "192.0.2.7/32"}, sourceMetadata, now); err == nil {
+		t.Error("accepted a mitigation from metadata without an expiry")
+	}
+	for _, req := range []mitigationRequest{
+		{Blackhole: "192.0.2.7/32", Duration: "1m"},
+		{Blackhole: "192.0.2.7/32", Duration: "1m", Until: &later},
+	} {
+		if mit, err := m.mitigation(req, sourceMetadata, now); err == nil {
+			t.Errorf("accepted a duration from metadata as %+v", mit)
+		}
+	}
+	if _, err := m.mitigation(mitigationRequest{Blackhole: "192.0.2.7/32", Until: &later}, sourceMetadata, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlowSpecRule(t *testing.T) {
+	rule := flowspecRule{Destination: "192.0.2.7/32", Source: "203.0.113.0/24", Protocol: "udp", DestinationPorts: []uint16{53, 123}}
+	nlri, err := rule.nlri()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nlri.String(), "[destination: 192.0.2.7/32][source: 203.0.113.0/24][protocol: ==udp][destination-port: ==53 ==123]"; got != want {
+		t.Errorf("rule is %s, want %s", got, want)
+	}
+
+	for _, invalid := range []flowspecRule{
+		{Destination: "192.0.2.7"},
+		{Destination: "192.0.2.7/32", Source: "2001:db8::/32"},
+		{Destination: "192.0.2.7/32", Protocol: "sctp-ish"},
+		{Destination: "192.0.2.7/32", RateLimit: -1},
+	} {
+		if _, err := invalid.nlri(); err == nil {
+			t.Errorf("accepted rule %+v", invalid)
+		}
+	}
+}
+
+func TestBlackhole(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{}, sp, n)
+	agent.Mitigations = newTestMitigator(t)
+	defer os.RemoveAll(filepath.Dir(agent.Mitigations.auditLog))
+
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}); err != nil {
+		t.Fatal(err)
+	}
+	n.Ops()
+	sp.Ops()
+
+	// an announced prefix keeps its address and gets the communities, another one is announced on its own
+	until := time.Now().Add(time.Hour)
+	agent.mu.Lock()
+	changed := agent.Mitigations.SetMetadata([]interface{}{
+		map[string]interface{}{"blackhole": "192.0.2.1/32", "until": until.Format(time.RFC3339Nano)},
+		map[string]interface{}{"blackhole": "192.0.2.99/32", "until": until.Format(time.RFC3339Nano)},
+		map[string]interface{}{"blackhole": "203.0.113.1/32", "until": until.Format(time.RFC3339Nano)},
+	}, time.Now())
+	agent.mu.Unlock()
+	if !changed {
+		t.Fatal("mitigations from metadata didn't change anything")
+	}
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops())
+	expectOps(t, "speaker", sp.Ops(), "announce 192.0.2.1/32", "announce 192.0.2.99/32")
+	for _, prefix := range []string{"192.0.2.1/32", "192.0.2.99/32"} {
+		r := sp.routes[prefix]
+		if r == nil || len(r.Communities) != 2 || r.Communities[0] != communityBlackhole {
+			t.Errorf("%s announced as %+v, want it blackholed", prefix, r)
+		}
+	}
+	if status := agent.Status().Prefixes["192.0.2.99/32"]; status.Health != healthAnnounced || status.Source != sourceMetadata {
+		t.Errorf("blackholed prefix has status %+v", status)
+	}
+
+	// a drained host keeps blackholing
+	agent.mu.Lock()
+	agent.setDrain(drainWithdraw)
+	agent.mu.Unlock()
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "speaker", sp.Ops())
+
+	agent.mu.Lock()
+	agent.setDrain("")
+	expired := agent.Mitigations.Expire(until)
+	agent.mu.Unlock()
+	if !expired {
+		t.Fatal("nothing expired")
+	}
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "speaker", sp.Ops(), "withdraw 192.0.2.99/32", "announce 192.0.2.1/32")
+	if r := sp.routes["192.0.2.1/32"]; len(r.Communities) != 0 {
+		t.Errorf("expired blackhole left communities %v", r.Communities)
+	}
+
+	expectOps(t, "audit log", audited(t, agent.Mitigations),
+		"add blackhole 192.0.2.1/32", "add blackhole 192.0.2.99/32",
+		"reject 203.0.113.1/32",
+		"expire blackhole 192.0.2.1/32", "expire blackhole 192.0.2.99/32")
+}
+
+func TestBlackholeExpiry(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{}, sp, n)
+	agent.Mitigations = newTestMitigator(t)
+	defer os.RemoveAll(filepath.Dir(agent.Mitigations.auditLog))
+
+	// a prefix that isn't otherwise desired is only announced while it's blackholed
+	until := time.Now().Add(time.Hour)
+	agent.mu.Lock()
+	agent.Mitigations.SetMetadata([]interface{}{
+		map[string]interface{}{"blackhole": "192.0.2.99/32", "until": until.Format(time.RFC3339Nano)},
+	}, time.Now())
+	agent.mu.Unlock()
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "speaker", sp.Ops(), "announce 192.0.2.99/32")
+
+	agent.mu.Lock()
+	agent.Mitigations.Expire(until)
+	agent.mu.Unlock()
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "speaker", sp.Ops(), "withdraw 192.0.2.99/32")
+	expectOps(t, "network", n.Ops())
+	if len(agent.announcementTable) != 0 || len(agent.Status().Prefixes) != 0 {
+		t.Errorf("an expired blackhole left %v, status %v", agent.announcementTable, agent.Status().Prefixes)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/packet/mrt"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+// strftimeLayouts maps the strftime directives allowed in MRT file patterns to Go time layouts
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+}
+
+// mrtPattern is an MRT file name with strftime directives, e.g. /var/lib/mrt/updates.%Y%m%d.%H%M
+type mrtPattern struct {
+	layout string // Go time layout gobgp formats
+	glob   string // matches every file the pattern produces
+}
+
+// parseMRTPattern converts pattern to the time layout gobgp expects. Go layouts can't be escaped, so
+// literal text that would read as part of one (a "1" or "Jan", say) is rejected
+func parseMRTPattern(pattern string) (*mrtPattern, error) {
+	var layout, glob, literal strings.Builder
+	check := func() error {
+		l := literal.String()
+		if time.Date(2019, 11, 22, 23, 44, 55, 0, time.UTC).Format(l) != l {
+			return fmt.Errorf("MRT file pattern %q: %q would be read as a time layout", pattern, l)
+		}
+		layout.WriteString(l)
+		glob.WriteString(l)
+		literal.Reset()
+		return nil
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			literal.WriteByte(pattern[i])
+			continue
+		}
+		if i+1 < len(pattern) && pattern[i+1] == '%' {
+			literal.WriteByte('%')
+			i++
+			continue
+		}
+		if i+1 == len(pattern) || strftimeLayouts[pattern[i+1]] == "" {
+			return nil, fmt.Errorf("MRT file pattern %q: unsupported directive at %d", pattern, i)
+		}
+		if err := check(); err != nil {
+			return nil, err
+		}
+		layout.WriteString(strftimeLayouts[pattern[i+1]])
+		glob.WriteString("*")
+		i++
+	}
+	if err := check(); err != nil {
+		return nil, err
+	}
+	return &mrtPattern{layout: layout.String(), glob: glob.String()}, nil
+}
+
+// mrtManager dumps BGP updates and periodic RIB snapshots to MRT files through gobgp, prunes old files
+// and writes snapshots on demand
+type mrtManager struct {
+	server        *gobgpServer.BgpServer
+	updates       *mrtPattern
+	table         *mrtPattern
+	tableInterval time.Duration
+	rotation      time.Duration
+	retention     time.Duration
+	maxFiles      int
+	mu            sync.Mutex // serializes on demand dumps
+}
+
+// newMRTManager sets up dumping, an empty pattern disables that kind of dump
+func newMRTManager(server *gobgpServer.BgpServer, cfg Config) (*mrtManager, error) {
+	m := &mrtManager{
+		server:        server,
+		tableInterval: cfg.MRTTableInterval,
+		rotation:      cfg.MRTRotation,
+		retention:     cfg.MRTRetention,
+		maxFiles:      cfg.MRTMaxFiles,
+	}
+
+	var err error
+	if cfg.MRTUpdates != "" {
+		if m.updates, err = parseMRTPattern(cfg.MRTUpdates); err != nil {
+			return nil, err
+		}
+		err = server.EnableMrt(&config.MrtConfig{
+			DumpType:         config.MRT_TYPE_UPDATES,
+			FileName:         m.updates.layout,
+			RotationInterval: uint64(m.rotation.Seconds()),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MRTTable != "" {
+		if m.table, err = parseMRTPattern(cfg.MRTTable); err != nil {
+			return nil, err
+		}
+		// rotating on every dump gives each snapshot its own file
+		err = server.EnableMrt(&config.MrtConfig{
+			DumpType:         config.MRT_TYPE_TABLE,
+			FileName:         m.table.layout,
+			RotationInterval: uint64(m.tableInterval.Seconds()),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Run should be run as a go routine, prunes dumps past retention until done is closed
+func (m *mrtManager) Run(done chan bool) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, p := range []*mrtPattern{m.updates, m.table} {
+				if p == nil {
+					continue
+				}
+				if err := m.prune(p); err != nil {
+					log.Println("can't prune MRT dumps:", err)
+				}
+			}
+		}
+	}
+}
+
+// prune removes files of p older than the retention period, and the oldest ones beyond maxFiles
+func (m *mrtManager) prune(p *mrtPattern) error {
+	names, err := filepath.Glob(p.glob)
+	if err != nil {
+		return err
+	}
+
+	files := make([]os.FileInfo, 0, len(names))
+	paths := make(map[os.FileInfo]string)
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, fi)
+		paths[fi] = name
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+
+	for i, fi := range files {
+		expired := m.retention > 0 && time.Since(fi.ModTime()) > m.retention
+		excess := m.maxFiles > 0 && i >= m.maxFiles
+		if !expired && !excess {
+			continue
+		}
+		if err := os.Remove(paths[fi]); err != nil {
+			return err
+		}
+		log.Println("removed MRT dump", paths[fi])
+	}
+	return nil
+}
+
+// DumpNow writes a snapshot of the global RIB to a file named by the table pattern and returns its name
+func (m *mrtManager) DumpNow() (string, error) {
+	if m.table == nil {
+		return "", fmt.Errorf("MRT table dumps aren't configured")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w := m.server.Watch()
+	defer w.Stop()
+	if err := w.Generate(gobgpServer.WATCH_EVENT_TYPE_TABLE); err != nil {
+		return "", err
+	}
+
+	var ev *gobgpServer.WatchEventTable
+	timeout := time.After(30 * time.Second)
+	for ev == nil {
+		select {
+		case e := <-w.Event():
+			ev, _ = e.(*gobgpServer.WatchEventTable)
+		case <-timeout:
+			return "", fmt.Errorf("timed out waiting for the RIB")
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range mrtTableMessages(ev, m.server.GetServer().Config.RouterId) {
+		b, err := msg.Serialize()
+		if err != nil {
+			return "", err
+		}
+		buf.Write(b)
+	}
+
+	name := time.Now().Format(m.table.layout)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return "", err
+	}
+	log.Println("dumped RIB to", name)
+	return name, f.Close()
+}
+
+// mrtTableMessages renders a table event as TABLE_DUMPv2, the same way gobgp's own table dumps do
+func mrtTableMessages(ev *gobgpServer.WatchEventTable, routerID string) []*mrt.MRTMessage {
+	t := uint32(time.Now().Unix())
+	msgs := make([]*mrt.MRTMessage, 0, len(ev.PathList)+1)
+
+	// peer 0 stands for locally originated routes
+	peers := []*mrt.Peer{mrt.NewPeer("0.0.0.0", "0.0.0.0", 0, true)}
+	index := make(map[string]uint16)
+	for _, n := range ev.Neighbor {
+		index[n.State.NeighborAddress] = uint16(len(peers))
+		peers = append(peers, mrt.NewPeer(n.State.RemoteRouterId, n.State.NeighborAddress, n.Config.PeerAs, true))
+	}
+	if msg, err := mrt.NewMRTMessage(t, mrt.TABLE_DUMPv2, mrt.PEER_INDEX_TABLE, mrt.NewPeerIndexTable(routerID, "", peers)); err == nil {
+		msgs = append(msgs, msg)
+	}
+
+	prefixes := make([]string, 0, len(ev.PathList))
+	for prefix := range ev.PathList {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	seq := uint32(0)
+	for _, prefix := range prefixes {
+		paths := ev.PathList[prefix]
+		entries := make([]*mrt.RibEntry, 0, len(paths))
+		for _, path := range paths {
+			i := uint16(0)
+			if !path.IsLocal() {
+				i = index[path.GetSource().Address.String()]
+			}
+			entries = append(entries, mrt.NewRibEntry(i, uint32(path.GetTimestamp().Unix()), 0, path.GetPathAttrs(), false))
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		subtype := mrt.RIB_GENERIC
+		switch paths[0].GetRouteFamily() {
+		case bgp.RF_IPv4_UC:
+			subtype = mrt.RIB_IPV4_UNICAST
+		case bgp.RF_IPv6_UC:
+			subtype = mrt.RIB_IPV6_UNICAST
+		}
+		if msg, err := mrt.NewMRTMessage(t, mrt.TABLE_DUMPv2, subtype, mrt.NewRib(seq, paths[0].GetNlri(), entries)); err == nil {
+			msgs = append(msgs, msg)
+			seq++
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/mrt"
+	"github.com/osrg/gobgp/table"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+func TestParseMRTPattern(t *testing.T) {
+	for pattern, want := range map[string]mrtPattern{
+		"/var/lib/mrt/updates.%Y%m%d.%H%M": {layout: "/var/lib/mrt/updates.20060102.1504", glob: "/var/lib/mrt/updates.***.**"},
+		"rib-%y%m%d%H%M%S.mrt":             {layout: "rib-060102150405.mrt", glob: "rib-******.mrt"},
+		"rib%%.%H":                         {layout: "rib%.15", glob: "rib%.*"},
+		"rib.mrt":                          {layout: "rib.mrt", glob: "rib.mrt"},
+	} {
+		if got, err := parseMRTPattern(pattern); err != nil || *got != want {
+			t.Errorf("%s parsed as %+v, %v, want %+v", pattern, got, err, want)
+		}
+	}
+	for _, bad := range []string{"rib.%j", "rib.%", "rib-Jan-%d", "/var/lib/mrt1/rib.%H", "rib.%H.2"} {
+		if _, err := parseMRTPattern(bad); err == nil {
+			t.Errorf("parsed %s", bad)
+		}
+	}
+}
+
+// inMRTDir runs the test from a temporary directory, patterns are relative as its name has digits
+func inMRTDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-mrt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMRTPrune(t *testing.T) {
+	dir, cleanup := inMRTDir(t)
+	defer cleanup()
+	p, err := parseMRTPattern("rib.%H%M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"rib.0100":  3 * time.Hour,
+		"rib.0200":  2 * time.Hour,
+		"rib.0230":  30 * time.Minute,
+		"rib.0240":  20 * time.Minute,
+		"rib.0250":  10 * time.Minute,
+		"other.mrt": 3 * time.Hour, // not one of the pattern's
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// directories are left alone
+	if err := os.Mkdir(filepath.Join(dir, "rib.0000"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	left := func() string {
+		names, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for i := range names {
+			names[i] = filepath.Base(names[i])
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	m := &mrtManager{retention: time.Hour}
+	if err := m.prune(p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := left(), "other.mrt rib.0000 rib.0230 rib.0240 rib.0250"; got != want {
+		t.Errorf("past retention left %s, want %s", got, want)
+	}
+	m.maxFiles = 2
+	if err := m.prune(p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := left(), "other.mrt rib.0000 rib.0240 rib.0250"; got != want {
+		t.Errorf("beyond the maximum left %s, want %s", got, want)
+	}
+}
+
+func TestMRTDumpNow(t *testing.T) {
+	_, cleanup := inMRTDir(t)
+	defer cleanup()
+
+	if _, err := (&mrtManager{}).DumpNow(); err == nil {
+		t.Error("dumped without a table pattern")
+	}
+
+	// left running, like the test router, see testHarness.Close
+	s := gobgpServer.NewBgpServer()
+	go s.Serve()
+	if err := s.Start(&config.Global{Config: config.GlobalConfig{As: 65000, RouterId: "10.99.0.2", Port: -1}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gobgpPath("192.0.2.1/32", &route{NextHop: "10.99.0.2"}, 65000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddPath("", []*table.Path{r}); err != nil {
+		t.Fatal(err)
+	}
+	receivePath(t, s, "10.0.0.1", "203.0.113.0/24", 65530)
+
+	p, err := parseMRTPattern("snapshots/rib.%Y%m%d%H%M%S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := (&mrtManager{server: s, table: p}).DumpNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched, _ := filepath.Match(p.glob, name); !matched {
+		t.Errorf("dumped to %s, want a file matching %s", name, p.glob)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Split(mrt.SplitMrt)
+	var prefixes []string
+	for scanner.Scan() {
+		h := &mrt.MRTHeader{}
+		if err := h.DecodeFromBytes(scanner.Bytes()[:mrt.MRT_COMMON_HEADER_LEN]); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := mrt.ParseMRTBody(h, scanner.Bytes()[mrt.MRT_COMMON_HEADER_LEN:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch body := msg.Body.(type) {
+		case *mrt.PeerIndexTable:
+			if !body.CollectorBgpId.Equal(net.ParseIP("10.99.0.2")) {
+				t.Errorf("peer index table has collector %s, want the router ID", body.CollectorBgpId)
+			}
+		case *mrt.Rib:
+			prefixes = append(prefixes, body.Prefix.String())
+			if len(body.Entries) != 1 || len(body.Entries[0].PathAttributes) == 0 {
+				t.Errorf("%s has entries %v, want one with the path's attributes", body.Prefix, body.Entries)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(prefixes, " "), "192.0.2.1/32 203.0.113.0/24"; got != want {
+		t.Errorf("dumped %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// getNetns opens a network namespace by name (as created by `ip netns add`) or by path
+func getNetns(name string) (netns.NsHandle, error) {
+	if strings.HasPrefix(name, "/") {
+		return netns.GetFromPath(name)
+	}
+	return netns.GetFromName(name)
+}
+
+// enterNetns moves the whole agent, and so the BGP speaker, into the named namespace. Namespaces are
+// per thread, so the only way to reliably move every goroutine is to exec ourselves again from a thread
+// already inside it. Must be called before any other goroutines are started
+func enterNetns(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	target, err := getNetns(name)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	current, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer current.Close()
+
+	if current.Equal(target) {
+		return nil
+	}
+
+	runtime.LockOSThread()
+	if err := netns.Set(target); err != nil {
+		return err
+	}
+	log.Println("re-executing in network namespace", name)
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
+
+// inNetns runs fn on a thread switched into the named namespace, or directly if name is empty
+func inNetns(name string, fn func() error) error {
+	if name == "" {
+		return fn()
+	}
+
+	target, err := getNetns(name)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+
+	if err := netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+
+	err = fn()
+	if restoreErr := netns.Set(origin); restoreErr != nil {
+		// keep the thread locked so it never runs other goroutines in the wrong namespace
+		return restoreErr
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// netlinkHandle returns a netlink handle operating in the named namespace, or the current one if name is empty
+func netlinkHandle(name string) (*netlink.Handle, error) {
+	if name == "" {
+		return netlink.NewHandle()
+	}
+
+	ns, err := getNetns(name)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	return netlink.NewHandleAt(ns)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// testNetns creates a network namespace bound to a file, like `ip netns add` does, and returns its path.
+// The test is skipped without the privileges for that
+func testNetns(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skip("can't create a network namespace, needs CAP_SYS_ADMIN:", err)
+	}
+	defer ns.Close()
+	self := fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid())
+	err = syscall.Mount(self, path, "none", syscall.MS_BIND, "")
+	if restoreErr := netns.Set(origin); restoreErr != nil {
+		t.Fatal(restoreErr)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skip("can't bind a network namespace, needs CAP_SYS_ADMIN:", err)
+	}
+
+	return path, func() {
+		syscall.Unmount(path, syscall.MNT_DETACH)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInNetns(t *testing.T) {
+	path, cleanup := testNetns(t)
+	defer cleanup()
+	target, err := getNetns(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	var inside bool
+	var links []netlink.Link
+	err = inNetns(path, func() error {
+		current, err := netns.Get()
+		if err != nil {
+			return err
+		}
+		defer current.Close()
+		inside = current.Equal(target)
+		links, err = netlink.LinkList()
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inside {
+		t.Error("fn didn't run in the namespace")
+	}
+	if len(links) != 1 || links[0].Attrs().Name != "lo" {
+		t.Errorf("the new namespace has links %v, want only lo", links)
+	}
+
+	// the thread fn ran on is back where it was
+	runtime.LockOSThread()
+	current, err := netns.Get()
+	runtime.UnlockOSThread()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+	if current.Equal(target) {
+		t.Error("left the thread in the namespace")
+	}
+
+	h, err := netlinkHandle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Delete()
+	if links, err := h.LinkList(); err != nil || len(links) != 1 {
+		t.Errorf("the handle lists links %v, %v, want only lo", links, err)
+	}
+
+	ran := false
+	if err := inNetns(filepath.Join(filepath.Dir(path), "missing"), func() error { ran = true; return nil }); err == nil || ran {
+		t.Errorf("a missing namespace returned %v, ran fn: %v", err, ran)
+	}
+}
+
+// TestEnterNetnsProcess is the process TestEnterNetns re-executes, it prints the namespace it ends up in
+func TestEnterNetnsProcess(t *testing.T) {
+	path := os.Getenv("PACKET_BGP_AGENT_TEST_NETNS")
+	if path == "" {
+		return
+	}
+	if err := enterNetns(path); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	current, err := netns.Get()
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("namespace:", current.UniqueId())
+	os.Exit(0)
+}
+
+func TestEnterNetns(t *testing.T) {
+	path, cleanup := testNetns(t)
+	defer cleanup()
+	target, err := getNetns(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestEnterNetnsProcess$")
+	cmd.Env = append(os.Environ(), "PACKET_BGP_AGENT_TEST_NETNS="+path)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	// the re-executed process finds itself in the namespace already and carries on
+	if want := "namespace: " + target.UniqueId(); !strings.Contains(string(out), want) {
+		t.Errorf("re-executed process printed %q, want %q", out, want)
+	}
+
+	if err := enterNetns(""); err != nil {
+		t.Errorf("staying in the current namespace failed: %v", err)
+	}
+}
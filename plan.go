@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/osrg/gobgp/packet/bgp"
+	"google.golang.org/grpc"
+
+	gobgpApi "github.com/osrg/gobgp/api"
+)
+
+type planAction string
+
+const (
+	actionWithdraw      planAction = "withdraw"
+	actionRemoveAddress planAction = "remove-address"
+	actionAddAddress    planAction = "add-address"
+	actionAnnounce      planAction = "announce"
+)
+
+// route is what gets announced for a prefix
+type route struct {
+	NextHop     string   `json:"next_hop"`
+	ECMP        []string `json:"ecmp,omitempty"`        // further next hops, each announced as a path of its own
+	Communities []string `json:"communities,omitempty"` // standard communities, e.g. "65535:0"
+	Prepend     int      `json:"prepend,omitempty"`     // extra copies of the agent's ASN on the AS path
+	MED         uint32   `json:"med,omitempty"`         // 0 sends no MED
+	// Aggregator is the address sent in AGGREGATOR, along with ATOMIC_AGGREGATE, when the route is an
+	// aggregate
+	Aggregator string `json:"aggregator,omitempty"`
+}
+
+// nextHops lists NextHop and the ECMP next hops
+func (r *route) nextHops() []string {
+	return append([]string{r.NextHop}, r.ECMP...)
+}
+
+// attrs describes the route's attributes besides the next hop, e.g. " med 100 community 65535:0 prepend 3
+// aggregator 10.80.1.3"
+func (r *route) attrs() string {
+	s := ""
+	if r.MED > 0 {
+		s += fmt.Sprintf(" med %d", r.MED)
+	}
+	for _, c := range r.Communities {
+		s += " community " + c
+	}
+	if r.Prepend > 0 {
+		s += fmt.Sprintf(" prepend %d", r.Prepend)
+	}
+	if r.Aggregator != "" {
+		s += " aggregator " + r.Aggregator
+	}
+	return s
+}
+
+// parseCommunity reads a standard community written as "asn:value"
+func parseCommunity(s string) (uint32, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid community %q", s)
+	}
+	asn, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q", s)
+	}
+	value, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q", s)
+	}
+	return uint32(asn<<16 | value), nil
+}
+
+func formatCommunity(c uint32) string {
+	return fmt.Sprintf("%d:%d", c>>16, c&0xffff)
+}
+
+// planChange is a single step from the applied state towards the desired one
+type planChange struct {
+	Action planAction `json:"action"`
+	Prefix string     `json:"prefix"`
+	Link   string     `json:"link,omitempty"`
+	Route  *route     `json:"route,omitempty"`
+}
+
+func (c planChange) String() string {
+	switch c.Action {
+	case actionWithdraw:
+		return fmt.Sprintf("- withdraw %s", c.Prefix)
+	case actionRemoveAddress:
+		return fmt.Sprintf("- address %s on %s", c.Prefix, c.Link)
+	case actionAddAddress:
+		return fmt.Sprintf("+ address %s on %s", c.Prefix, c.Link)
+	case actionAnnounce:
+		return fmt.Sprintf("+ announce %s next-hop %s%s", c.Prefix, strings.Join(c.Route.nextHops(), ","), c.Route.attrs())
+	}
+	return fmt.Sprintf("? %s %s", c.Action, c.Prefix)
+}
+
+// routeFor returns what should be announced for a desired prefix, agent.mu must be held
+func (agent *PacketBGPAgent) routeFor(announcement Announcement) *route {
+	r := &route{NextHop: agent.PrivateIP.Address.String()}
+	if len(announcement.NextHops) > 0 {
+		r.NextHop = announcement.NextHops[0]
+		r.ECMP = append([]string(nil), announcement.NextHops[1:]...)
+	}
+	if len(announcement.Aggregates) > 0 {
+		r.Aggregator = agent.PrivateIP.Address.String()
+	}
+	r = agent.drained(agent.shedding(agent.profiled(r)))
+	return agent.blackholed(announcement.Prefix, r)
+}
+
+// plan works out the changes that take the applied state in announcementTable to the desired state,
+// without touching anything. Withdrawals and removals come before additions. agent.mu must be held
+func (agent *PacketBGPAgent) plan() []planChange {
+	agent.errors = make(map[string]string)
+	changes := make([]planChange, 0)
+
+	desired := make(map[string]Announcement)
+	links := make(map[string]string)
+	for _, announcement := range agent.Announcements {
+		desired[announcement.Prefix] = announcement
+		link, err := agent.VIPLinks.NameFor(announcement.Group)
+		if err != nil {
+			agent.errors[announcement.Prefix] = err.Error()
+			continue
+		}
+		links[announcement.Prefix] = link
+	}
+
+	applied := make([]string, 0, len(agent.announcementTable))
+	for prefix := range agent.announcementTable {
+		applied = append(applied, prefix)
+	}
+	sort.Strings(applied)
+
+	for _, prefix := range applied {
+		ann := agent.announcementTable[prefix]
+		_, want := desired[prefix]
+		link, placeable := links[prefix]
+
+		if ann.route != nil && !(want && placeable && agent.announcing(prefix)) && !agent.blackholing(prefix) {
+			changes = append(changes, planChange{Action: actionWithdraw, Prefix: prefix})
+		}
+		if ann.link == "" {
+			continue
+		}
+		if !want || (placeable && link != ann.link) { // no longer desired, or its group moved
+			changes = append(changes, planChange{Action: actionRemoveAddress, Prefix: prefix, Link: ann.link})
+		}
+	}
+
+	for _, announcement := range agent.Announcements {
+		prefix := announcement.Prefix
+		link, placeable := links[prefix]
+		if _, held := agent.held[prefix]; held || !placeable {
+			continue
+		}
+
+		ann, ok := agent.announcementTable[prefix]
+		if !ok || ann.link != link {
+			changes = append(changes, planChange{Action: actionAddAddress, Prefix: prefix, Link: link})
+		}
+
+		if !agent.announcing(prefix) && !agent.blackholing(prefix) {
+			continue
+		}
+		r := agent.routeFor(announcement)
+		if !ok || ann.route == nil || !reflect.DeepEqual(ann.route, r) {
+			changes = append(changes, planChange{Action: actionAnnounce, Prefix: prefix, Route: r})
+		}
+	}
+
+	// blackholes of prefixes that aren't announced along with their address above
+	if agent.Mitigations != nil {
+		for _, prefix := range agent.Mitigations.blackholes() {
+			_, want := desired[prefix]
+			_, placeable := links[prefix]
+			_, held := agent.held[prefix]
+			if (want && placeable && !held) || !agent.blackholing(prefix) {
+				continue
+			}
+			r := agent.blackholed(prefix, &route{NextHop: agent.PrivateIP.Address.String()})
+			if ann, ok := agent.announcementTable[prefix]; !ok || ann.route == nil || !reflect.DeepEqual(ann.route, r) {
+				changes = append(changes, planChange{Action: actionAnnounce, Prefix: prefix, Route: r})
+			}
+		}
+	}
+
+	return changes
+}
+
+// apply carries out a plan, updating announcementTable as it goes. A failing change is recorded against
+// its prefix and the rest of the plan still applied, the first error is returned. agent.mu must be held
+func (agent *PacketBGPAgent) apply(changes []planChange) error {
+	var firstErr error
+	for _, change := range changes {
+		if _, failed := agent.errors[change.Prefix]; failed {
+			continue
+		}
+		if err := agent.applyChange(change); err != nil {
+			err = fmt.Errorf("can't %s %s: %s", change.Action, change.Prefix, err)
+			agent.errors[change.Prefix] = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (agent *PacketBGPAgent) applyChange(change planChange) error {
+	ann, ok := agent.announcementTable[change.Prefix]
+	if !ok {
+		ann = &announced{}
+	}
+
+	_, ipnet, err := net.ParseCIDR(change.Prefix)
+	if err != nil {
+		return err
+	}
+
+	switch change.Action {
+	case actionWithdraw:
+		if err := agent.Speaker.Withdraw(change.Prefix); err != nil {
+			return err
+		}
+		ann.route = nil
+		if ann.link == "" {
+			delete(agent.announcementTable, change.Prefix)
+			return nil
+		}
+
+	case actionRemoveAddress:
+		if err := agent.VIPLinks.DelAddr(change.Link, ipnet); err != nil {
+			return err
+		}
+		ann.link = ""
+		if ann.route == nil {
+			delete(agent.announcementTable, change.Prefix)
+			return nil
+		}
+
+	case actionAddAddress:
+		if err := agent.VIPLinks.Ensure(change.Link); err != nil {
+			return err
+		}
+		if err := agent.VIPLinks.AddAddr(change.Link, ipnet); err != nil {
+			return err
+		}
+		ann.link = change.Link
+
+	case actionAnnounce:
+		if err := agent.Speaker.Announce(change.Prefix, change.Route); err != nil {
+			return err
+		}
+		ann.route = change.Route
+	}
+
+	agent.announcementTable[change.Prefix] = ann
+	return nil
+}
+
+// Plan returns the changes the last reconcile planned, in dry run mode these are still outstanding
+func (agent *PacketBGPAgent) Plan() []planChange {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	return agent.lastPlan
+}
+
+// runPlan prints the changes an agent with cfg would make to this host, compared to what is live right
+// now: the addresses recorded in the state file that are still in place, and whatever the embedded
+// gobgp of a running agent announces. Persistent speakers are taken to announce what the state file says
+func runPlan(cfg Config) error {
+	client := newMetadataClient(cfg.HegelAddr, cfg.HegelInsecure, cfg.MetadataURL)
+	device, err := client.Device()
+	if err != nil {
+		return err
+	}
+	privateIP, err := getPrivateIP(device)
+	if err != nil {
+		return err
+	}
+
+	md, err := client.Get()
+	if err != nil {
+		return err
+	}
+	profile, err := selectProfile(md.Instance, cfg.FacilityProfiles, cfg.Profile)
+	if err != nil {
+		return err
+	}
+	drain, err := parseDrain(md.Instance, cfg.DrainPolicy)
+	if err != nil {
+		return err
+	}
+
+	announcements := []Announcement{}
+	if v, ok := md.Instance.CustomData["BGP_ANNOUNCE"]; ok {
+		if announcements, err = parseAnnouncements(v); err != nil {
+			return err
+		}
+	}
+
+	host, vipHost, err := newHostNetworks(cfg.VIPNetns)
+	if err != nil {
+		return err
+	}
+	links := newVIPLinks(vipHost, cfg.VIPInterface, cfg.InterfacePerGroup)
+
+	cfg.DryRun = true // the mesh is only looked at
+	agent := &PacketBGPAgent{
+		Announcements:     announcements,
+		PrivateIP:         privateIP,
+		Config:            cfg,
+		Host:              host,
+		VIPLinks:          links,
+		announcementTable: make(map[string]*announced),
+		uplinkUp:          true,
+		held:              make(map[string]string),
+		errors:            make(map[string]string),
+		source:            sourceMetadata,
+		drain:             drain,
+		hostSchedules:     cfg.Schedules,
+		schedules:         make(map[string]scheduleStatus),
+		scheduleOverrides: make(map[string]scheduleOverride),
+	}
+	if _, err := agent.setProfile(profile); err != nil {
+		return err
+	}
+	if v, ok := md.Instance.CustomData["BGP_SCHEDULE"]; ok {
+		if agent.hostSchedules, err = parseSchedules(v); err != nil {
+			return err
+		}
+	}
+	if cfg.Uplink != "" {
+		agent.uplinkUp, _ = uplinkState(host, cfg.Uplink)
+	}
+
+	if cfg.StateFile != "" {
+		state, err := newStateStore(cfg.StateFile).Load()
+		if err != nil {
+			return err
+		}
+		for prefix, status := range state.Prefixes {
+			_, ipnet, err := net.ParseCIDR(prefix)
+			if err != nil || status.Link == "" {
+				continue
+			}
+			if placed, err := links.HasAddr(status.Link, ipnet); err == nil && placed {
+				agent.announcementTable[prefix] = &announced{link: status.Link}
+			}
+		}
+	}
+
+	routes := make(map[string]*route)
+	if cfg.Speaker == speakerGobgp {
+		// evaluate against what the running agent received, or what an agent that was just started has
+		agent.RIB = emptyRIB{}
+		conn, err := dialGobgp(dialAddr(cfg.GRPCAddr))
+		if err != nil {
+			log.Println("can't reach a running agent, assuming nothing is announced or received:", err)
+		} else {
+			defer conn.Close()
+			client := gobgpApi.NewGobgpApiClient(conn)
+			agent.RIB = apiRIB{client}
+			if routes, err = liveRoutes(client); err != nil {
+				log.Println("can't read what the running agent announces, assuming nothing is:", err)
+			}
+		}
+
+		if len(cfg.RPKICaches) > 0 {
+			asn, err := strconv.ParseUint(cfg.ASN, 10, 32)
+			if err != nil {
+				return err
+			}
+			if agent.RPKI, err = newRPKIValidator(agent.RIB, uint32(asn), cfg.RPKIPolicy); err != nil {
+				return err
+			}
+		}
+		if agent.Mesh, err = lookAtMesh(agent.RIB, member{ID: device.ID, Address: privateIP.Address.String()}, cfg); err != nil {
+			return err
+		}
+	} else if cfg.StateFile != "" {
+		state, err := newStateStore(cfg.StateFile).Load()
+		if err != nil {
+			return err
+		}
+		for prefix, status := range state.Prefixes {
+			if status.Route != nil {
+				routes[prefix] = status.Route
+			}
+		}
+	}
+	for prefix, r := range routes {
+		ann, ok := agent.announcementTable[prefix]
+		if !ok {
+			ann = &announced{}
+			agent.announcementTable[prefix] = ann
+		}
+		ann.route = r
+	}
+
+	agent.evaluate(time.Now())
+	plan := agent.plan()
+	for prefix, err := range agent.errors {
+		fmt.Println("!", prefix, err)
+	}
+	if len(plan) == 0 {
+		fmt.Println("no changes")
+	}
+	for _, change := range plan {
+		fmt.Println(change)
+	}
+	return nil
+}
+
+// dialGobgp connects to the gobgp API on addr
+func dialGobgp(addr string) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+}
+
+// liveRoutes asks the gobgp API for the paths it originates
+func liveRoutes(client gobgpApi.GobgpApiClient) (map[string]*route, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	routes := make(map[string]*route)
+	for _, family := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+		res, err := client.GetRib(ctx, &gobgpApi.GetRibRequest{
+			Table: &gobgpApi.Table{Type: gobgpApi.Resource_GLOBAL, Family: uint32(family)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, dst := range res.Table.Destinations {
+			for _, p := range dst.Paths {
+				path, err := p.ToNativePath()
+				if err != nil || !path.IsLocal() {
+					continue
+				}
+				// further paths of the prefix carry its ECMP next hops
+				if r, ok := routes[dst.Prefix]; ok {
+					r.ECMP = append(r.ECMP, path.GetNexthop().String())
+					continue
+				}
+				r := &route{NextHop: path.GetNexthop().String(), Prepend: path.GetAsPathLen()}
+				r.MED, _ = path.GetMed()
+				for _, c := range path.GetCommunities() {
+					r.Communities = append(r.Communities, formatCommunity(c))
+				}
+				for _, a := range path.GetPathAttrs() {
+					if aggregator, ok := a.(*bgp.PathAttributeAggregator); ok {
+						r.Aggregator = aggregator.Value.Address.String()
+					}
+				}
+				routes[dst.Prefix] = r
+			}
+		}
+	}
+	return routes, nil
+}
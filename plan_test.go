@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+	"github.com/packethost/packngo/metadata"
+)
+
+// fakeSpeaker records what it's told to announce
+type fakeSpeaker struct {
+	persistent bool
+	routes     map[string]*route
+	ops        []string
+	failures   map[string]error
+	mu         sync.Mutex
+}
+
+func newFakeSpeaker(persistent bool) *fakeSpeaker {
+	return &fakeSpeaker{
+		persistent: persistent,
+		routes:     make(map[string]*route),
+		failures:   make(map[string]error),
+	}
+}
+
+func (s *fakeSpeaker) Start(asn uint32, routerID string) error                    { return nil }
+func (s *fakeSpeaker) AddNeighbor(address string, peerAS uint32, pw string) error { return nil }
+func (s *fakeSpeaker) Persistent() bool                                           { return s.persistent }
+func (s *fakeSpeaker) SessionState() (string, error)                              { return "established", nil }
+
+func (s *fakeSpeaker) Announce(prefix string, r *route) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, "announce "+prefix)
+	if err := s.failures[prefix]; err != nil {
+		return err
+	}
+	s.routes[prefix] = r
+	return nil
+}
+
+func (s *fakeSpeaker) Withdraw(prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, "withdraw "+prefix)
+	delete(s.routes, prefix)
+	return nil
+}
+
+// Ops returns what the speaker was told so far and forgets it
+func (s *fakeSpeaker) Ops() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops := s.ops
+	s.ops = nil
+	return ops
+}
+
+// announced returns the prefixes currently announced, sorted
+func (s *fakeSpeaker) announced() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefixes := make([]string, 0, len(s.routes))
+	for prefix := range s.routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// newTestAgent returns an agent using sp and n that hasn't applied anything yet
+func newTestAgent(cfg Config, sp speaker, n *fakeNetwork) *PacketBGPAgent {
+	if cfg.VIPInterface == "" {
+		cfg.VIPInterface = "lo"
+	}
+	if cfg.VIPRemovedPolicy == "" {
+		cfg.VIPRemovedPolicy = vipRemovedRestore
+	}
+	if cfg.DrainPolicy == "" {
+		cfg.DrainPolicy = drainGracefulShutdown
+	}
+	if cfg.Profiles == nil {
+		cfg.Profiles, _ = parseProfiles(splitList(defaultProfiles))
+		cfg.Profile = profilePrimary
+	}
+	return &PacketBGPAgent{
+		Speaker:           sp,
+		Announcements:     []Announcement{},
+		PrivateIP:         &metadata.AddressInfo{Address: net.ParseIP(testPrivateIP), Gateway: net.ParseIP(testGateway)},
+		Config:            cfg,
+		Host:              n,
+		VIPLinks:          newVIPLinks(n, cfg.VIPInterface, cfg.InterfacePerGroup),
+		announcementTable: make(map[string]*announced),
+		uplinkUp:          true,
+		held:              make(map[string]string),
+		errors:            make(map[string]string),
+		rpkiStates:        make(map[string]string),
+		unmet:             make(map[string]string),
+		schedules:         make(map[string]scheduleStatus),
+		scheduleOverrides: make(map[string]scheduleOverride),
+		source:            sourceMetadata,
+		lastGood:          []Announcement{},
+		profile:           cfg.Profile,
+	}
+}
+
+// desire reconciles towards the given announcements
+func desire(agent *PacketBGPAgent, announcements ...Announcement) error {
+	agent.mu.Lock()
+	agent.Announcements = announcements
+	agent.mu.Unlock()
+	return agent.EnsureBGP()
+}
+
+func expectOps(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s did %q, want %q", what, got, want)
+	}
+}
+
+// eventually polls cond for a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for", what)
+}
+
+func TestReconcile(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{}, sp, n)
+
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}, Announcement{Prefix: "198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops(), "addr-replace lo 192.0.2.1/32", "addr-replace lo 198.51.100.0/24")
+	expectOps(t, "speaker", sp.Ops(), "announce 192.0.2.1/32", "announce 198.51.100.0/24")
+	if r := sp.routes["192.0.2.1/32"]; r == nil || r.NextHop != testPrivateIP {
+		t.Errorf("192.0.2.1/32 announced with %+v, want next hop %s", r, testPrivateIP)
+	}
+
+	// nothing to do the second time round
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops())
+	expectOps(t, "speaker", sp.Ops())
+
+	// the removed prefix is withdrawn before its address goes
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}, Announcement{Prefix: "203.0.113.7/32"}); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops(), "addr-del lo 198.51.100.0/24", "addr-replace lo 203.0.113.7/32")
+	expectOps(t, "speaker", sp.Ops(), "withdraw 198.51.100.0/24", "announce 203.0.113.7/32")
+	if got, want := fmt.Sprint(n.placed("lo")), "[192.0.2.1/32 203.0.113.7/32]"; got != want {
+		t.Errorf("addresses on lo are %s, want %s", got, want)
+	}
+}
+
+func TestReconcileFailure(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{}, sp, n)
+
+	n.fail("addr-replace lo 192.0.2.1/32", errors.New("injected"))
+	err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}, Announcement{Prefix: "198.51.100.0/24"})
+	if err == nil {
+		t.Fatal("reconcile succeeded despite a failing address")
+	}
+	// the failing prefix isn't announced without its address, the other one carries on
+	if got, want := fmt.Sprint(sp.announced()), "[198.51.100.0/24]"; got != want {
+		t.Errorf("announced %s, want %s", got, want)
+	}
+	status := agent.Status().Prefixes["192.0.2.1/32"]
+	if status.Health != healthError {
+		t.Errorf("failed prefix has health %s, want %s", status.Health, healthError)
+	}
+	if !reflect.DeepEqual(agent.lastGood, []Announcement{}) {
+		t.Errorf("a failed reconcile became the last good set: %v", agent.lastGood)
+	}
+
+	n.fail("addr-replace lo 192.0.2.1/32", nil)
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(sp.announced()), "[192.0.2.1/32 198.51.100.0/24]"; got != want {
+		t.Errorf("announced %s after recovering, want %s", got, want)
+	}
+}
+
+func TestStopWithdrawsFromPersistentSpeaker(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		n, sp := newFakeNetwork(), newFakeSpeaker(persistent)
+		agent := newTestAgent(Config{}, sp, n)
+		if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}); err != nil {
+			t.Fatal(err)
+		}
+		sp.Ops()
+
+		agent.Stop()
+		if persistent {
+			expectOps(t, "persistent speaker", sp.Ops(), "withdraw 192.0.2.1/32")
+		} else {
+			expectOps(t, "embedded speaker", sp.Ops())
+		}
+	}
+}
+
+func TestParseNextHops(t *testing.T) {
+	anns, err := parseAnnouncements([]interface{}{
+		map[string]interface{}{"prefix": "192.0.2.1/32", "next_hop": "10.99.0.5"},
+		map[string]interface{}{"prefix": "2001:db8::1/128", "next_hop": []interface{}{"2001:db8:1::5", "2001:DB8:1::6"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(anns[0].NextHops, anns[1].NextHops), "[10.99.0.5] [2001:db8:1::5 2001:db8:1::6]"; got != want {
+		t.Errorf("next hops are %s, want %s", got, want)
+	}
+
+	for _, invalid := range []interface{}{
+		map[string]interface{}{"prefix": "192.0.2.1/32", "next_hop": "not an address"},
+		map[string]interface{}{"prefix": "192.0.2.1/32", "next_hop": "2001:db8:1::5"},
+		map[string]interface{}{"prefix": "192.0.2.1/32", "next_hop": []interface{}{"10.99.0.5", "10.99.0.5"}},
+		map[string]interface{}{"prefix": "192.0.2.1/32", "next_hop": 5},
+	} {
+		if ann, err := parseAnnouncement(invalid); err == nil {
+			t.Errorf("accepted %v as %+v", invalid, ann)
+		}
+	}
+}
+
+func TestNextHops(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{}, sp, n)
+
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32", NextHops: nextHops{"10.99.0.5", "10.99.0.6"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := &route{NextHop: "10.99.0.5", ECMP: []string{"10.99.0.6"}}
+	if r := sp.routes["192.0.2.1/32"]; !reflect.DeepEqual(r, want) {
+		t.Errorf("announced %+v, want %+v", r, want)
+	}
+	if got, want := agent.Plan()[1].String(), "+ announce 192.0.2.1/32 next-hop 10.99.0.5,10.99.0.6"; got != want {
+		t.Errorf("planned %q, want %q", got, want)
+	}
+	sp.Ops()
+
+	// back to the agent's own address in place
+	if err := desire(agent, Announcement{Prefix: "192.0.2.1/32"}); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "speaker", sp.Ops(), "announce 192.0.2.1/32")
+	if r := sp.routes["192.0.2.1/32"]; r.NextHop != testPrivateIP || r.ECMP != nil {
+		t.Errorf("announced %+v, want next hop %s only", r, testPrivateIP)
+	}
+}
+
+// fakeRIB has what neighbors sent, by neighbor, and ROAs from a connected cache
+type fakeRIB struct {
+	received map[string][]*table.Path
+	roas     []*table.ROA
+}
+
+func (r *fakeRIB) Received(neighbor string, family bgp.RouteFamily, prefix string) ([]*table.Path, error) {
+	var paths []*table.Path
+	for _, path := range r.received[neighbor] {
+		if path.GetRouteFamily() == family && (prefix == "" || path.GetNlri().String() == prefix) {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (r *fakeRIB) ROAs(family bgp.RouteFamily) ([]*table.ROA, error) {
+	var roas []*table.ROA
+	for _, roa := range r.roas {
+		if (roa.Family == bgp.AFI_IP) == (family == bgp.RF_IPv4_UC) {
+			roas = append(roas, roa)
+		}
+	}
+	return roas, nil
+}
+
+func (r *fakeRIB) RTRCaches() ([]rpkiCacheStatus, error) {
+	return []rpkiCacheStatus{{Address: "127.0.0.1:8282", Up: true, ROAs: uint32(len(r.roas))}}, nil
+}
+
+// plannedAnnouncements returns the prefixes plan announces
+func plannedAnnouncements(plan []planChange) []string {
+	var prefixes []string
+	for _, change := range plan {
+		if change.Action == actionAnnounce {
+			prefixes = append(prefixes, change.Prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+func TestEvaluateBeforePlan(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{}, sp, n)
+
+	peer, err := (&mesh{self: member{"dev-b", "10.0.0.9"}}).path("2001:db8::/48", meshAnnounced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rib := &fakeRIB{
+		received: map[string][]*table.Path{
+			testGateway: {table.NewPath(nil, bgp.NewIPAddrPrefix(10, "100.64.0.0"), false, []bgp.PathAttributeInterface{bgp.NewPathAttributeOrigin(0)}, time.Now(), false)},
+			"10.0.0.9":  {peer},
+		},
+		roas: []*table.ROA{
+			table.NewROA(bgp.AFI_IP, net.ParseIP("192.0.2.0").To4(), 24, 24, 65000, ""),
+			table.NewROA(bgp.AFI_IP, net.ParseIP("198.51.100.0").To4(), 24, 24, 64999, ""),
+		},
+	}
+	agent.RIB = rib
+	if agent.RPKI, err = newRPKIValidator(rib, 65000, rpkiPolicyWithholdInvalid); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{MeshDiscovery: discoveryStatic, MeshPeers: []string{"dev-b=10.0.0.9"}}
+	if agent.Mesh, err = lookAtMesh(rib, member{"dev-a", testPrivateIP}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	agent.Config.DryRun = true
+
+	agent.Announcements = []Announcement{
+		{Prefix: "192.0.2.0/24"},
+		{Prefix: "198.51.100.0/24"}, // RPKI invalid
+		{Prefix: "203.0.113.0/24", When: &advertiseCondition{Absent: "100.64.0.0/10"}},
+		{Prefix: "2001:db8::/48", Quorum: &quorum{Min: 3}}, // only dev-a and dev-b
+		{Prefix: "2001:db8:1::/48"},
+	}
+	agent.evaluate(time.Now())
+	if got, want := fmt.Sprint(plannedAnnouncements(agent.plan())), "[192.0.2.0/24 2001:db8:1::/48]"; got != want {
+		t.Errorf("plan announces %s, want %s", got, want)
+	}
+	for prefix, want := range map[string]string{
+		"198.51.100.0/24": "RPKI invalid",
+		"203.0.113.0/24":  "condition: 100.64.0.0/10 received from " + testGateway,
+		"2001:db8::/48":   "quorum: 2 announcers available, at least 3 needed",
+	} {
+		if got := agent.prefixStatuses()[prefix].Reason; got != want {
+			t.Errorf("%s is held because %q, want %q", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/table"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+// addNeighborSet defines a neighbor set matching the given addresses
+func addNeighborSet(s *gobgpServer.BgpServer, name string, addrs ...string) error {
+	set, err := table.NewNeighborSet(config.NeighborSet{
+		NeighborSetName:  name,
+		NeighborInfoList: addrs,
+	})
+	if err != nil {
+		return err
+	}
+	return s.AddDefinedSet(set)
+}
+
+// addPrefixSets defines prefix sets for prefixes, one per address family since gobgp can't mix them in a
+// set. Each entry is a prefix optionally followed by a masklength range, e.g. "10.0.0.0/8 16..24". It
+// returns the names of the sets defined
+func addPrefixSets(s *gobgpServer.BgpServer, name string, prefixes []string) ([]string, error) {
+	families := map[string][]config.Prefix{}
+	for _, p := range prefixes {
+		fields := strings.Fields(p)
+		if len(fields) == 0 {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		prefix := config.Prefix{IpPrefix: fields[0]}
+		if len(fields) > 1 {
+			prefix.MasklengthRange = fields[1]
+		}
+		family := name + "-v6"
+		if ip.To4() != nil {
+			family = name + "-v4"
+		}
+		families[family] = append(families[family], prefix)
+	}
+
+	names := make([]string, 0, len(families))
+	for setName, list := range families {
+		set, err := table.NewPrefixSet(config.PrefixSet{
+			PrefixSetName: setName,
+			PrefixList:    list,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.AddDefinedSet(set); err != nil {
+			return nil, err
+		}
+		names = append(names, setName)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// addGlobalImportPolicy defines a policy from statements and appends it to the global import policies,
+// any defined sets it refers to must already exist
+func addGlobalImportPolicy(s *gobgpServer.BgpServer, name string, statements []config.Statement) error {
+	policy, err := table.NewPolicy(config.PolicyDefinition{
+		Name:       name,
+		Statements: statements,
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.AddPolicy(policy, false); err != nil {
+		return err
+	}
+	return s.AddPolicyAssignment("", table.POLICY_DIRECTION_IMPORT, []*config.PolicyDefinition{{Name: name}}, table.ROUTE_TYPE_ACCEPT)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/packethost/packngo/metadata"
+)
+
+const (
+	profilePrimary = "primary"
+
+	// profileTag on the device, as "bgp-profile:<name>", picks its profile
+	profileTag = "bgp-profile"
+
+	defaultProfiles = "primary 0 0,secondary 2 100,backup 5 200"
+)
+
+// announceProfile weights the announcements of a host against the rest of the fleet announcing the same
+// prefixes
+type announceProfile struct {
+	Name        string   `json:"name"`
+	Prepend     int      `json:"prepend"`               // extra copies of the agent's ASN on the AS path
+	MED         uint32   `json:"med"`                   // 0 sends no MED
+	Communities []string `json:"communities,omitempty"` // standard communities, e.g. "65000:100"
+}
+
+// parseProfiles reads profiles from entries like "name prepend med [community ...]"
+func parseProfiles(entries []string) (map[string]announceProfile, error) {
+	profiles := make(map[string]announceProfile)
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("profile %q isn't \"name prepend med [community ...]\"", entry)
+		}
+		p := announceProfile{Name: fields[0]}
+		prepend, err := strconv.Atoi(fields[1])
+		if err != nil || prepend < 0 {
+			return nil, fmt.Errorf("profile %s has invalid prepend count %q", p.Name, fields[1])
+		}
+		p.Prepend = prepend
+		med, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s has invalid MED %q", p.Name, fields[2])
+		}
+		p.MED = uint32(med)
+		for _, c := range fields[3:] {
+			if _, err := parseCommunity(c); err != nil {
+				return nil, fmt.Errorf("profile %s: %s", p.Name, err)
+			}
+			p.Communities = append(p.Communities, c)
+		}
+		profiles[p.Name] = p
+	}
+	return profiles, nil
+}
+
+// parseFacilityProfiles reads entries like "ewr1=primary"
+func parseFacilityProfiles(entries []string) (map[string]string, error) {
+	facilities := make(map[string]string)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("facility profile %q isn't \"facility=profile\"", entry)
+		}
+		facilities[parts[0]] = parts[1]
+	}
+	return facilities, nil
+}
+
+// profileNames lists the configured profiles, sorted
+func profileNames(profiles map[string]announceProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectProfile picks the device's profile: BGP_PROFILE in customdata, else a bgp-profile:<name> tag,
+// else the profile of its facility, else def
+func selectProfile(device *metadata.CurrentDevice, facilities map[string]string, def string) (string, error) {
+	if v, ok := device.CustomData["BGP_PROFILE"]; ok && v != nil {
+		name, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("BGP_PROFILE has unexpected type %T", v)
+		}
+		if name != "" {
+			return name, nil
+		}
+	}
+	for _, tag := range device.Tags {
+		if strings.HasPrefix(tag, profileTag+":") {
+			return strings.TrimPrefix(tag, profileTag+":"), nil
+		}
+	}
+	if name, ok := facilities[device.Facility]; ok {
+		return name, nil
+	}
+	return def, nil
+}
+
+// setProfile switches to the named profile and reports whether that's a change. agent.mu must be held
+func (agent *PacketBGPAgent) setProfile(name string) (bool, error) {
+	if _, ok := agent.Config.Profiles[name]; !ok {
+		return false, fmt.Errorf("unknown profile %q, must be one of %s", name, strings.Join(profileNames(agent.Config.Profiles), ", "))
+	}
+	if name == agent.profile {
+		return false, nil
+	}
+	if agent.profile != "" {
+		log.Println("switching from profile", agent.profile, "to", name)
+	}
+	agent.profile = name
+	return true, nil
+}
+
+// profiled applies the current profile to a route. agent.mu must be held
+func (agent *PacketBGPAgent) profiled(r *route) *route {
+	p, ok := agent.Config.Profiles[agent.profile]
+	if !ok {
+		return r
+	}
+	r.Prepend += p.Prepend
+	r.MED = p.MED
+	r.Communities = append(r.Communities, p.Communities...)
+	return r
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo/metadata"
+)
+
+func testProfiles(t *testing.T) map[string]announceProfile {
+	profiles, err := parseProfiles(splitList(defaultProfiles + ",tagged 1 0 65000:100 65000:200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profiles
+}
+
+func TestParseProfiles(t *testing.T) {
+	profiles := testProfiles(t)
+	want := announceProfile{Name: "tagged", Prepend: 1, Communities: []string{"65000:100", "65000:200"}}
+	if got := profiles["tagged"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+	if got := profiles["backup"]; got.Prepend != 5 || got.MED != 200 {
+		t.Errorf("default backup profile is %+v", got)
+	}
+
+	for _, invalid := range []string{"primary", "primary x 0", "primary 0 -1", "primary 0 0 65536:1"} {
+		if _, err := parseProfiles([]string{invalid}); err == nil {
+			t.Errorf("accepted profile %q", invalid)
+		}
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	facilities := map[string]string{"sjc1": "secondary"}
+	for _, c := range []struct {
+		device metadata.CurrentDevice
+		want   string
+	}{
+		{metadata.CurrentDevice{Facility: "ewr1"}, "primary"},
+		{metadata.CurrentDevice{Facility: "sjc1"}, "secondary"},
+		{metadata.CurrentDevice{Facility: "sjc1", Tags: []string{"bgp-profile:backup"}}, "backup"},
+		{metadata.CurrentDevice{Facility: "sjc1", Tags: []string{"bgp-profile:backup"}, CustomData: map[string]interface{}{"BGP_PROFILE": "primary"}}, "primary"},
+	} {
+		if got, err := selectProfile(&c.device, facilities, "primary"); err != nil || got != c.want {
+			t.Errorf("%+v got profile %q, %v, want %q", c.device, got, err, c.want)
+		}
+	}
+}
+
+func TestProfileSwitchIsSoft(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{Profiles: testProfiles(t), Profile: profilePrimary}, sp, n)
+	setProfile := func(profile string) {
+		customData := map[string]interface{}{"BGP_ANNOUNCE": "192.0.2.1/32", "BGP_PROFILE": profile}
+		if agent.update(&metadata.CurrentDevice{CustomData: customData}) {
+			if err := agent.EnsureBGP(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	setProfile("primary")
+	sp.Ops()
+
+	setProfile("tagged")
+	expectOps(t, "speaker", sp.Ops(), "announce 192.0.2.1/32")
+	want := &route{NextHop: testPrivateIP, Prepend: 1, Communities: []string{"65000:100", "65000:200"}}
+	if got := sp.routes["192.0.2.1/32"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("announced %+v, want %+v", got, want)
+	}
+
+	// unknown profiles are ignored
+	setProfile("nonexistent")
+	expectOps(t, "speaker", sp.Ops())
+	if got := agent.Status().Profile; got != "tagged" {
+		t.Errorf("profile is %s after an unknown one, want tagged", got)
+	}
+
+	// draining adds to the profile
+	customData := map[string]interface{}{"BGP_ANNOUNCE": "192.0.2.1/32", "BGP_PROFILE": "backup", "BGP_DRAIN": "prepend"}
+	agent.Config.DrainPrepend = 3
+	agent.update(&metadata.CurrentDevice{CustomData: customData})
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sp.routes["192.0.2.1/32"]; got.Prepend != 8 || got.MED != 200 {
+		t.Errorf("drained backup route is %+v, want 8 prepends and MED 200", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// quorum limits how many agents of the mesh announce a prefix: it's held back unless at least Min of them
+// are able to announce it, and no more than Max do. 0 disables either limit
+type quorum struct {
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+}
+
+// normalize checks the limits aren't negative and that at least one is set
+func (q *quorum) normalize() error {
+	if q.Min < 0 || q.Max < 0 {
+		return fmt.Errorf("quorum %+v can't be negative", *q)
+	}
+	if q.Min == 0 && q.Max == 0 {
+		return fmt.Errorf("quorum needs min or max")
+	}
+	return nil
+}
+
+func (q quorum) String() string {
+	return fmt.Sprintf("min %d max %d", q.Min, q.Max)
+}
+
+// hold returns why the agent self, able to announce prefix along with the other candidates, holds it back,
+// empty if it announces. Candidates are device IDs or addresses, self among them. The Max that announce are
+// picked by rendezvous hashing, so every agent reaches the same decision and different prefixes land on
+// different agents, and a prefix only moves when one of its announcers goes away
+func (q quorum) hold(prefix, self string, candidates []string) string {
+	if q.Min > 0 && len(candidates) < q.Min {
+		return fmt.Sprintf("quorum: %d announcers available, at least %d needed", len(candidates), q.Min)
+	}
+	if q.Max <= 0 || len(candidates) <= q.Max {
+		return ""
+	}
+	for _, id := range rendezvous(prefix, candidates)[q.Max:] {
+		if id == self {
+			return fmt.Sprintf("quorum: standing by, %d others announce", q.Max)
+		}
+	}
+	return ""
+}
+
+// rendezvous orders ids by their weight for prefix, highest first
+func rendezvous(prefix string, ids []string) []string {
+	weight := func(id string) uint64 {
+		sum := sha256.Sum256([]byte(prefix + " " + id))
+		return binary.BigEndian.Uint64(sum[:8])
+	}
+	ordered := append([]string(nil), ids...)
+	sort.Slice(ordered, func(i, j int) bool {
+		wi, wj := weight(ordered[i]), weight(ordered[j])
+		if wi != wj {
+			return wi > wj
+		}
+		return ordered[i] < ordered[j]
+	})
+	return ordered
+}
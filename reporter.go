@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// reportedPrefix is the state of a prefix as written to BGP_STATUS
+type reportedPrefix struct {
+	State  string `json:"state"` // announced, withdrawn, unhealthy or rejected
+	Reason string `json:"reason,omitempty"`
+}
+
+// reportedStatus is the BGP_STATUS object written back to the device's customdata
+type reportedStatus struct {
+	Version  string                    `json:"agent_version"`
+	Session  string                    `json:"session"`
+	Error    string                    `json:"error,omitempty"` // why BGP_ANNOUNCE as a whole was rejected
+	Profile  string                    `json:"profile,omitempty"`
+	Drain    string                    `json:"drain,omitempty"` // drain policy in effect
+	Load     string                    `json:"load,omitempty"`  // load level, unless normal
+	Prefixes map[string]reportedPrefix `json:"prefixes"`
+	Updated  time.Time                 `json:"updated"`
+}
+
+// statusReporter writes the agent's status to BGP_STATUS on the device through the Packet API, so whoever
+// edits BGP_ANNOUNCE can see whether it worked. Writes happen at most once per interval and only when
+// something other than the timestamp changed, so the metadata update a write causes doesn't cause
+// another one
+type statusReporter struct {
+	api      string
+	token    string
+	deviceID string
+	interval time.Duration
+	client   *http.Client
+	last     *reportedStatus
+	notify   chan struct{}
+}
+
+func newStatusReporter(api, token, deviceID string, interval time.Duration) *statusReporter {
+	return &statusReporter{
+		api:      strings.TrimSuffix(api, "/"),
+		token:    token,
+		deviceID: deviceID,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Notify tells the reporter the status may have changed, it never blocks
+func (r *statusReporter) Notify() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run should be run as a go routine, reports the status returned by status whenever notified, and
+// every minute to catch session changes, until done is closed
+func (r *statusReporter) Run(done chan bool, status func() *reportedStatus) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	var lastWrite time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-r.notify:
+		case <-ticker.C:
+		}
+
+		// rate limit, changes made while waiting are picked up by the write after it
+		if wait := r.interval - time.Since(lastWrite); wait > 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		s := status()
+		if r.last != nil && sameStatus(r.last, s) {
+			continue
+		}
+		lastWrite = time.Now()
+		if err := r.write(s); err != nil {
+			log.Println("can't report status:", err)
+			r.Notify() // try again after the interval
+			continue
+		}
+		r.last = s
+	}
+}
+
+// sameStatus reports whether a and b differ in nothing but the timestamp
+func sameStatus(a, b *reportedStatus) bool {
+	x, y := *a, *b
+	x.Updated, y.Updated = time.Time{}, time.Time{}
+	return reflect.DeepEqual(x, y)
+}
+
+// write sets BGP_STATUS, keeping the rest of customdata as it is
+func (r *statusReporter) write(s *reportedStatus) error {
+	var device struct {
+		CustomData map[string]interface{} `json:"customdata"`
+	}
+	if err := r.do(http.MethodGet, nil, &device); err != nil {
+		return err
+	}
+	if device.CustomData == nil {
+		device.CustomData = make(map[string]interface{})
+	}
+	device.CustomData["BGP_STATUS"] = s
+
+	return r.do(http.MethodPut, map[string]interface{}{"customdata": device.CustomData}, nil)
+}
+
+// do sends a request for the device, encoding body and decoding the response into out if they're set
+func (r *statusReporter) do(method string, body, out interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, r.api+"/devices/"+r.deviceID, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", r.token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s %s", method, req.URL, res.Status, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+// reportedStatus builds BGP_STATUS from the agent's status
+func (agent *PacketBGPAgent) reportedStatus() *reportedStatus {
+	status := agent.Status()
+
+	agent.mu.Lock()
+	sourceErr := agent.sourceError
+	agent.mu.Unlock()
+
+	s := &reportedStatus{
+		Version:  agent.Config.Version,
+		Session:  status.Session,
+		Error:    sourceErr,
+		Profile:  status.Profile,
+		Drain:    status.Drain,
+		Prefixes: make(map[string]reportedPrefix),
+		Updated:  time.Now(),
+	}
+	if status.Load != nil && status.Load.Level != loadLevels[loadNormal] {
+		s.Load = status.Load.Level
+	}
+	for prefix, p := range status.Prefixes {
+		rp := reportedPrefix{State: p.Health, Reason: p.Reason}
+		switch p.Health {
+		case healthError:
+			rp.State = "rejected"
+		case healthHeld:
+			rp.State = "unhealthy"
+		}
+		s.Prefixes[prefix] = rp
+	}
+	return s
+}
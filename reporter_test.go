@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDeviceAPI serves the device resource of the Packet API, recording every BGP_STATUS written
+type fakeDeviceAPI struct {
+	customData map[string]interface{}
+	reports    []reportedStatus
+	mu         sync.Mutex
+}
+
+func (f *fakeDeviceAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/devices/dev-1" || r.Header.Get("X-Auth-Token") != "token" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]interface{}{"customdata": f.customData})
+	case http.MethodPut:
+		var device struct {
+			CustomData map[string]json.RawMessage `json:"customdata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var s reportedStatus
+		if err := json.Unmarshal(device.CustomData["BGP_STATUS"], &s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.customData = make(map[string]interface{})
+		for k, v := range device.CustomData {
+			f.customData[k] = v
+		}
+		f.reports = append(f.reports, s)
+		writeJSON(w, map[string]interface{}{"customdata": f.customData})
+	}
+}
+
+// Reports returns the statuses written so far
+func (f *fakeDeviceAPI) Reports() []reportedStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]reportedStatus(nil), f.reports...)
+}
+
+// runTestReporter runs a reporter against a fake API, reporting whatever the returned setter last set until
+// the returned stop is called
+func runTestReporter(interval time.Duration) (*fakeDeviceAPI, *statusReporter, func(reportedStatus), func()) {
+	f := &fakeDeviceAPI{customData: map[string]interface{}{"BGP_ANNOUNCE": []interface{}{"192.0.2.1/32"}}}
+	h := httptest.NewServer(f)
+	r := newStatusReporter(h.URL+"/", "token", "dev-1", interval)
+
+	var mu sync.Mutex
+	current := reportedStatus{Version: "test", Session: "established", Prefixes: map[string]reportedPrefix{"192.0.2.1/32": {State: "announced"}}}
+	set := func(s reportedStatus) {
+		mu.Lock()
+		current = s
+		mu.Unlock()
+		r.Notify()
+	}
+	done := make(chan bool)
+	go r.Run(done, func() *reportedStatus {
+		mu.Lock()
+		defer mu.Unlock()
+		s := current
+		s.Updated = time.Now()
+		return &s
+	})
+	stop := func() {
+		close(done)
+		h.Close()
+	}
+	return f, r, set, stop
+}
+
+// waitReports waits until the fake API got n reports
+func waitReports(t *testing.T, f *fakeDeviceAPI, n int) []reportedStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reports := f.Reports()
+		if len(reports) >= n {
+			return reports
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d reports, want %d", len(reports), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReporterReportsEveryField(t *testing.T) {
+	f, r, set, stop := runTestReporter(10 * time.Millisecond)
+	defer stop()
+	r.Notify()
+	waitReports(t, f, 1)
+
+	// none of these change the state of a prefix
+	s := reportedStatus{Version: "test", Session: "established", Prefixes: map[string]reportedPrefix{"192.0.2.1/32": {State: "announced"}}}
+	s.Drain = drainGracefulShutdown
+	set(s)
+	if got := waitReports(t, f, 2)[1].Drain; got != drainGracefulShutdown {
+		t.Errorf("reported drain %q, want %s", got, drainGracefulShutdown)
+	}
+	s.Profile = "secondary"
+	set(s)
+	if got := waitReports(t, f, 3)[2].Profile; got != "secondary" {
+		t.Errorf("reported profile %q, want %s", got, "secondary")
+	}
+	s.Load = loadLevels[loadPrepend]
+	set(s)
+	if got := waitReports(t, f, 4)[3].Load; got != loadLevels[loadPrepend] {
+		t.Errorf("reported load %q, want %s", got, loadLevels[loadPrepend])
+	}
+
+	f.mu.Lock()
+	_, kept := f.customData["BGP_ANNOUNCE"]
+	f.mu.Unlock()
+	if !kept {
+		t.Error("reporting dropped BGP_ANNOUNCE from customdata")
+	}
+}
+
+func TestReporterRateLimit(t *testing.T) {
+	interval := 300 * time.Millisecond
+	f, r, set, stop := runTestReporter(interval)
+	defer stop()
+	r.Notify()
+	waitReports(t, f, 1)
+	first := time.Now()
+
+	// a burst of changes is written once, with the last of them, no sooner than the interval
+	for i := 1; i <= 3; i++ {
+		set(reportedStatus{Version: "test", Session: "established", Error: fmt.Sprintf("change %d", i)})
+	}
+	reports := waitReports(t, f, 2)
+	if elapsed := time.Since(first); elapsed < interval-50*time.Millisecond {
+		t.Errorf("second report written %s after the first, want at least %s", elapsed, interval)
+	}
+	if got := reports[1].Error; got != "change 3" {
+		t.Errorf("reported error %q, want the last one, %q", got, "change 3")
+	}
+	time.Sleep(2 * interval)
+	if got := len(f.Reports()); got != 2 {
+		t.Errorf("a burst of changes was written %d times, want once", got-1)
+	}
+}
+
+func TestReporterIgnoresItsOwnWrites(t *testing.T) {
+	f, r, _, stop := runTestReporter(10 * time.Millisecond)
+	defer stop()
+	r.Notify()
+	waitReports(t, f, 1)
+
+	// every write changes customdata, which makes the agent notify again, but nothing but the timestamp
+	// changed so nothing more is written
+	for i := 0; i < 10; i++ {
+		r.Notify()
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := len(f.Reports()); got != 1 {
+		t.Errorf("unchanged status written %d times, want once", got)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+
+	gobgpApi "github.com/osrg/gobgp/api"
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+// ribReader is what evaluating the announcements reads from gobgp: the paths neighbors send, and the ROAs
+// and state of the RTR caches. It's the embedded gobgp, or for plan the one of a running agent
+type ribReader interface {
+	// Received returns the paths neighbor sent for family, whether or not the import policy accepted them,
+	// only those for prefix unless it's empty
+	Received(neighbor string, family bgp.RouteFamily, prefix string) ([]*table.Path, error)
+	ROAs(family bgp.RouteFamily) ([]*table.ROA, error)
+	// RTRCaches reports every RTR cache gobgp is connected to
+	RTRCaches() ([]rpkiCacheStatus, error)
+}
+
+// serverRIB reads the embedded gobgp
+type serverRIB struct {
+	server *gobgpServer.BgpServer
+}
+
+func (r serverRIB) Received(neighbor string, family bgp.RouteFamily, prefix string) ([]*table.Path, error) {
+	var lookup []*table.LookupPrefix
+	if prefix != "" {
+		lookup = []*table.LookupPrefix{{Prefix: prefix}}
+	}
+	rib, _, err := r.server.GetAdjRib(neighbor, family, true, lookup)
+	if err != nil {
+		return nil, err
+	}
+	var paths []*table.Path
+	for _, dst := range rib.GetDestinations() {
+		paths = append(paths, dst.GetAllKnownPathList()...)
+	}
+	return paths, nil
+}
+
+func (r serverRIB) ROAs(family bgp.RouteFamily) ([]*table.ROA, error) {
+	return r.server.GetRoa(family)
+}
+
+func (r serverRIB) RTRCaches() ([]rpkiCacheStatus, error) {
+	servers, err := r.server.GetRpki()
+	if err != nil {
+		return nil, err
+	}
+	caches := make([]rpkiCacheStatus, 0, len(servers))
+	for _, s := range servers {
+		caches = append(caches, rpkiCacheStatus{
+			Address: net.JoinHostPort(s.Config.Address, strconv.FormatUint(uint64(s.Config.Port), 10)),
+			Up:      s.State.Up,
+			ROAs:    s.State.RecordsV4 + s.State.RecordsV6,
+		})
+	}
+	return caches, nil
+}
+
+// apiRIB reads the gobgp of a running agent through its gRPC API
+type apiRIB struct {
+	client gobgpApi.GobgpApiClient
+}
+
+func (r apiRIB) Received(neighbor string, family bgp.RouteFamily, prefix string) ([]*table.Path, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t := &gobgpApi.Table{Type: gobgpApi.Resource_ADJ_IN, Name: neighbor, Family: uint32(family)}
+	if prefix != "" {
+		t.Destinations = []*gobgpApi.Destination{{Prefix: prefix}}
+	}
+	res, err := r.client.GetRib(ctx, &gobgpApi.GetRibRequest{Table: t})
+	if err != nil {
+		return nil, err
+	}
+	var paths []*table.Path
+	for _, dst := range res.Table.Destinations {
+		for _, p := range dst.Paths {
+			path, err := p.ToNativePath()
+			if err != nil {
+				log.Println("skipping a path from", neighbor+":", err)
+				continue
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (r apiRIB) ROAs(family bgp.RouteFamily) ([]*table.ROA, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := r.client.GetRoa(ctx, &gobgpApi.GetRoaRequest{Family: uint32(family)})
+	if err != nil {
+		return nil, err
+	}
+	roas := make([]*table.ROA, 0, len(res.Roas))
+	for _, roa := range res.Roas {
+		ip := net.ParseIP(roa.Prefix)
+		if ip == nil {
+			continue
+		}
+		afi, b := bgp.AFI_IP6, ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			afi, b = bgp.AFI_IP, ip4
+		}
+		roas = append(roas, table.NewROA(int(afi), b, uint8(roa.Prefixlen), uint8(roa.Maxlen), roa.As, roa.Conf.GetAddress()))
+	}
+	return roas, nil
+}
+
+func (r apiRIB) RTRCaches() ([]rpkiCacheStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := r.client.GetRpki(ctx, &gobgpApi.GetRpkiRequest{})
+	if err != nil {
+		return nil, err
+	}
+	caches := make([]rpkiCacheStatus, 0, len(res.Servers))
+	for _, s := range res.Servers {
+		caches = append(caches, rpkiCacheStatus{
+			Address: net.JoinHostPort(s.GetConf().GetAddress(), s.GetConf().GetRemotePort()),
+			Up:      s.GetState().GetUp(),
+			ROAs:    s.GetState().GetRecordIpv4() + s.GetState().GetRecordIpv6(),
+		})
+	}
+	return caches, nil
+}
+
+// emptyRIB is what a gobgp that was just started has: nothing received and no RTR cache connected yet
+type emptyRIB struct{}
+
+func (emptyRIB) Received(string, bgp.RouteFamily, string) ([]*table.Path, error) { return nil, nil }
+func (emptyRIB) ROAs(bgp.RouteFamily) ([]*table.ROA, error)                      { return nil, nil }
+func (emptyRIB) RTRCaches() ([]rpkiCacheStatus, error)                           { return nil, nil }
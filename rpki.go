@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/bgp"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+const (
+	rpkiValid    = "valid"
+	rpkiInvalid  = "invalid"
+	rpkiNotFound = "not-found"
+	rpkiUnknown  = "unknown" // no cache is connected, nothing can be said
+
+	// rpkiPolicyFlag only reports the validation state, rpkiPolicyWithholdInvalid holds back invalid
+	// prefixes and rpkiPolicyWithhold holds back anything that isn't valid
+	rpkiPolicyFlag            = "flag"
+	rpkiPolicyWithholdInvalid = "withhold-invalid"
+	rpkiPolicyWithhold        = "withhold"
+)
+
+// rpkiCacheStatus is how an RTR cache is doing
+type rpkiCacheStatus struct {
+	Address string `json:"address"`
+	Up      bool   `json:"up"`
+	ROAs    uint32 `json:"roas"`
+}
+
+// rpkiValidator checks the origin of the agent's own prefixes against the ROAs gobgp receives from RTR caches
+type rpkiValidator struct {
+	rib    ribReader
+	asn    uint32
+	policy string
+}
+
+// newRPKIValidator validates against the ROAs in rib
+func newRPKIValidator(rib ribReader, asn uint32, policy string) (*rpkiValidator, error) {
+	switch policy {
+	case rpkiPolicyFlag, rpkiPolicyWithholdInvalid, rpkiPolicyWithhold:
+	default:
+		return nil, fmt.Errorf("invalid RPKI policy %q, must be %s, %s or %s", policy, rpkiPolicyFlag, rpkiPolicyWithholdInvalid, rpkiPolicyWithhold)
+	}
+	return &rpkiValidator{rib: rib, asn: asn, policy: policy}, nil
+}
+
+// addRTRCaches connects gobgp to every cache, given as host:port
+func addRTRCaches(server *gobgpServer.BgpServer, caches []string) error {
+	for _, cache := range caches {
+		host, port, err := net.SplitHostPort(cache)
+		if err != nil {
+			return err
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return err
+		}
+		err = server.AddRpki(&config.RpkiServerConfig{
+			Address:        host,
+			Port:           uint32(p),
+			RecordLifetime: int64(time.Hour.Seconds()),
+		})
+		if err != nil {
+			return err
+		}
+		log.Println("added RTR cache", cache)
+	}
+	return nil
+}
+
+// Validate returns the origin validation state of prefix announced from the agent's ASN, following
+// RFC 6811: valid if a covering ROA matches the ASN and length, invalid if ROAs cover it but none
+// matches, not found if no ROA covers it
+func (v *rpkiValidator) Validate(prefix string) (string, error) {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", err
+	}
+	ones, _ := ipnet.Mask.Size()
+
+	if !v.connected() {
+		return rpkiUnknown, nil
+	}
+
+	family := bgp.RF_IPv4_UC
+	if ip.To4() == nil {
+		family = bgp.RF_IPv6_UC
+	}
+	roas, err := v.rib.ROAs(family)
+	if err != nil {
+		return "", err
+	}
+
+	state := rpkiNotFound
+	for _, roa := range roas {
+		roaNet := &net.IPNet{IP: roa.Prefix.Prefix, Mask: net.CIDRMask(int(roa.Prefix.Length), len(roa.Prefix.Prefix)*8)}
+		if int(roa.Prefix.Length) > ones || !roaNet.Contains(ip) {
+			continue
+		}
+		if roa.AS != 0 && roa.AS == v.asn && ones <= int(roa.MaxLen) {
+			return rpkiValid, nil
+		}
+		state = rpkiInvalid
+	}
+	return state, nil
+}
+
+// Withholds reports whether the policy keeps a prefix in state from being announced
+func (v *rpkiValidator) Withholds(state string) bool {
+	switch v.policy {
+	case rpkiPolicyWithholdInvalid:
+		return state == rpkiInvalid
+	case rpkiPolicyWithhold:
+		return state == rpkiInvalid || state == rpkiNotFound
+	}
+	return false
+}
+
+func (v *rpkiValidator) connected() bool {
+	for _, cache := range v.Caches() {
+		if cache.Up {
+			return true
+		}
+	}
+	return false
+}
+
+// Caches reports every RTR cache, sorted by address
+func (v *rpkiValidator) Caches() []rpkiCacheStatus {
+	caches, err := v.rib.RTRCaches()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	sort.Slice(caches, func(i, j int) bool { return caches[i].Address < caches[j].Address })
+	return caches
+}
+
+// validateRPKI refreshes the validation state of every desired prefix and reports whether any changed,
+// agent.mu must be held
+func (agent *PacketBGPAgent) validateRPKI() bool {
+	if agent.RPKI == nil {
+		return false
+	}
+
+	states := make(map[string]string)
+	changed := false
+	for _, announcement := range agent.Announcements {
+		state, err := agent.RPKI.Validate(announcement.Prefix)
+		if err != nil {
+			log.Println("can't validate", announcement.Prefix, err)
+			state = rpkiUnknown
+		}
+		if prev, ok := agent.rpkiStates[announcement.Prefix]; !ok || prev != state {
+			log.Println("RPKI origin validation of", announcement.Prefix, "is", state)
+			changed = true
+		}
+		states[announcement.Prefix] = state
+	}
+	agent.rpkiStates = states
+	return changed
+}
+
+// rpkiWithheld reports whether policy holds back prefix, agent.mu must be held
+func (agent *PacketBGPAgent) rpkiWithheld(prefix string) bool {
+	return agent.RPKI != nil && agent.RPKI.Withholds(agent.rpkiStates[prefix])
+}
+
+// WatchRPKI should be run as a go routine, revalidates the desired prefixes as ROAs change and reconciles
+// when a validation state did, until done is closed
+func (agent *PacketBGPAgent) WatchRPKI(done chan bool) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			agent.mu.Lock()
+			if agent.validateRPKI() {
+				if err := agent.ensureBGP(); err != nil {
+					log.Println(err)
+				}
+			}
+			agent.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/osrg/gobgp/config"
+
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+// startRTRCache serves the ROAs in roas, as JSON, from a test cache and returns its address
+func startRTRCache(t *testing.T, dir, roas string) string {
+	path := filepath.Join(dir, "roas.json")
+	if err := ioutil.WriteFile(path, []byte(roas), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &rtrCache{path: path, clients: make(map[net.Conn]bool)}
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go c.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRPKIValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-rtr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := startRTRCache(t, dir, `[
+		{"prefix": "192.0.2.0/24", "max_length": 28, "asn": 65000},
+		{"prefix": "198.51.100.0/24", "asn": 64999},
+		{"prefix": "203.0.113.0/24", "asn": 65000},
+		{"prefix": "2001:db8::/32", "max_length": 48, "asn": 65000}
+	]`)
+
+	// left running, it has nothing to tear down that outlives the test
+	s := gobgpServer.NewBgpServer()
+	go s.Serve()
+	if err := s.Start(&config.Global{Config: config.GlobalConfig{As: 65000, RouterId: "192.0.2.1", Port: -1}}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := newRPKIValidator(serverRIB{s}, 65000, rpkiPolicyWithhold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := v.Validate("192.0.2.0/24"); err != nil || state != rpkiUnknown {
+		t.Errorf("without a cache got %s, %v, want %s", state, err, rpkiUnknown)
+	}
+	if err := addRTRCaches(s, []string{cache}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the ROAs to load", func() bool {
+		caches := v.Caches()
+		return len(caches) == 1 && caches[0].Up && caches[0].ROAs == 4
+	})
+
+	for _, c := range []struct {
+		prefix string
+		want   string
+	}{
+		{"192.0.2.0/24", rpkiValid},
+		{"192.0.2.16/28", rpkiValid},
+		{"2001:db8:1::/48", rpkiValid},
+		{"198.51.100.0/24", rpkiInvalid}, // another origin
+		{"203.0.113.0/25", rpkiInvalid},  // longer than the ROA allows
+		{"192.0.2.0/29", rpkiInvalid},
+		{"100.64.0.0/10", rpkiNotFound},
+		{"2001:db9::/48", rpkiNotFound},
+		{"192.0.0.0/16", rpkiNotFound}, // ROAs only cover more-specifics
+	} {
+		if got, err := v.Validate(c.prefix); err != nil || got != c.want {
+			t.Errorf("%s is %s, %v, want %s", c.prefix, got, err, c.want)
+		}
+	}
+
+	for policy, withheld := range map[string][]bool{
+		rpkiPolicyFlag:            {false, false, false, false},
+		rpkiPolicyWithholdInvalid: {false, true, false, false},
+		rpkiPolicyWithhold:        {false, true, true, false},
+	} {
+		v := &rpkiValidator{policy: policy}
+		for i, state := range []string{rpkiValid, rpkiInvalid, rpkiNotFound, rpkiUnknown} {
+			if got := v.Withholds(state); got != withheld[i] {
+				t.Errorf("policy %s withholds %s: %v, want %v", policy, state, got, withheld[i])
+			}
+		}
+	}
+	if _, err := newRPKIValidator(serverRIB{s}, 65000, "strict"); err == nil {
+		t.Error("accepted an unknown policy")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/osrg/gobgp/packet/rtr"
+)
+
+// testROA is an entry of the test RTR cache's ROA file
+type testROA struct {
+	Prefix    string `json:"prefix"`
+	MaxLength uint8  `json:"max_length"`
+	ASN       uint32 `json:"asn"`
+}
+
+// rtrCache is a minimal RTR (RFC 6810) cache serving ROAs from a JSON file, a stand-in for a real
+// validator like Routinator when testing. The session ID changes whenever the file does, so clients
+// drop what they had and load the new set
+type rtrCache struct {
+	path    string
+	roas    []testROA
+	session uint16
+	clients map[net.Conn]bool
+	mu      sync.Mutex
+}
+
+// runRTRCache serves the test cache, args are the flags after "rtr-cache"
+func runRTRCache(args []string) error {
+	fs := flag.NewFlagSet("rtr-cache", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8323", "address to serve RTR on")
+	path := fs.String("roas", "roas.json", "JSON file with a list of {\"prefix\", \"max_length\", \"asn\"} ROAs, reloaded when it changes. max_length defaults to the prefix length")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c := &rtrCache{path: *path, clients: make(map[net.Conn]bool)}
+	if err := c.load(); err != nil {
+		return err
+	}
+	go c.watch()
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	log.Println("serving RTR on", *listen)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serve(conn)
+	}
+}
+
+func (c *rtrCache) load() error {
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	roas := make([]testROA, 0)
+	if err := json.Unmarshal(b, &roas); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roas = roas
+	c.session++
+	log.Println("loaded", len(roas), "ROAs from", c.path)
+	return nil
+}
+
+// watch reloads the file when it changes and notifies every client
+func (c *rtrCache) watch() {
+	var modified time.Time
+	if fi, err := os.Stat(c.path); err == nil {
+		modified = fi.ModTime()
+	}
+
+	for range time.Tick(2 * time.Second) {
+		fi, err := os.Stat(c.path)
+		if err != nil || !fi.ModTime().After(modified) {
+			continue
+		}
+		modified = fi.ModTime()
+		if err := c.load(); err != nil {
+			log.Println("can't reload ROAs:", err)
+			continue
+		}
+
+		c.mu.Lock()
+		for conn := range c.clients {
+			c.write(conn, rtr.NewRTRSerialNotify(c.session, uint32(c.session)))
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *rtrCache) serve(conn net.Conn) {
+	c.mu.Lock()
+	c.clients[conn] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.clients, conn)
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(rtr.SplitRTR)
+	for scanner.Scan() {
+		msg, err := rtr.ParseRTR(scanner.Bytes())
+		if err != nil {
+			log.Println(conn.RemoteAddr(), err)
+			return
+		}
+
+		c.mu.Lock()
+		switch msg.(type) {
+		case *rtr.RTRResetQuery:
+			c.write(conn, rtr.NewRTRCacheResponse(c.session))
+			for _, roa := range c.roas {
+				_, ipnet, err := net.ParseCIDR(roa.Prefix)
+				if err != nil {
+					log.Println("skipping ROA:", err)
+					continue
+				}
+				ones, _ := ipnet.Mask.Size()
+				maxLength := roa.MaxLength
+				if maxLength == 0 {
+					maxLength = uint8(ones)
+				}
+				ip := ipnet.IP
+				if v4 := ip.To4(); v4 != nil {
+					ip = v4
+				}
+				c.write(conn, rtr.NewRTRIPPrefix(ip, uint8(ones), maxLength, roa.ASN, rtr.ANNOUNCEMENT))
+			}
+			c.write(conn, rtr.NewRTREndOfData(c.session, uint32(c.session)))
+		case *rtr.RTRSerialQuery:
+			// no history is kept, the client has to start over
+			c.write(conn, rtr.NewRTRCacheReset())
+		}
+		c.mu.Unlock()
+	}
+}
+
+// write sends msg to conn, c.mu must be held
+func (c *rtrCache) write(conn net.Conn, msg rtr.RTRMessage) {
+	b, err := msg.Serialize()
+	if err == nil {
+		_, err = conn.Write(b)
+	}
+	if err != nil {
+		log.Println(conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule actions: announce only inside the windows, e.g. business hours, or withdraw inside them, e.g.
+// planned maintenance
+const (
+	scheduleAnnounce = "announce"
+	scheduleWithdraw = "withdraw"
+)
+
+// maxScheduleLookahead bounds how far ahead a schedule is searched for its next window
+const maxScheduleLookahead = 5 * 366 * 24 * time.Hour
+
+// schedule is a set of time windows: each opens at a time matching Cron, a crontab(5) style expression of
+// minute, hour, day of month, month and day of week, in time zone TZ, and lasts Duration
+type schedule struct {
+	Cron     string `json:"cron"`
+	Duration string `json:"duration"`
+	TZ       string `json:"tz,omitempty"`     // UTC when empty
+	Action   string `json:"action,omitempty"` // announce when empty
+}
+
+// normalize checks the schedule parses and fills in the defaults
+func (s *schedule) normalize() error {
+	if s.Action == "" {
+		s.Action = scheduleAnnounce
+	}
+	if s.Action != scheduleAnnounce && s.Action != scheduleWithdraw {
+		return fmt.Errorf("schedule action %q must be %s or %s", s.Action, scheduleAnnounce, scheduleWithdraw)
+	}
+	if s.TZ == "" {
+		s.TZ = "UTC"
+	}
+	_, _, _, err := s.parse()
+	return err
+}
+
+func (s schedule) String() string {
+	return fmt.Sprintf("%s %q for %s in %s", s.Action, s.Cron, s.Duration, s.TZ)
+}
+
+func (s schedule) parse() (*cronSpec, time.Duration, *time.Location, error) {
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	d, err := time.ParseDuration(s.Duration)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("schedule duration: %s", err)
+	}
+	if d < time.Minute {
+		return nil, 0, nil, fmt.Errorf("schedule duration %s is shorter than a minute", s.Duration)
+	}
+	loc, err := time.LoadLocation(s.TZ)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("schedule time zone: %s", err)
+	}
+	return spec, d, loc, nil
+}
+
+// at reports whether a window is open at now and when that next changes, zero if it never does
+func (s schedule) at(now time.Time) (bool, time.Time, error) {
+	spec, d, loc, err := s.parse()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	now = now.In(loc)
+
+	// a window is open if one started less than its duration ago
+	start := spec.next(now.Add(-d))
+	if start.IsZero() {
+		return false, time.Time{}, nil
+	}
+	if start.After(now) {
+		return false, start, nil
+	}
+	// windows that start before the open one ends extend it
+	end := start.Add(d)
+	for i := 0; i < 1000; i++ {
+		next := spec.next(start)
+		if next.IsZero() || next.After(end) {
+			return true, end, nil
+		}
+		start, end = next, next.Add(d)
+	}
+	return true, time.Time{}, nil // always open
+}
+
+// withholds reports whether the schedule withholds announcements at now, and when that next changes
+func (s schedule) withholds(now time.Time) (bool, time.Time, error) {
+	open, next, err := s.at(now)
+	return open == (s.Action == scheduleWithdraw), next, err
+}
+
+// scheduleList is one schedule or a list of them, in JSON either an object or an array of objects
+type scheduleList []schedule
+
+func (l *scheduleList) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var one schedule
+	if err := json.Unmarshal(b, &one); err == nil {
+		*l = scheduleList{one}
+		return nil
+	}
+	var many []schedule
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("schedules must be objects like {\"cron\": \"0 2 * * 6\", \"duration\": \"4h\"}: %s", err)
+	}
+	if len(many) > 0 {
+		*l = many
+	}
+	return nil
+}
+
+// normalize checks every schedule parses and fills in their defaults
+func (l scheduleList) normalize() error {
+	for i := range l {
+		if err := l[i].normalize(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSchedules reads a schedule object or a list of them, as in BGP_SCHEDULE
+func parseSchedules(v interface{}) ([]schedule, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var schedules scheduleList
+	if err := json.Unmarshal(b, &schedules); err != nil {
+		return nil, err
+	}
+	if err := schedules.normalize(); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// cronSpec is the set of minutes, hours, days of month, months and days of week a cron expression matches
+type cronSpec struct {
+	minute, hour, dom, month, dow [64]bool
+	// with both day fields restricted a day matches either, like cron does
+	anyDOM, anyDOW bool
+}
+
+// parseCron reads five fields, each "*", a number, a range "a-b", or any of those with a step "/n", and
+// lists of them separated by commas. Sunday is 0 or 7
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, minute hour day-of-month month day-of-week", expr)
+	}
+	spec := &cronSpec{anyDOM: fields[2] == "*", anyDOW: fields[4] == "*"}
+	for i, f := range []struct {
+		set      *[64]bool
+		min, max int
+	}{
+		{&spec.minute, 0, 59},
+		{&spec.hour, 0, 23},
+		{&spec.dom, 1, 31},
+		{&spec.month, 1, 12},
+		{&spec.dow, 0, 7},
+	} {
+		if err := parseCronField(fields[i], f.set, f.min, f.max); err != nil {
+			return nil, fmt.Errorf("cron expression %q: %s", expr, err)
+		}
+	}
+	spec.dow[0] = spec.dow[0] || spec.dow[7]
+	return spec, nil
+}
+
+func parseCronField(field string, set *[64]bool, min, max int) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max // "5/15" is 5 and every 15 after it
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%q isn't within %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// matchesDay reports whether the spec matches the day of t
+func (spec *cronSpec) matchesDay(t time.Time) bool {
+	dom, dow := spec.dom[t.Day()], spec.dow[int(t.Weekday())]
+	switch {
+	case spec.anyDOM && spec.anyDOW:
+		return true
+	case spec.anyDOM:
+		return dow
+	case spec.anyDOW:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the spec matches, in t's location, zero if there's none within
+// maxScheduleLookahead
+func (spec *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	for limit := t.Add(maxScheduleLookahead); day.Before(limit); day = day.AddDate(0, 0, 1) {
+		if !spec.month[int(day.Month())] || !spec.matchesDay(day) {
+			continue
+		}
+		for h := 0; h < 24; h++ {
+			if !spec.hour[h] {
+				continue
+			}
+			for m := 0; m < 60; m++ {
+				if !spec.minute[m] {
+					continue
+				}
+				// times skipped by a DST change come out an hour later, that still counts
+				at := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, loc)
+				if at.After(t) {
+					return at
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// scheduleOverride replaces what the schedules say about a prefix, or the whole host, until Until
+type scheduleOverride struct {
+	Announce bool      `json:"announce"`
+	Until    time.Time `json:"until"`
+}
+
+// scheduleStatus is what the schedules say about a prefix, or the whole host
+type scheduleStatus struct {
+	Withheld       bool              `json:"withheld"`
+	Reason         string            `json:"reason,omitempty"`
+	NextTransition *time.Time        `json:"next_transition,omitempty"`
+	Override       *scheduleOverride `json:"override,omitempty"`
+}
+
+// hostSchedule is the key of the whole host's schedule status and override
+const hostSchedule = ""
+
+// evaluateSchedules evaluates the schedule of the host and of every desired prefix at now, and reports
+// whether what they withhold changed, agent.mu must be held. Expired overrides are dropped
+func (agent *PacketBGPAgent) evaluateSchedules(now time.Time) bool {
+	for key, o := range agent.scheduleOverrides {
+		if !now.Before(o.Until) {
+			log.Printf("schedule override of %s expired", scheduleTarget(key))
+			delete(agent.scheduleOverrides, key)
+		}
+	}
+
+	statuses := make(map[string]scheduleStatus)
+	statuses[hostSchedule] = agent.scheduleStatus(hostSchedule, agent.hostSchedules, now)
+	for _, announcement := range agent.Announcements {
+		schedules := announcement.Schedule
+		status := agent.scheduleStatus(announcement.Prefix, schedules, now)
+		if _, overridden := agent.scheduleOverrides[announcement.Prefix]; !overridden && statuses[hostSchedule].Withheld && !status.Withheld {
+			status.Withheld, status.Reason = true, statuses[hostSchedule].Reason
+		}
+		if len(schedules) > 0 || status.Override != nil || status.Withheld {
+			statuses[announcement.Prefix] = status
+		}
+	}
+
+	changed := false
+	for key, status := range statuses {
+		if prev := agent.schedules[key]; prev.Withheld != status.Withheld {
+			if status.Withheld {
+				log.Printf("withholding %s: %s", scheduleTarget(key), status.Reason)
+			} else {
+				log.Printf("advertising %s, its schedule allows it", scheduleTarget(key))
+			}
+			changed = true
+		}
+	}
+	for key, prev := range agent.schedules {
+		if _, ok := statuses[key]; !ok && prev.Withheld {
+			changed = true
+		}
+	}
+	agent.schedules = statuses
+	return changed
+}
+
+// scheduleStatus evaluates schedules at now, unless key has an override. agent.mu must be held
+func (agent *PacketBGPAgent) scheduleStatus(key string, schedules []schedule, now time.Time) scheduleStatus {
+	var status scheduleStatus
+	if o, ok := agent.scheduleOverrides[key]; ok {
+		o := o
+		status.Override = &o
+		status.Withheld = !o.Announce
+		status.NextTransition = &o.Until
+		if status.Withheld {
+			status.Reason = "schedule: withdrawn by override until " + o.Until.Format(time.RFC3339)
+		}
+		return status
+	}
+
+	for _, s := range schedules {
+		withholds, next, err := s.withholds(now)
+		if err != nil {
+			log.Println("ignoring schedule", s.String()+":", err)
+			continue
+		}
+		if withholds && !status.Withheld {
+			status.Withheld = true
+			if s.Action == scheduleWithdraw {
+				status.Reason = "schedule: in maintenance window " + s.String()
+			} else {
+				status.Reason = "schedule: outside window " + s.String()
+			}
+		}
+		if !next.IsZero() && (status.NextTransition == nil || next.Before(*status.NextTransition)) {
+			next := next
+			status.NextTransition = &next
+		}
+	}
+	return status
+}
+
+// scheduleWithheld reports whether the schedules withhold a desired prefix, agent.mu must be held
+func (agent *PacketBGPAgent) scheduleWithheld(prefix string) bool {
+	if status, ok := agent.schedules[prefix]; ok {
+		return status.Withheld
+	}
+	return agent.schedules[hostSchedule].Withheld
+}
+
+// scheduleReason returns why the schedules withhold a desired prefix, agent.mu must be held
+func (agent *PacketBGPAgent) scheduleReason(prefix string) string {
+	if status, ok := agent.schedules[prefix]; ok {
+		return status.Reason
+	}
+	return agent.schedules[hostSchedule].Reason
+}
+
+func scheduleTarget(key string) string {
+	if key == hostSchedule {
+		return "the host"
+	}
+	return key
+}
+
+// Override makes the schedules of prefix, or of the whole host when it's empty, announce or withdraw until
+// until. A zero until lasts until the next scheduled transition. The status is nil if the override was
+// refused, an error along with it is from reconciling
+func (agent *PacketBGPAgent) Override(prefix string, announce bool, until time.Time) (*scheduleStatus, error) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	status, ok := agent.schedules[prefix]
+	if prefix != hostSchedule && !ok {
+		status, ok = agent.schedules[hostSchedule], agent.desired(prefix)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s isn't desired", prefix)
+	}
+	if until.IsZero() {
+		if status.NextTransition == nil {
+			return nil, fmt.Errorf("%s has no scheduled transition, the override needs an end", scheduleTarget(prefix))
+		}
+		until = *status.NextTransition
+	}
+	if !until.After(time.Now()) {
+		return nil, fmt.Errorf("override of %s would end in the past", scheduleTarget(prefix))
+	}
+
+	log.Printf("overriding the schedule of %s until %s, announce: %v", scheduleTarget(prefix), until.Format(time.RFC3339), announce)
+	agent.scheduleOverrides[prefix] = scheduleOverride{Announce: announce, Until: until}
+	err := agent.ensureBGP()
+	status = agent.schedules[prefix]
+	return &status, err
+}
+
+// ClearOverride goes back to the schedules of prefix, or of the whole host when it's empty
+func (agent *PacketBGPAgent) ClearOverride(prefix string) error {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	if _, ok := agent.scheduleOverrides[prefix]; !ok {
+		return fmt.Errorf("%s has no schedule override", scheduleTarget(prefix))
+	}
+	log.Printf("clearing the schedule override of %s", scheduleTarget(prefix))
+	delete(agent.scheduleOverrides, prefix)
+	return agent.ensureBGP()
+}
+
+// desired reports whether prefix is one of the desired announcements, agent.mu must be held
+func (agent *PacketBGPAgent) desired(prefix string) bool {
+	for _, announcement := range agent.Announcements {
+		if announcement.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchSchedules should be run as a go routine, re-evaluates the schedules at the start of every minute,
+// the finest a schedule can change at, and reconciles when what they withhold changed, until done is closed
+func (agent *PacketBGPAgent) WatchSchedules(done chan bool) {
+	for {
+		now := time.Now()
+		select {
+		case <-done:
+			return
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+
+		agent.mu.Lock()
+		if agent.evaluateSchedules(time.Now()) {
+			if err := agent.ensureBGP(); err != nil {
+				log.Println(err)
+			}
+		}
+		agent.mu.Unlock()
+	}
+}
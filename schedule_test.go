@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo/metadata"
+)
+
+func TestCron(t *testing.T) {
+	from := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC) // a Friday
+	for _, c := range []struct {
+		expr string
+		want string
+	}{
+		{"* * * * *", "2024-03-01 10:31"},
+		{"0 2 * * 6", "2024-03-02 02:00"},
+		{"0 2 * * 7", "2024-03-03 02:00"}, // 7 is Sunday too
+		{"*/20 9-17 * * 1-5", "2024-03-01 10:40"},
+		{"0 0 1,15 * *", "2024-03-15 00:00"},
+		{"0 0 29 2 *", "2028-02-29 00:00"},
+		// day of month or day of week when both are set
+		{"0 12 10 * 1", "2024-03-04 12:00"},
+	} {
+		spec, err := parseCron(c.expr)
+		if err != nil {
+			t.Errorf("%q: %v", c.expr, err)
+			continue
+		}
+		if got := spec.next(from).Format("2006-01-02 15:04"); got != c.want {
+			t.Errorf("%q next after %s is %s, want %s", c.expr, from, got, c.want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q parsed", expr)
+		}
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+	s := schedule{Cron: "0 9 * * 1-5", Duration: "8h", TZ: "America/New_York"}
+	if err := s.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	ny, _ := time.LoadLocation("America/New_York")
+	for _, c := range []struct {
+		now  time.Time
+		open bool
+		next time.Time
+	}{
+		{time.Date(2024, 3, 1, 12, 0, 0, 0, ny), true, time.Date(2024, 3, 1, 17, 0, 0, 0, ny)},
+		{time.Date(2024, 3, 1, 18, 0, 0, 0, ny), false, time.Date(2024, 3, 4, 9, 0, 0, 0, ny)},
+		{time.Date(2024, 3, 4, 8, 59, 0, 0, ny), false, time.Date(2024, 3, 4, 9, 0, 0, 0, ny)},
+	} {
+		open, next, err := s.at(c.now.UTC())
+		if err != nil || open != c.open || !next.Equal(c.next) {
+			t.Errorf("at %s got %v until %s, %v, want %v until %s", c.now, open, next, err, c.open, c.next)
+		}
+		if withholds, _, _ := s.withholds(c.now); withholds == c.open {
+			t.Errorf("at %s an announce window withholds: %v", c.now, withholds)
+		}
+	}
+
+	for _, v := range []interface{}{
+		map[string]interface{}{"cron": "0 2 * * 6", "duration": "4h", "action": "pause"},
+		map[string]interface{}{"cron": "0 2 * * 6", "duration": "30s"},
+		map[string]interface{}{"cron": "0 2 * * 6", "duration": "4h", "tz": "Mars/Olympus"},
+		"0 2 * * 6",
+	} {
+		if _, err := parseSchedules(v); err == nil {
+			t.Errorf("schedule %v parsed", v)
+		}
+	}
+}
+
+func TestScheduleOverride(t *testing.T) {
+	n, sp := newFakeNetwork(), newFakeSpeaker(false)
+	agent := newTestAgent(Config{}, sp, n)
+	// a maintenance window that never closes
+	customData := map[string]interface{}{"BGP_ANNOUNCE": []interface{}{
+		"192.0.2.1/32",
+		map[string]interface{}{"prefix": "198.51.100.0/24", "schedule": map[string]interface{}{"cron": "* * * * *", "duration": "1h", "action": "withdraw"}},
+	}}
+	if !agent.update(&metadata.CurrentDevice{CustomData: customData}) {
+		t.Fatal("update didn't change anything")
+	}
+	if err := agent.EnsureBGP(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(sp.announced()), "[192.0.2.1/32]"; got != want {
+		t.Errorf("announced %s, want %s", got, want)
+	}
+	status := agent.Status().Prefixes["198.51.100.0/24"]
+	if status.Schedule == nil || !status.Schedule.Withheld || status.Schedule.NextTransition != nil {
+		t.Errorf("scheduled prefix has schedule status %+v, want withheld with no transition", status.Schedule)
+	}
+	if want := `schedule: in maintenance window withdraw "* * * * *" for 1h in UTC`; status.Reason != want {
+		t.Errorf("scheduled prefix has reason %q, want %q", status.Reason, want)
+	}
+
+	// without a transition an override needs an end
+	if s, err := agent.Override("198.51.100.0/24", true, time.Time{}); s != nil || err == nil {
+		t.Errorf("override without an end got %+v, %v", s, err)
+	}
+	if s, err := agent.Override("203.0.113.0/24", true, time.Now().Add(time.Hour)); s != nil || err == nil {
+		t.Errorf("override of a prefix that isn't desired got %+v, %v", s, err)
+	}
+	until := time.Now().Add(time.Hour)
+	s, err := agent.Override("198.51.100.0/24", true, until)
+	if err != nil || s == nil || s.Withheld || s.NextTransition == nil || !s.NextTransition.Equal(until) {
+		t.Fatalf("override got %+v, %v", s, err)
+	}
+	if got, want := fmt.Sprint(sp.announced()), "[192.0.2.1/32 198.51.100.0/24]"; got != want {
+		t.Errorf("announced %s with the override, want %s", got, want)
+	}
+
+	// a host override withdraws everything that isn't overridden itself
+	if _, err := agent.Override(hostSchedule, false, until); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(sp.announced()), "[198.51.100.0/24]"; got != want {
+		t.Errorf("announced %s with the host withdrawn, want %s", got, want)
+	}
+	if err := agent.ClearOverride(hostSchedule); err != nil {
+		t.Fatal(err)
+	}
+
+	// the API normalizes the prefix like it does when overriding
+	for _, c := range []struct {
+		prefix string
+		want   int
+	}{
+		{"198.51.100.7/24", http.StatusNoContent},
+		{"198.51.100.0/24", http.StatusNotFound},
+		{"198.51.100", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		agent.handleSchedule(w, httptest.NewRequest(http.MethodDelete, "/schedule?prefix="+c.prefix, nil))
+		if w.Code != c.want {
+			t.Errorf("clearing the override of %s got %d, want %d", c.prefix, w.Code, c.want)
+		}
+	}
+	if got, want := fmt.Sprint(sp.announced()), "[192.0.2.1/32]"; got != want {
+		t.Errorf("announced %s after clearing the override, want %s", got, want)
+	}
+
+	// expired overrides are dropped
+	agent.mu.Lock()
+	agent.scheduleOverrides["198.51.100.0/24"] = scheduleOverride{Announce: true, Until: time.Now().Add(-time.Second)}
+	agent.evaluateSchedules(time.Now())
+	_, ok := agent.scheduleOverrides["198.51.100.0/24"]
+	agent.mu.Unlock()
+	if ok {
+		t.Error("expired override wasn't dropped")
+	}
+
+	// a slow client listing the schedules doesn't hold up the agent
+	w := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan bool), release: make(chan bool)}
+	go agent.handleSchedule(w, httptest.NewRequest(http.MethodGet, "/schedule", nil))
+	<-w.writing
+	locked := make(chan bool)
+	go func() {
+		agent.mu.Lock()
+		agent.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Error("the agent is locked while the schedules are written")
+	}
+	close(w.release)
+}
+
+func TestPrefixSchedules(t *testing.T) {
+	businessHours := map[string]interface{}{"cron": "0 9 * * 1-5", "duration": "8h"}
+	maintenance := map[string]interface{}{"cron": "0 12 * * 3", "duration": "1h", "action": "withdraw"}
+	anns, err := parseAnnouncements([]interface{}{
+		map[string]interface{}{"prefix": "192.0.2.1/32", "schedule": []interface{}{businessHours, maintenance}},
+		map[string]interface{}{"prefix": "192.0.2.2/32", "schedule": businessHours},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anns[0].Schedule) != 2 || len(anns[1].Schedule) != 1 {
+		t.Fatalf("parsed schedules %v and %v, want 2 and 1", anns[0].Schedule, anns[1].Schedule)
+	}
+	for _, invalid := range []interface{}{
+		[]interface{}{businessHours, map[string]interface{}{"cron": "0 12 * * 3"}},
+		"0 9 * * 1-5",
+	} {
+		if _, err := parseAnnouncement(map[string]interface{}{"prefix": "192.0.2.1/32", "schedule": invalid}); err == nil {
+			t.Errorf("schedule %v parsed", invalid)
+		}
+	}
+
+	agent := newTestAgent(Config{}, newFakeSpeaker(false), newFakeNetwork())
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	agent.Announcements = anns
+	// both windows apply to the first prefix, only business hours to the second
+	for _, c := range []struct {
+		now      time.Time
+		withheld string
+		reason   string
+		next     time.Time
+	}{
+		{time.Date(2024, 3, 6, 10, 0, 0, 0, time.UTC), "", "", time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 6, 12, 30, 0, 0, time.UTC), "192.0.2.1/32", "in maintenance window", time.Date(2024, 3, 6, 13, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 6, 18, 0, 0, 0, time.UTC), "192.0.2.1/32 192.0.2.2/32", "outside window", time.Date(2024, 3, 7, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 7, 12, 30, 0, 0, time.UTC), "", "", time.Date(2024, 3, 7, 17, 0, 0, 0, time.UTC)},
+	} {
+		agent.evaluateSchedules(c.now)
+		var withheld []string
+		for _, prefix := range []string{"192.0.2.1/32", "192.0.2.2/32"} {
+			if agent.scheduleWithheld(prefix) {
+				withheld = append(withheld, prefix)
+			}
+		}
+		status := agent.schedules["192.0.2.1/32"]
+		if got := strings.Join(withheld, " "); got != c.withheld || !strings.Contains(status.Reason, c.reason) {
+			t.Errorf("at %s withheld %q because %q, want %q because %q", c.now, got, status.Reason, c.withheld, c.reason)
+		}
+		if status.NextTransition == nil || !status.NextTransition.Equal(c.next) {
+			t.Errorf("at %s the next transition is %v, want %s", c.now, status.NextTransition, c.next)
+		}
+	}
+}
+
+// blockingWriter signals writing when a response is written and waits for release before taking it
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	writing chan bool
+	release chan bool
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	close(w.writing)
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
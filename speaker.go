@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+
+	gobgpApi "github.com/osrg/gobgp/api"
+	gobgpServer "github.com/osrg/gobgp/server"
+)
+
+const (
+	speakerGobgp = "gobgp"
+	speakerFRR   = "frr"
+	speakerBIRD  = "bird"
+)
+
+// speaker is the BGP daemon that announces the agent's prefixes to the Packet routers
+type speaker interface {
+	Start(asn uint32, routerID string) error
+	AddNeighbor(address string, peerAS uint32, password string) error
+	Announce(prefix string, r *route) error
+	Withdraw(prefix string) error
+	// Persistent reports whether announcements outlive the agent, i.e. the daemon isn't embedded
+	Persistent() bool
+	// SessionState returns the state of the session to the Packet router, e.g. "established"
+	SessionState() (string, error)
+}
+
+// newSpeaker returns the speaker cfg.Speaker names
+func newSpeaker(cfg Config) (speaker, error) {
+	switch cfg.Speaker {
+	case speakerGobgp, "":
+		return newGobgpSpeaker(cfg.GRPCAddr), nil
+	case speakerFRR:
+		return newFRRSpeaker(cfg.Vtysh), nil
+	case speakerBIRD:
+		return newBIRDSpeaker(cfg.BIRDConfig, cfg.Birdc)
+	}
+	return nil, fmt.Errorf("unknown speaker %q, must be %s, %s or %s", cfg.Speaker, speakerGobgp, speakerFRR, speakerBIRD)
+}
+
+// gobgpSpeaker runs gobgp embedded in the agent, along with its gRPC API
+type gobgpSpeaker struct {
+	server   *gobgpServer.BgpServer
+	grpc     *gobgpApi.Server
+	asn      uint32
+	neighbor string
+	peerPort uint16 // port the neighbor listens on, 179 if 0
+	flowspec bool   // negotiate IPv4 and IPv6 FlowSpec with the neighbor too
+	addPaths uint8  // most paths sent per prefix with ADD-PATH, 0 sends only one
+	// multipath makes gobgp notify changes to the set of equally good paths, not just the best one
+	multipath bool
+	paths     map[string][][]byte // UUIDs of the paths of a prefix, one per next hop
+	// listenAddr and listenPort are where gobgp accepts sessions, it doesn't listen if listenPort is 0
+	listenAddr string
+	listenPort int32
+}
+
+func newGobgpSpeaker(grpcAddr string) *gobgpSpeaker {
+	s := gobgpServer.NewBgpServer()
+	go s.Serve()
+
+	g := gobgpApi.NewGrpcServer(s, grpcAddr)
+	go g.Serve()
+
+	return &gobgpSpeaker{
+		server: s,
+		grpc:   g,
+		paths:  make(map[string][][]byte),
+	}
+}
+
+func (g *gobgpSpeaker) Start(asn uint32, routerID string) error {
+	g.asn = asn
+	// global configuration
+	global := &config.Global{
+		Config: config.GlobalConfig{
+			As:       asn,
+			RouterId: routerID,
+			Port:     -1, // gobgp won't listen on tcp:179,
+		},
+	}
+	global.UseMultiplePaths.Config.Enabled = g.multipath
+	if g.listenPort > 0 {
+		global.Config.Port = g.listenPort
+		global.Config.LocalAddressList = []string{g.listenAddr}
+	}
+	return g.server.Start(global)
+}
+
+func (g *gobgpSpeaker) AddNeighbor(address string, peerAS uint32, password string) error {
+	g.neighbor = address
+
+	// neighbor configuration
+	n := &config.Neighbor{
+		Config: config.NeighborConfig{
+			NeighborAddress: address,
+			PeerAs:          peerAS,
+			AuthPassword:    password,
+		},
+		Transport: config.Transport{
+			Config: config.TransportConfig{RemotePort: g.peerPort},
+		},
+	}
+	if g.addPaths > 0 {
+		n.AddPaths.Config.SendMax = g.addPaths
+	}
+	if g.flowspec {
+		// the unicast family gobgp picks by default has to be listed along with them
+		families := []config.AfiSafiType{config.AFI_SAFI_TYPE_IPV4_UNICAST, config.AFI_SAFI_TYPE_IPV4_FLOWSPEC, config.AFI_SAFI_TYPE_IPV6_FLOWSPEC}
+		if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+			families[0] = config.AFI_SAFI_TYPE_IPV6_UNICAST
+		}
+		for _, family := range families {
+			n.AfiSafis = append(n.AfiSafis, config.AfiSafi{Config: config.AfiSafiConfig{AfiSafiName: family, Enabled: true}})
+		}
+	}
+	return g.server.AddNeighbor(n)
+}
+
+func (g *gobgpSpeaker) Announce(prefix string, r *route) error {
+	if n := len(r.nextHops()); n > 1 && n > int(g.addPaths) {
+		return fmt.Errorf("%d next hops need ADD-PATH sending at least as many paths, see --add-paths", n)
+	}
+	paths, err := gobgpPaths(prefix, r, g.asn)
+	if err != nil {
+		return err
+	}
+	// a path with the same identifier implicitly replaces the announced one, the router sees a single
+	// update instead of a withdrawal and a re-announcement. The UUIDs keep referring to the prefix
+	uuids := g.paths[prefix]
+	for i, path := range paths {
+		if i < len(uuids) {
+			if err := g.server.UpdatePath("", []*table.Path{path}); err != nil {
+				return err
+			}
+			continue
+		}
+		uuid, err := g.server.AddPath("", []*table.Path{path})
+		if err != nil {
+			return err
+		}
+		uuids = append(uuids, uuid)
+		g.paths[prefix] = uuids
+	}
+	// the paths of next hops that went away
+	for len(uuids) > len(paths) {
+		if err := g.server.DeletePath(uuids[len(uuids)-1], 0, "", nil); err != nil {
+			return err
+		}
+		uuids = uuids[:len(uuids)-1]
+		g.paths[prefix] = uuids
+	}
+	return nil
+}
+
+func (g *gobgpSpeaker) Withdraw(prefix string) error {
+	uuids := g.paths[prefix]
+	for len(uuids) > 0 {
+		if err := g.server.DeletePath(uuids[len(uuids)-1], 0, "", nil); err != nil {
+			return err
+		}
+		uuids = uuids[:len(uuids)-1]
+		g.paths[prefix] = uuids
+	}
+	delete(g.paths, prefix)
+	return nil
+}
+
+func (g *gobgpSpeaker) Persistent() bool {
+	return false
+}
+
+func (g *gobgpSpeaker) SessionState() (string, error) {
+	for _, n := range g.server.GetNeighbor(g.neighbor, false) {
+		return string(n.State.SessionState), nil
+	}
+	return "", fmt.Errorf("no neighbor %s", g.neighbor)
+}
+
+// gobgpPaths builds a path for each next hop of r, told apart by their path identifiers
+func gobgpPaths(prefix string, r *route, asn uint32) ([]*table.Path, error) {
+	hops := r.nextHops()
+	paths := make([]*table.Path, 0, len(hops))
+	for i, hop := range hops {
+		single := *r
+		single.NextHop, single.ECMP = hop, nil
+		path, err := gobgpPath(prefix, &single, asn)
+		if err != nil {
+			return nil, err
+		}
+		path.GetNlri().SetPathIdentifier(uint32(i))
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// gobgpPath builds the path announcing prefix, IPv6 prefixes are carried in MP_REACH_NLRI. asn is
+// prepended as often as the route asks, gobgp adds it once more on its way out. It's the AS in AGGREGATOR
+// too
+func gobgpPath(prefix string, r *route, asn uint32) (*table.Path, error) {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := ipnet.Mask.Size()
+
+	attrs := []bgp.PathAttributeInterface{bgp.NewPathAttributeOrigin(0)}
+	var nlri bgp.AddrPrefixInterface
+	if ip.To4() != nil {
+		nlri = bgp.NewIPAddrPrefix(uint8(ones), ip.String())
+		attrs = append(attrs, bgp.NewPathAttributeNextHop(r.NextHop))
+	} else {
+		nlri = bgp.NewIPv6AddrPrefix(uint8(ones), ip.String())
+		attrs = append(attrs, bgp.NewPathAttributeMpReachNLRI(r.NextHop, []bgp.AddrPrefixInterface{nlri}))
+	}
+	if r.MED > 0 {
+		attrs = append(attrs, bgp.NewPathAttributeMultiExitDisc(r.MED))
+	}
+	if r.Prepend > 0 {
+		asns := make([]uint32, r.Prepend)
+		for i := range asns {
+			asns[i] = asn
+		}
+		attrs = append(attrs, bgp.NewPathAttributeAsPath([]bgp.AsPathParamInterface{
+			bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, asns),
+		}))
+	}
+	if len(r.Communities) > 0 {
+		communities := make([]uint32, 0, len(r.Communities))
+		for _, c := range r.Communities {
+			community, err := parseCommunity(c)
+			if err != nil {
+				return nil, err
+			}
+			communities = append(communities, community)
+		}
+		attrs = append(attrs, bgp.NewPathAttributeCommunities(communities))
+	}
+	if r.Aggregator != "" {
+		attrs = append(attrs, bgp.NewPathAttributeAtomicAggregate(), bgp.NewPathAttributeAggregator(asn, r.Aggregator))
+	}
+	return table.NewPath(nil, nlri, false, attrs, time.Now(), false), nil
+}
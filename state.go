@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	sourceMetadata = "metadata"
+	sourceState    = "state"
+)
+
+const (
+	healthAnnounced = "announced"
+	healthWithdrawn = "withdrawn"
+	healthHeld      = "held"
+	healthError     = "error"
+)
+
+// prefixStatus is where a single prefix stands
+type prefixStatus struct {
+	Source    string            `json:"source"`
+	Link      string            `json:"link,omitempty"` // interface the address is placed on, empty if it isn't
+	Announced bool              `json:"announced"`
+	Route     *route            `json:"route,omitempty"`
+	RPKI      string            `json:"rpki,omitempty"` // origin validation state, when validating
+	Mesh      map[string]string `json:"mesh,omitempty"` // mesh peers publishing the prefix, and their state
+	Schedule  *scheduleStatus   `json:"schedule,omitempty"`
+	Health    string            `json:"health"`
+	Reason    string            `json:"reason,omitempty"`
+}
+
+// agentState is what the agent persists so a restart, or a crash, doesn't lose track of what it did
+type agentState struct {
+	// Desired is the last desired set that was applied without errors
+	Desired  []Announcement          `json:"desired"`
+	Prefixes map[string]prefixStatus `json:"prefixes"`
+	Links    []string                `json:"links,omitempty"` // VIP interfaces the agent created
+	Updated  time.Time               `json:"updated"`
+}
+
+// stateStore reads and atomically writes agentState to a file
+type stateStore struct {
+	path string
+}
+
+func newStateStore(path string) *stateStore {
+	return &stateStore{path: path}
+}
+
+// Load returns the saved state, or an empty one if nothing was saved yet
+func (s *stateStore) Load() (*agentState, error) {
+	state := &agentState{
+		Desired:  []Announcement{},
+		Prefixes: make(map[string]prefixStatus),
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save writes state atomically, so readers only ever see a complete file
+func (s *stateStore) Save(state *agentState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// AddLink records an interface the agent is about to create, so a crash before the next Save can't
+// leave it behind unowned
+func (s *stateStore) AddLink(name string) error {
+	state, err := s.Load()
+	if err != nil {
+		return err
+	}
+	for _, link := range state.Links {
+		if link == name {
+			return nil
+		}
+	}
+	state.Links = append(state.Links, name)
+	return s.Save(state)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestRestoreState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packet-bgp-agent-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	// the speaker is a daemon that outlives the agent, like FRR
+	n, sp := newFakeNetwork(), newFakeSpeaker(true)
+	start := func() *PacketBGPAgent {
+		agent := newTestAgent(Config{VIPInterface: "vip", InterfacePerGroup: true}, sp, n)
+		agent.State = newStateStore(path)
+		agent.VIPLinks.state = agent.State
+		agent.source = "" // nothing loaded from metadata yet
+		return agent
+	}
+	// a dummy interface someone else made
+	if err := n.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "vip-db"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := start()
+	if err := desire(first,
+		Announcement{Prefix: "192.0.2.1/32", Group: "web"},
+		Announcement{Prefix: "192.0.2.2/32", Group: "db"},
+		Announcement{Prefix: "192.0.2.3/32"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	// created right before a crash, so the state wasn't saved since
+	if err := first.VIPLinks.Ensure("vip-mail"); err != nil {
+		t.Fatal(err)
+	}
+	n.Ops()
+	sp.Ops()
+
+	second := start()
+	if err := second.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(second.VIPLinks.Owned()), "[vip vip-mail vip-web]"; got != want {
+		t.Errorf("adopted interfaces %s, want %s", got, want)
+	}
+	// the last good set is kept up until metadata has loaded
+	expectOps(t, "network", n.Ops())
+	expectOps(t, "speaker", sp.Ops())
+	if got := second.Status().Prefixes["192.0.2.1/32"]; got.Source != sourceState || !got.Announced {
+		t.Errorf("restored prefix has status %+v, want announced from %s", got, sourceState)
+	}
+
+	// then whatever is no longer desired is cleaned up
+	second.source = sourceMetadata
+	if err := desire(second, Announcement{Prefix: "192.0.2.3/32"}); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, "network", n.Ops(), "addr-del vip-web 192.0.2.1/32", "addr-del vip-db 192.0.2.2/32")
+	expectOps(t, "speaker", sp.Ops(), "withdraw 192.0.2.1/32", "withdraw 192.0.2.2/32")
+	if len(second.Status().Prefixes) != 1 {
+		t.Errorf("status lists %v, want only the desired prefix", second.Status().Prefixes)
+	}
+	state, err := second.State.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(len(state.Prefixes), state.Links), "1 [vip vip-mail vip-web]"; got != want {
+		t.Errorf("saved %s prefixes and links, want %s", got, want)
+	}
+
+	if err := second.VIPLinks.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	for name, kept := range map[string]bool{"vip": false, "vip-web": false, "vip-mail": false, "vip-db": true} {
+		if _, err := n.LinkByName(name); (err == nil) != kept {
+			t.Errorf("interface %s kept on teardown: %v, want %v", name, err == nil, kept)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysctlSetting is a kernel parameter the agent depends on, relative to <proc root>/sys
+type sysctlSetting struct {
+	Key        string   // e.g. net/ipv4/conf/all/rp_filter
+	Value      string   // value written when enforcing
+	Acceptable []string // values that are fine as they are, Value is always acceptable
+}
+
+func (s sysctlSetting) accepts(value string) bool {
+	if value == s.Value {
+		return true
+	}
+	for _, a := range s.Acceptable {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// sysctlDrift is a setting whose current value isn't acceptable
+type sysctlDrift struct {
+	Setting sysctlSetting
+	Current string
+}
+
+func (d sysctlDrift) String() string {
+	return fmt.Sprintf("%s is %s, want %s", d.Setting.Key, d.Current, d.Setting.Value)
+}
+
+// requiredSysctls returns the settings needed so VIPs on vipIface are only reachable through routing:
+// the uplinks must not answer ARP for them and rp_filter must not drop asymmetric traffic
+func requiredSysctls(vipIface string, uplinks []string) []sysctlSetting {
+	settings := []sysctlSetting{
+		{Key: "net/ipv4/conf/all/arp_ignore", Value: "1", Acceptable: []string{"2"}},
+		{Key: "net/ipv4/conf/all/arp_announce", Value: "2"},
+		{Key: "net/ipv4/conf/all/rp_filter", Value: "2", Acceptable: []string{"0"}},
+	}
+	settings = append(settings, vipLinkSysctls(vipIface)...)
+	for _, uplink := range uplinks {
+		settings = append(settings,
+			sysctlSetting{Key: "net/ipv4/conf/" + uplink + "/arp_ignore", Value: "1", Acceptable: []string{"2"}},
+			sysctlSetting{Key: "net/ipv4/conf/" + uplink + "/arp_announce", Value: "2"},
+			sysctlSetting{Key: "net/ipv4/conf/" + uplink + "/rp_filter", Value: "2", Acceptable: []string{"0"}},
+			sysctlSetting{Key: "net/ipv6/conf/" + uplink + "/disable_ipv6", Value: "0"},
+		)
+	}
+	return settings
+}
+
+// vipLinkSysctls returns the settings of an interface VIPs are placed on
+func vipLinkSysctls(name string) []sysctlSetting {
+	return []sysctlSetting{
+		{Key: "net/ipv4/conf/" + name + "/arp_ignore", Value: "1", Acceptable: []string{"2"}},
+		{Key: "net/ipv4/conf/" + name + "/arp_announce", Value: "2"},
+		// IPv6 has no ARP or rp_filter, but VIPs can only be placed when IPv6 is enabled
+		// and shouldn't sit in tentative state waiting on DAD
+		{Key: "net/ipv6/conf/" + name + "/disable_ipv6", Value: "0"},
+		{Key: "net/ipv6/conf/" + name + "/accept_dad", Value: "0"},
+	}
+}
+
+// sysctlManager checks, enforces and restores sysctls under a (possibly fake) /proc root. /proc/sys/net
+// shows the namespace of whoever reads it, so access happens from inside netns when one is set
+type sysctlManager struct {
+	root     string
+	netns    string
+	settings []sysctlSetting
+	original map[string]string
+}
+
+func newSysctlManager(procRoot, netnsName string, settings []sysctlSetting) *sysctlManager {
+	return &sysctlManager{
+		root:     procRoot,
+		netns:    netnsName,
+		settings: settings,
+		original: make(map[string]string),
+	}
+}
+
+func (m *sysctlManager) path(key string) string {
+	return filepath.Join(m.root, "sys", filepath.FromSlash(key))
+}
+
+func (m *sysctlManager) read(key string) (string, error) {
+	var b []byte
+	err := inNetns(m.netns, func() (err error) {
+		b, err = ioutil.ReadFile(m.path(key))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (m *sysctlManager) write(key, value string) error {
+	return inNetns(m.netns, func() error {
+		return ioutil.WriteFile(m.path(key), []byte(value+"\n"), 0644)
+	})
+}
+
+// Check returns every setting that has drifted from what the agent needs, settings that don't exist
+// (interface missing, IPv6 disabled in the kernel) are skipped
+func (m *sysctlManager) Check() ([]sysctlDrift, error) {
+	drift := make([]sysctlDrift, 0)
+	for _, s := range m.settings {
+		current, err := m.read(s.Key)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !s.accepts(current) {
+			drift = append(drift, sysctlDrift{Setting: s, Current: current})
+		}
+	}
+	return drift, nil
+}
+
+// Ensure logs any drift and, if enforce is set, corrects it, remembering the original values for Restore
+func (m *sysctlManager) Ensure(enforce bool) error {
+	drift, err := m.Check()
+	if err != nil {
+		return err
+	}
+	for _, d := range drift {
+		if !enforce {
+			log.Println("sysctl drift:", d)
+			continue
+		}
+		log.Println("sysctl drift, enforcing:", d)
+		if _, ok := m.original[d.Setting.Key]; !ok {
+			m.original[d.Setting.Key] = d.Current
+		}
+		if err := m.write(d.Setting.Key, d.Setting.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore writes back the values Ensure replaced
+func (m *sysctlManager) Restore() error {
+	var lastErr error
+	for key, value := range m.original {
+		if err := m.write(key, value); err != nil {
+			lastErr = err
+			continue
+		}
+		delete(m.original, key)
+	}
+	return lastErr
+}
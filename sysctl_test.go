@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSysctls(t *testing.T) {
+	root, err := ioutil.TempDir("", "packet-bgp-agent-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := func(key string) string {
+		return filepath.Join(root, "sys", filepath.FromSlash(key))
+	}
+	write := func(key, value string) {
+		if err := os.MkdirAll(filepath.Dir(path(key)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path(key), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(key string) string {
+		b, err := ioutil.ReadFile(path(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(b))
+	}
+
+	settings := requiredSysctls("vip", []string{"bond0"})
+	for _, s := range settings {
+		write(s.Key, s.Value)
+	}
+	write("net/ipv4/conf/all/arp_ignore", "2") // acceptable as it is
+	write("net/ipv4/conf/bond0/arp_ignore", "0")
+	write("net/ipv4/conf/all/rp_filter", "1")
+	// IPv6 disabled in the kernel
+	if err := os.RemoveAll(filepath.Join(root, "sys", "net", "ipv6")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newSysctlManager(root, "", settings)
+	drift, err := m.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[net/ipv4/conf/all/rp_filter is 1, want 2 net/ipv4/conf/bond0/arp_ignore is 0, want 1]"
+	if got := fmt.Sprint(drift); got != want {
+		t.Errorf("drift is %s, want %s", got, want)
+	}
+
+	// without enforcing drift is only logged
+	if err := m.Ensure(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("net/ipv4/conf/all/rp_filter"); got != "1" {
+		t.Errorf("rp_filter is %s without enforcing, want it untouched", got)
+	}
+
+	if err := m.Ensure(true); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := m.Check(); err != nil || len(drift) != 0 {
+		t.Errorf("drift after enforcing is %v, %v", drift, err)
+	}
+	if got := read("net/ipv4/conf/all/arp_ignore"); got != "2" {
+		t.Errorf("acceptable arp_ignore was changed to %s", got)
+	}
+
+	if err := m.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"net/ipv4/conf/all/rp_filter":    "1",
+		"net/ipv4/conf/bond0/arp_ignore": "0",
+		"net/ipv4/conf/vip/arp_announce": "2",
+	} {
+		if got := read(key); got != want {
+			t.Errorf("%s is %s after restoring, want %s", key, got, want)
+		}
+	}
+}